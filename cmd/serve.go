@@ -15,18 +15,37 @@
 package cmd
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/file"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/hybrid"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	redishandler "github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/redis"
+	s3handler "github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/s3"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/registry"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/tracing"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/upstream"
 	"github.com/dgraph-io/ristretto"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
 	"k8s.io/utils/env"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -36,96 +55,505 @@ func newCmdRegistry() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "registry",
 	}
-	cmd.AddCommand(newCmdServe())
+	cmd.AddCommand(newCmdServe(), newCmdWarm())
 	return cmd
 }
 
 func newCmdServe() *cobra.Command {
-	return &cobra.Command{
+	var address string
+	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "Serve an in-memory registry implementation",
-		Long: `This sub-command serves an in-memory registry implementation on port :8080 (or $PORT)
+		Long: `This sub-command serves an in-memory registry implementation on port :9000 (or $PORT) of all interfaces (or $LISTEN_ADDR)
 
 The command blocks while the server accepts pushes and pulls.
 
 Contents are only stored in memory, and when the process exits, pushed data is lost.`,
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			ctx := cmd.Context()
+			return runRegistry(cmd.Context(), "", true, address)
+		},
+	}
+	addAddressFlag(cmd, &address)
+	return cmd
+}
 
-			l := log.New(os.Stdout, "proxy-", log.LstdFlags)
+// addAddressFlag adds the --address flag overriding LISTEN_ADDR.
+func addAddressFlag(cmd *cobra.Command, address *string) {
+	cmd.Flags().StringVar(address, "address", "", "host or host:port to listen on, overrides LISTEN_ADDR")
+}
 
-			port, err := env.GetInt("PORT", 9000)
-			if err != nil {
-				l.Fatalln(err)
-			}
+// listenAddress returns the address to listen on: addr if it has a port, addr with the port otherwise.
+// IPv6 literals may be bracketed or not, [::] listens on all IPv4 and IPv6 interfaces.
+func listenAddress(addr string, port int) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(port))
+}
 
-			debug, _ := env.GetBool("DEBUG", false)
-			cacheTTL, _ := env.GetInt("MANIFEST_CACHE_TTL", 60)              // 1 minute
-			indexCacheTTL, _ := env.GetInt("INDEX_CACHE_TTL", 3600*4)        // 4 hours
-			indexErrorCacheTTL, _ := env.GetInt("INDEX_ERROR_CACHE_TTL", 30) // 30 seconds
+// runRegistry sets the registry up from the env vars, the address overrides LISTEN_ADDR if not empty.
+// Charts listed in the warm file get pulled first, then the registry is served unless keepServing is false.
+func runRegistry(ctx context.Context, warmFile string, keepServing bool, address string) error {
+	var l logrus.StdLogger = log.New(os.Stdout, "proxy-", log.LstdFlags)
+	switch logFormat := env.GetString("LOG_FORMAT", "text"); logFormat {
+	case "text":
+	case "json":
+		jsonLogger := logrus.New()
+		jsonLogger.SetOutput(os.Stdout)
+		jsonLogger.SetFormatter(&logrus.JSONFormatter{})
+		l = jsonLogger
+	default:
+		l.Fatalf("invalid LOG_FORMAT %q, expected text or json", logFormat)
+	}
 
-			useTLS, _ := env.GetBool("USE_TLS", false)
-			certFile := env.GetString("CERT_FILE", "certs/registry.pem")
-			keyfileFile := env.GetString("KEY_FILE", "certs/registry-key.pem")
+	port, err := env.GetInt("PORT", 9000)
+	if err != nil {
+		l.Fatalln(err)
+	}
+	if address == "" {
+		address = env.GetString("LISTEN_ADDR", "0.0.0.0")
+	}
+	address = listenAddress(address, port)
 
-			listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
-			if err != nil {
-				l.Fatalln(err)
-			}
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		l.Fatalf("setting up tracing: %v", err)
+	}
+	defer func() {
+		// the command context is done by now, give pending spans a moment to get exported
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			l.Printf("flushing traces: %v", err)
+		}
+	}()
 
-			portI := listener.Addr().(*net.TCPAddr).Port
+	debug, _ := env.GetBool("DEBUG", false)
+	prettyJSON, _ := env.GetBool("PRETTY_JSON", false)
+	metricsEnabled, _ := env.GetBool("METRICS_ENABLED", false)
+	maxInflight, _ := env.GetInt("MAX_INFLIGHT", 0)                  // unlimited
+	cacheTTL, _ := env.GetInt("MANIFEST_CACHE_TTL", 60)              // 1 minute
+	indexCacheTTL, _ := env.GetInt("INDEX_CACHE_TTL", 3600*4)        // 4 hours
+	indexErrorCacheTTL, _ := env.GetInt("INDEX_ERROR_CACHE_TTL", 30) // 30 seconds
+	notFoundCacheTTL, _ := env.GetInt("NOTFOUND_CACHE_TTL", 10)      // 10 seconds
+	blobCacheTTL, _ := env.GetInt("BLOB_CACHE_TTL", 0)               // deleted together with manifests
+	knownDigestTTL, _ := env.GetInt("KNOWN_DIGEST_TTL", 86400)       // 1 day
+	versionIndex, _ := env.GetBool("SERVE_VERSION_INDEX", false)
+	indexNotFoundCacheTTL, _ := env.GetInt("INDEX_NOTFOUND_CACHE_TTL", 300) // 5 minutes
+	responseCacheMaxAge, _ := env.GetInt("RESPONSE_CACHE_MAX_AGE", 0)       // no Cache-Control
+	parentRegistry := env.GetString("PARENT_REGISTRY", "")
+	requireExplicitVersion, _ := env.GetBool("REQUIRE_EXPLICIT_VERSION", false)
+	maxRepos, _ := env.GetInt("MAX_CACHED_REPOS", 0)
+	maxManifests, _ := env.GetInt("MAX_CACHED_MANIFESTS", 0)
+	ociUpstreams := splitList(env.GetString("OCI_UPSTREAM_HOSTS", ""))
+	allowedUpstreamHosts := splitList(env.GetString("ALLOWED_UPSTREAM_HOSTS", ""))
+	deniedUpstreamHosts := splitList(env.GetString("DENIED_UPSTREAM_HOSTS", ""))
+	revalidateMaxAge, _ := env.GetInt("REVALIDATE_MAX_AGE", 0) // disabled
+	siblingPolicy := manifest.SiblingPolicy(env.GetString("SIBLING_POLICY", string(manifest.SiblingsProvenance)))
+	if !siblingPolicy.Valid() {
+		l.Fatalf("invalid SIBLING_POLICY %q", siblingPolicy)
+	}
+	createdPolicy := manifest.CreatedPolicy(env.GetString("CREATED_TIMESTAMP_POLICY", string(manifest.CreatedFromChart)))
+	if !createdPolicy.Valid() {
+		l.Fatalf("invalid CREATED_TIMESTAMP_POLICY %q", createdPolicy)
+	}
 
-			indexCache, err := ristretto.NewCache(&ristretto.Config{
-				NumCounters: 1e7,       // number of keys to track frequency of (10M).
-				MaxCost:     100000000, // maximum cost of cache (1GB).
-				BufferItems: 64,        // number of keys per Get buffer.
-			})
-			if err != nil {
-				l.Fatalln(err)
+	upstreamDNS := env.GetString("UPSTREAM_DNS", "")
+	upstreamUserAgent := env.GetString("UPSTREAM_USER_AGENT", upstream.DefaultUserAgent())
+	upstreamTimeout, _ := env.GetInt("UPSTREAM_HTTP_TIMEOUT", 120)            // 2 minutes
+	upstreamDialTimeout, _ := env.GetInt("UPSTREAM_DIAL_TIMEOUT", 30)         // 30 seconds
+	upstreamTLSTimeout, _ := env.GetInt("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10) // 10 seconds
+	upstreamCAFile := env.GetString("UPSTREAM_CA_FILE", "")
+	allowPrivateUpstream, _ := env.GetBool("ALLOW_PRIVATE_UPSTREAM", false)
+	upstreamMaxRetries, _ := env.GetInt("UPSTREAM_MAX_RETRIES", 2)
+	upstreamRetryBackoff, _ := env.GetInt("UPSTREAM_RETRY_BACKOFF", 500) // milliseconds
+	preserveVersionPrefix, _ := env.GetBool("PRESERVE_VERSION_PREFIX", false)
+	exposeValuesLayer, _ := env.GetBool("EXPOSE_VALUES_LAYER", false)
+	verifyChartDigest, _ := env.GetBool("VERIFY_CHART_DIGEST", true)
+	copyConcurrency, _ := env.GetInt("COPY_CONCURRENCY", 1)
+	maxChartSize, _ := env.GetInt("MAX_CHART_SIZE", 100) // megabytes
+	maxIndexSize, _ := env.GetInt("MAX_INDEX_SIZE", 50)  // megabytes
+	allowPrereleaseLatest, _ := env.GetBool("ALLOW_PRERELEASE_LATEST", false)
+	maxConcurrentDownloads, _ := env.GetInt("MAX_CONCURRENT_DOWNLOADS", 0) // unlimited
+	downloadQueueTimeout, _ := env.GetInt("DOWNLOAD_QUEUE_TIMEOUT", 10)    // seconds
+	indexOnly, _ := env.GetBool("INDEX_ONLY", false)
+	helmHTTP, _ := env.GetBool("ENABLE_HELM_HTTP", false)
+	rejectLibraryCharts, _ := env.GetBool("REJECT_LIBRARY_CHARTS", false)
+	keepInvalidChartVersions, _ := env.GetBool("KEEP_INVALID_CHART_VERSIONS", false)
+	maxConcurrentIndexDownloads, _ := env.GetInt("MAX_CONCURRENT_INDEX_DOWNLOADS", 0) // unlimited
+	defaultPageSize, _ := env.GetInt("DEFAULT_PAGE_SIZE", 0)                          // all tags, 10000 repos
+	maxPageSize, _ := env.GetInt("MAX_PAGE_SIZE", 0)                                  // unlimited
+	// artifact manifests aren't converted, clients not accepting their media type, such as older Helm, get a 406
+	artifactManifests, _ := env.GetBool("ARTIFACT_MANIFESTS", false)
+	upstreamScheme := env.GetString("UPSTREAM_SCHEME", "https")
+	if upstreamScheme != "http" && upstreamScheme != "https" {
+		l.Fatalf("invalid UPSTREAM_SCHEME %q, expected http or https", upstreamScheme)
+	}
+	upstreamSchemes := map[string]string{}
+	for host, scheme := range prefixedEnv("UPSTREAM_SCHEME_") {
+		if scheme != "http" && scheme != "https" {
+			l.Fatalf("invalid UPSTREAM_SCHEME_%s %q, expected http or https", host, scheme)
+		}
+		upstreamSchemes[strings.ToLower(host)] = scheme
+	}
+	upstreamAuth := map[string]manifest.BasicCredentials{}
+	for host, value := range prefixedEnv("UPSTREAM_AUTH_") {
+		username, password, ok := strings.Cut(value, ":")
+		if !ok {
+			l.Fatalf("invalid UPSTREAM_AUTH_%s, expected user:password", host)
+		}
+		upstreamAuth[strings.ToLower(host)] = manifest.BasicCredentials{Username: username, Password: password}
+	}
+	cacheTTLOverrides := map[string]time.Duration{}
+	for host, value := range prefixedEnv("CACHE_TTL_OVERRIDE_") {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			// plain seconds like the other TTLs
+			seconds, serr := strconv.Atoi(value)
+			if serr != nil || seconds < 0 {
+				l.Fatalf("invalid CACHE_TTL_OVERRIDE_%s %q, expected a duration like 1h or seconds", host, value)
 			}
-
-			blobsHandler := mem.NewMemHandler()
-
-			manifests := manifest.NewManifests(ctx, blobsHandler, manifest.Config{
-				Debug:              debug,
-				CacheTTL:           time.Duration(cacheTTL) * time.Second,
-				IndexCacheTTL:      time.Duration(indexCacheTTL) * time.Second,
-				IndexErrorCacheTTl: time.Duration(indexErrorCacheTTL) * time.Second,
-			}, indexCache, l)
-
-			blobsHttpHandler := blobs.NewBlobs(blobsHandler, l)
-			//blobsHandler = file.NewHandler(dbLocation)
-			s := &http.Server{
-				ReadHeaderTimeout: 5 * time.Second, // prevent slowloris, quiet linter
-				Handler: registry.New(
-					manifests.Handle,
-					blobsHttpHandler.Handle,
-					manifests.HandleTags,
-					manifests.HandleCatalog,
-					registry.Debug(debug), registry.Logger(l)),
+			ttl = time.Duration(seconds) * time.Second
+		}
+		cacheTTLOverrides[strings.ToLower(host)] = ttl
+	}
+	repoAliases := map[string]string{}
+	for alias, target := range prefixedEnv("REPO_ALIAS_") {
+		if target = strings.Trim(target, "/"); target == "" {
+			l.Fatalf("invalid REPO_ALIAS_%s, expected an upstream host/path", alias)
+		}
+		repoAliases[strings.ToLower(alias)] = target
+	}
+	virtualRepos := map[string][]string{}
+	for name, value := range prefixedEnv("VIRTUAL_REPO_") {
+		var paths []string
+		for _, p := range splitList(value) {
+			if p = strings.Trim(p, "/"); p != "" {
+				paths = append(paths, p)
 			}
+		}
+		if len(paths) == 0 {
+			l.Fatalf("invalid VIRTUAL_REPO_%s, expected comma separated upstream host/paths", name)
+		}
+		virtualRepos[strings.ToLower(name)] = paths
+	}
+	virtualConflictPolicy := manifest.MergePolicy(env.GetString("VIRTUAL_CONFLICT_POLICY", string(manifest.MergeOverride)))
+	if !virtualConflictPolicy.Valid() {
+		l.Fatalf("invalid VIRTUAL_CONFLICT_POLICY %q, expected override or error", virtualConflictPolicy)
+	}
+	proxyUsers := map[string]string{}
+	for _, item := range splitList(env.GetString("PROXY_AUTH_USERS", "")) {
+		username, password, ok := strings.Cut(item, ":")
+		if !ok || username == "" {
+			l.Fatalln("invalid PROXY_AUTH_USERS, expected comma separated user:password pairs")
+		}
+		proxyUsers[username] = password
+	}
+	proxyAuthRealm := env.GetString("PROXY_AUTH_REALM", "helm-charts-oci-proxy")
+	proxyAuthMode := env.GetString("PROXY_AUTH_MODE", "basic")
+	if proxyAuthMode != "basic" && proxyAuthMode != "token" {
+		l.Fatalf("invalid PROXY_AUTH_MODE %q, expected basic or token", proxyAuthMode)
+	}
+	tokenKey := []byte(env.GetString("PROXY_AUTH_TOKEN_KEY", ""))
+	if proxyAuthMode == "token" && len(tokenKey) == 0 {
+		// tokens issued before a restart or by other replicas are not accepted then
+		tokenKey = make([]byte, 32)
+		if _, err := rand.Read(tokenKey); err != nil {
+			l.Fatalln(err)
+		}
+	}
+	tokenTTL, _ := env.GetInt("PROXY_AUTH_TOKEN_TTL", 300) // 5 minutes
+	tokenService := env.GetString("PROXY_AUTH_TOKEN_SERVICE", "helm-charts-oci-proxy")
+	tokenRealm := env.GetString("PROXY_AUTH_TOKEN_REALM", "") // the token endpoint at the requested host
+	adminToken := env.GetString("ADMIN_TOKEN", "")            // disables the admin endpoints
+	var signer crypto.Signer
+	if signingKey := env.GetString("SIGNING_KEY", ""); signingKey != "" {
+		if signer, err = manifest.LoadSigningKey(signingKey); err != nil {
+			l.Fatalf("loading SIGNING_KEY: %v", err)
+		}
+	}
 
-			errCh := make(chan error)
-			go func() {
-				if useTLS {
-					l.Printf("listening HTTP over TLS serving on port %d", portI)
-					errCh <- s.ServeTLS(listener, certFile, keyfileFile)
-				} else {
-					l.Printf("listening HTTP on port %d", portI)
-					errCh <- s.Serve(listener)
-				}
-			}()
-
-			<-ctx.Done()
-			l.Println("shutting down...")
-			if err := s.Shutdown(ctx); err != nil {
-				return err
+	manifestPersistPath := env.GetString("MANIFEST_PERSIST_PATH", "")
+	indexCacheDir := env.GetString("INDEX_CACHE_DIR", "")
+	blobBackend := env.GetString("BLOB_BACKEND", "mem")
+	blobMemThreshold, _ := env.GetInt("BLOB_MEM_THRESHOLD", 0) // kilobytes, all blobs in memory
+	blobSpillDir := env.GetString("BLOB_SPILL_DIR", filepath.Join(os.TempDir(), "helm-charts-oci-proxy-blobs"))
+	blobDir := env.GetString("BLOB_DIR", "")
+	blobRedirectBaseURL := env.GetString("BLOB_REDIRECT_BASE_URL", "") // serve blobs through the proxy
+	redisAddr := env.GetString("REDIS_ADDR", "localhost:6379")
+	redisPassword := env.GetString("REDIS_PASSWORD", "")
+	redisBlobTTL, _ := env.GetInt("REDIS_BLOB_TTL", 0) // no expiry
+	s3Bucket := env.GetString("S3_BUCKET", "")
+	s3Endpoint := env.GetString("S3_ENDPOINT", "s3.amazonaws.com")
+	s3Region := env.GetString("S3_REGION", "")
+	s3UseSSL, _ := env.GetBool("S3_USE_SSL", true)
+	s3PresignTTL, _ := env.GetInt("S3_PRESIGN_TTL", 0) // serve blobs through the proxy
+
+	useTLS, _ := env.GetBool("USE_TLS", false)
+	certFile := env.GetString("CERT_FILE", "certs/registry.pem")
+	keyfileFile := env.GetString("KEY_FILE", "certs/registry-key.pem")
+
+	indexCache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,       // number of keys to track frequency of (10M).
+		MaxCost:     100000000, // maximum cost of cache (1GB).
+		BufferItems: 64,        // number of keys per Get buffer.
+	})
+	if err != nil {
+		l.Fatalln(err)
+	}
+	var cache manifest.Cache = indexCache
+	if indexCacheDir != "" {
+		if cache, err = manifest.NewFileCache(indexCacheDir, indexCache, l); err != nil {
+			l.Fatalf("opening INDEX_CACHE_DIR: %v", err)
+		}
+	}
+
+	var blobsHandler handler.BlobHandler
+	switch blobBackend {
+	case "mem":
+		blobsHandler = mem.NewMemHandler()
+		if blobMemThreshold > 0 {
+			if err := os.MkdirAll(blobSpillDir, 0o755); err != nil {
+				l.Fatalf("creating BLOB_SPILL_DIR: %v", err)
 			}
-			if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			blobsHandler = hybrid.NewHandler(int64(blobMemThreshold)<<10, blobSpillDir)
+		}
+	case "file":
+		if blobDir == "" {
+			l.Fatalln("BLOB_DIR is required for BLOB_BACKEND=file")
+		}
+		if err := os.MkdirAll(blobDir, 0o755); err != nil {
+			l.Fatalf("creating BLOB_DIR: %v", err)
+		}
+		blobsHandler = file.NewHandler(blobDir)
+		if blobRedirectBaseURL != "" {
+			blobsHandler = file.NewRedirectHandler(blobDir, blobRedirectBaseURL)
+		}
+	case "redis":
+		blobsHandler = redishandler.NewHandler(redis.NewClient(&redis.Options{
+			Addr:     redisAddr,
+			Password: redisPassword,
+		}), time.Duration(redisBlobTTL)*time.Second)
+	case "s3":
+		s3Client, err := minio.New(s3Endpoint, &minio.Options{
+			// static keys from S3_ACCESS_KEY/S3_SECRET_KEY, otherwise the AWS env vars or the instance's IAM role
+			Creds: credentials.NewChainCredentials([]credentials.Provider{
+				&credentials.Static{Value: credentials.Value{
+					AccessKeyID:     env.GetString("S3_ACCESS_KEY", ""),
+					SecretAccessKey: env.GetString("S3_SECRET_KEY", ""),
+					SignerType:      credentials.SignatureV4,
+				}},
+				&credentials.EnvAWS{},
+				&credentials.IAM{},
+			}),
+			Secure: s3UseSSL,
+			Region: s3Region,
+		})
+		if err != nil {
+			l.Fatalln(err)
+		}
+		if s3Bucket == "" {
+			l.Fatalln("S3_BUCKET is required for BLOB_BACKEND=s3")
+		}
+		blobsHandler = s3handler.NewHandler(s3Client, s3Bucket, time.Duration(s3PresignTTL)*time.Second)
+	default:
+		l.Fatalf("invalid BLOB_BACKEND %q, expected mem, file, redis or s3", blobBackend)
+	}
+	var upstreamCAs *x509.CertPool
+	if upstreamCAFile != "" {
+		upstreamCAs, err = upstream.LoadCAFile(upstreamCAFile)
+		if err != nil {
+			l.Fatalf("loading UPSTREAM_CA_FILE: %v", err)
+		}
+	}
+	var trustedHosts []string
+	if u, err := url.Parse(parentRegistry); err == nil && u.Host != "" {
+		// the parent registry is configured by the operator and often runs in the same network
+		trustedHosts = append(trustedHosts, u.Host)
+	}
+	upstreamClient := upstream.NewClient(upstream.Config{
+		DNS:                 upstreamDNS,
+		DialTimeout:         time.Duration(upstreamDialTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(upstreamTLSTimeout) * time.Second,
+		Timeout:             time.Duration(upstreamTimeout) * time.Second,
+		RootCAs:             upstreamCAs,
+		AllowPrivate:        allowPrivateUpstream,
+		TrustedHosts:        trustedHosts,
+		UserAgent:           upstreamUserAgent,
+	})
+
+	var manifestStore manifest.ManifestStore
+	if manifestPersistPath != "" {
+		badgerStore, err := manifest.NewBadgerStore(manifestPersistPath)
+		if err != nil {
+			l.Fatalf("opening MANIFEST_PERSIST_PATH: %v", err)
+		}
+		defer badgerStore.Close()
+		manifestStore = badgerStore
+	}
+
+	manifests := manifest.NewManifests(ctx, blobsHandler, manifest.Config{
+		Debug:              debug,
+		CacheTTL:           time.Duration(cacheTTL) * time.Second,
+		IndexCacheTTL:      time.Duration(indexCacheTTL) * time.Second,
+		IndexErrorCacheTTl: time.Duration(indexErrorCacheTTL) * time.Second,
+		NotFoundCacheTTL:   time.Duration(notFoundCacheTTL) * time.Second,
+		RepoAliases:        repoAliases,
+		VersionIndex:       versionIndex,
+		ParentRegistry:     parentRegistry,
+
+		RequireExplicitVersion: requireExplicitVersion,
+		MaxRepos:               maxRepos,
+		OCIUpstreams:           ociUpstreams,
+		RevalidateMaxAge:       time.Duration(revalidateMaxAge) * time.Second,
+		SiblingPolicy:          siblingPolicy,
+		Client:                 upstreamClient,
+		BlobCacheTTL:           time.Duration(blobCacheTTL) * time.Second,
+		RejectLibraryCharts:    rejectLibraryCharts,
+		Signer:                 signer,
+		UpstreamAuth:           upstreamAuth,
+		UpstreamScheme:         upstreamScheme,
+		UpstreamSchemes:        upstreamSchemes,
+		Store:                  manifestStore,
+		MaxRetries:             upstreamMaxRetries,
+		RetryBackoff:           time.Duration(upstreamRetryBackoff) * time.Millisecond,
+		PreserveVersionPrefix:  preserveVersionPrefix,
+		ExposeValuesLayer:      exposeValuesLayer,
+		VerifyChartDigest:      verifyChartDigest,
+		AllowedUpstreamHosts:   allowedUpstreamHosts,
+		DeniedUpstreamHosts:    deniedUpstreamHosts,
+		CopyConcurrency:        copyConcurrency,
+		MaxChartSize:           int64(maxChartSize) << 20,
+		MaxIndexSize:           int64(maxIndexSize) << 20,
+		AllowPrereleaseLatest:  allowPrereleaseLatest,
+		CreatedPolicy:          createdPolicy,
+		MaxConcurrentDownloads: maxConcurrentDownloads,
+		DownloadQueueTimeout:   time.Duration(downloadQueueTimeout) * time.Second,
+		MaxManifests:           maxManifests,
+		HelmHTTP:               helmHTTP,
+		IndexNotFoundCacheTTL:  time.Duration(indexNotFoundCacheTTL) * time.Second,
+		ResponseCacheMaxAge:    time.Duration(responseCacheMaxAge) * time.Second,
+		CacheTTLOverrides:      cacheTTLOverrides,
+		VirtualRepos:           virtualRepos,
+		VirtualRepoConflicts:   virtualConflictPolicy,
+
+		KeepInvalidChartVersions:    keepInvalidChartVersions,
+		MaxConcurrentIndexDownloads: maxConcurrentIndexDownloads,
+		DefaultPageSize:             defaultPageSize,
+		MaxPageSize:                 maxPageSize,
+		ArtifactManifests:           artifactManifests,
+		KnownDigestTTL:              time.Duration(knownDigestTTL) * time.Second,
+	}, cache, l)
+	// runs before the deferred close of the store, so warming and shutting down keep the queued changes
+	defer manifests.Flush()
+
+	blobsHttpHandler := blobs.NewBlobs(blobsHandler, blobs.Config{
+		Debug:          debug,
+		ParentRegistry: parentRegistry,
+		Client:         upstreamClient,
+		CacheMaxAge:    time.Duration(responseCacheMaxAge) * time.Second,
+	}, l)
+	opts := []registry.Option{registry.Debug(debug), registry.Logger(l), registry.PrettyJSON(prettyJSON), registry.MaxInflight(maxInflight), registry.Referrers(manifests.HandleReferrers), registry.Ready(blobsReady(blobsHandler)), registry.DebugIndex(manifests.HandleDebugIndex)}
+	if indexOnly || helmHTTP {
+		opts = append(opts, registry.Index(manifests.HandleIndex))
+	}
+	if indexOnly {
+		opts = append(opts, registry.IndexOnly(true))
+	}
+	if helmHTTP {
+		opts = append(opts, registry.Archive(manifests.HandleArchive))
+	}
+	if metricsEnabled {
+		opts = append(opts, registry.Metrics(promhttp.Handler()))
+	}
+	if len(proxyUsers) > 0 {
+		opts = append(opts, registry.BasicAuth(proxyUsers, proxyAuthRealm))
+		if proxyAuthMode == "token" {
+			opts = append(opts, registry.TokenAuth(tokenKey, time.Duration(tokenTTL)*time.Second, tokenService, tokenRealm))
+		}
+	}
+	if adminToken != "" {
+		opts = append(opts, registry.Invalidate(adminToken, manifests.HandleInvalidate))
+	}
+	if warmFile != "" {
+		if err := warmCharts(ctx, manifests, warmFile, l); err != nil {
+			if !keepServing {
 				return err
 			}
-			return nil
-		},
+			l.Println(err)
+		}
+	}
+	if !keepServing {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		l.Fatalf("listening on %s: %v", address, err)
+	}
+
+	s := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second, // prevent slowloris, quiet linter
+		Handler: registry.New(
+			manifests.Handle,
+			blobsHttpHandler.Handle,
+			manifests.HandleTags,
+			manifests.HandleCatalog,
+			opts...),
+	}
+
+	errCh := make(chan error)
+	go func() {
+		if useTLS {
+			l.Printf("listening HTTP over TLS serving on %s", listener.Addr())
+			errCh <- s.ServeTLS(listener, certFile, keyfileFile)
+		} else {
+			l.Printf("listening HTTP on %s", listener.Addr())
+			errCh <- s.Serve(listener)
+		}
+	}()
+
+	<-ctx.Done()
+	l.Println("shutting down...")
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// prefixedEnv returns the env vars starting with the prefix, keyed by the rest of their name.
+func prefixedEnv(prefix string) map[string]string {
+	res := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			res[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return res
+}
+
+// blobsReady checks that the blob backend is reachable, if it can tell.
+func blobsReady(h handler.BlobHandler) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if pinger, ok := h.(handler.BlobPingHandler); ok {
+			return pinger.Ping(ctx)
+		}
+		return nil
 	}
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"0.0.0.0", "0.0.0.0:9000"},
+		{"127.0.0.1", "127.0.0.1:9000"},
+		{"localhost", "localhost:9000"},
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+		{":8080", ":8080"},
+		{"::", "[::]:9000"},
+		{"[::]", "[::]:9000"},
+		{"::1", "[::1]:9000"},
+		{"[::1]:8080", "[::1]:8080"},
+	} {
+		if got := listenAddress(tc.addr, 9000); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.addr, got, tc.want)
+		}
+	}
+}
+
+// freeAddress returns an address on the host with a port nothing listens on.
+func freeAddress(t *testing.T, host string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", host, err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// serveRegistry runs the registry with the --address flag until the test ends, and waits until it's healthy at the dial address.
+func serveRegistry(t *testing.T, address string, dial string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runRegistry(ctx, "", true, address)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + dial + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+	}
+	t.Fatalf("registry not serving on %s", dial)
+}
+
+func TestServeListenAddress(t *testing.T) {
+	address := freeAddress(t, "127.0.0.1")
+	t.Setenv("LISTEN_ADDR", address)
+	serveRegistry(t, "", address)
+}
+
+func TestServeAddressFlag(t *testing.T) {
+	// the flag wins over the env var
+	t.Setenv("LISTEN_ADDR", "192.0.2.1:1")
+	address := freeAddress(t, "127.0.0.1")
+	serveRegistry(t, address, address)
+}
+
+func TestServeIPv6(t *testing.T) {
+	address := freeAddress(t, "::1")
+	_, port, _ := net.SplitHostPort(address)
+	t.Setenv("PORT", port)
+	t.Setenv("LISTEN_ADDR", "[::1]")
+	serveRegistry(t, "", address)
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Google LLC All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newCmdWarm() *cobra.Command {
+	var serve bool
+	var address string
+	cmd := &cobra.Command{
+		Use:   "warm FILE",
+		Short: "Pull the charts listed in a file into the registry cache",
+		Long: `This sub-command pulls the charts listed in FILE the way a client pull does, so they are cached before the first real pull.
+
+FILE lists one repo/chart[:version] per line, the latest version is pulled if it's left out. Empty lines and lines starting with # are skipped.
+
+The registry is configured like for serve. Without --serve the command exits once the charts are pulled, which only makes
+sense with a persistent BLOB_BACKEND and MANIFEST_PERSIST_PATH. It fails if any chart could not be pulled.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true, // failed pulls are no usage errors
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRegistry(cmd.Context(), args[0], serve, address)
+		},
+	}
+	cmd.Flags().BoolVar(&serve, "serve", false, "serve the registry once the charts are pulled, also if some of them failed")
+	addAddressFlag(cmd, &address)
+	return cmd
+}
+
+// warmCharts pulls the charts listed in the file, logging the outcome of each one.
+func warmCharts(ctx context.Context, manifests *manifest.Manifests, file string, l logrus.StdLogger) error {
+	refs, err := readWarmFile(file)
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, ref := range refs {
+		if err := manifests.Warm(ctx, ref); err != nil {
+			failed++
+			l.Printf("warming %s failed: %v", ref, err)
+			continue
+		}
+		l.Printf("warmed %s", ref)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d charts failed to warm", failed, len(refs))
+	}
+	return nil
+}
+
+// readWarmFile returns the chart references listed in the file, skipping empty lines and comments.
+func readWarmFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var refs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		refs = append(refs, line)
+	}
+	return refs, scanner.Err()
+}
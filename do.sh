@@ -29,7 +29,7 @@ run() {
 }
 
 tests() {
-  go test -v ./...
+  go test -v -race ./...
 }
 
 list_of_actions() {
@@ -2,10 +2,14 @@ package blobs
 
 import (
 	"bytes"
+	"context"
 	cerrors "errors"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/parent"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -13,21 +17,62 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 // errNotFound represents an error locating the Blob.
 
 // Blobs service
 type Blobs struct {
-	handler handler.BlobHandler `json:"blobHandler"`
+	handler handler.BlobHandler
 	// Each upload gets a unique id that writes occur to until finalized.
 	// Temporary storage
-	lock sync.Mutex
-	log  logrus.StdLogger
+	lock   sync.Mutex
+	log    logrus.StdLogger
+	config Config
+	parent *parent.Registry
 }
 
-func NewBlobs(blobHandler handler.BlobHandler, log logrus.StdLogger) *Blobs {
-	return &Blobs{handler: blobHandler, log: log}
+func NewBlobs(blobHandler handler.BlobHandler, config Config, log logrus.StdLogger) *Blobs {
+	b := &Blobs{handler: blobHandler, config: config, log: log}
+	if config.ParentRegistry != "" {
+		b.parent = parent.New(config.ParentRegistry, config.Client)
+	}
+	return b
+}
+
+// fetchParent pulls a blob which isn't stored locally from the parent registry and stores it.
+func (b *Blobs) fetchParent(ctx context.Context, repo string, h v1.Hash) error {
+	ph, ok := b.handler.(handler.BlobPutHandler)
+	if !ok {
+		return fmt.Errorf("blob handler can't store blobs")
+	}
+	if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
+		if _, err := bsh.Stat(ctx, repo, h); IsRedirect(err) {
+			// stored, just served elsewhere
+			return nil
+		} else if !cerrors.Is(err, ErrNotFound) {
+			return err
+		}
+	} else {
+		rc, err := b.handler.Get(ctx, repo, h)
+		if err == nil {
+			return rc.Close()
+		}
+		if !cerrors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	resp, err := b.parent.Get(ctx, fmt.Sprintf("/v2/%s/blobs/%s", repo, h.String()))
+	if err != nil {
+		return err
+	}
+	vrc, err := verify.ReadCloser(resp.Body, resp.ContentLength, h)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	return ph.Put(ctx, repo, h, vrc)
 }
 
 func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
@@ -59,6 +104,11 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 				Message: "invalid digest",
 			}
 		}
+		if b.parent != nil {
+			if err := b.fetchParent(ctx, repo, h); err != nil && b.config.Debug {
+				b.log.Printf("parent registry fallback failed: %v\n", err)
+			}
+		}
 
 		var size int64
 		if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
@@ -94,6 +144,8 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 
 		resp.Header().Set("Content-Length", fmt.Sprint(size))
 		resp.Header().Set("Docker-Content-Digest", h.String())
+		resp.Header().Set("Accept-Ranges", "bytes")
+		helper.SetCacheHeaders(resp, h.String(), b.config.CacheMaxAge, true)
 		resp.WriteHeader(http.StatusOK)
 		return nil
 
@@ -106,6 +158,11 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 				Message: "invalid digest",
 			}
 		}
+		if b.parent != nil {
+			if err := b.fetchParent(ctx, repo, h); err != nil && b.config.Debug {
+				b.log.Printf("parent registry fallback failed: %v\n", err)
+			}
+		}
 
 		var size int64
 		var r io.Reader
@@ -153,16 +210,34 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 			var buf bytes.Buffer
 			io.Copy(&buf, tmp)
 			size = int64(buf.Len())
-			r = &buf
+			r = bytes.NewReader(buf.Bytes())
 		}
 
-		resp.Header().Set("Content-Length", fmt.Sprint(size))
 		resp.Header().Set("Docker-Content-Digest", h.String())
+		resp.Header().Set("Accept-Ranges", "bytes")
+		helper.SetCacheHeaders(resp, h.String(), b.config.CacheMaxAge, true)
+		if _, ok := r.(io.ReadSeeker); !ok && req.Header.Get("Range") != "" {
+			// backends which can't seek get the range sliced from the whole blob
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return errors.RegErrInternal(err)
+			}
+			r = bytes.NewReader(data)
+		}
+		if rs, ok := r.(io.ReadSeeker); ok {
+			// answers range requests with 206 Partial Content and the Content-Range
+			http.ServeContent(resp, req, "", time.Time{}, rs)
+			return nil
+		}
+		resp.Header().Set("Content-Length", fmt.Sprint(size))
 		resp.WriteHeader(http.StatusOK)
 		io.Copy(resp, r)
 		return nil
 
 	default:
+		if errors.IsWrite(req.Method) {
+			return errors.RegErrReadOnly
+		}
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
 			Code:    "METHOD_UNKNOWN",
@@ -0,0 +1,194 @@
+package blobs_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/file"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleRejectsPushes(t *testing.T) {
+	b := blobs.NewBlobs(mem.NewMemHandler(), blobs.Config{}, log.New(io.Discard, "", 0))
+
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/v2/charts.example.com/app/blobs/uploads/"},
+		{http.MethodPatch, "/v2/charts.example.com/app/blobs/uploads/6f1e2c"},
+		{http.MethodPut, "/v2/charts.example.com/app/blobs/uploads/6f1e2c"},
+		{http.MethodDelete, "/v2/charts.example.com/app/blobs/sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},
+	} {
+		err := b.Handle(httptest.NewRecorder(), httptest.NewRequest(tc.method, tc.path, nil))
+		regErr, ok := err.(*errors.RegError)
+		if !ok || regErr.Status != http.StatusMethodNotAllowed || regErr.Code != "UNSUPPORTED" {
+			t.Errorf("%s %s: got %v, want a 405 UNSUPPORTED", tc.method, tc.path, err)
+		}
+	}
+}
+
+func TestHandleRange(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bh := range map[string]handler.BlobPutHandler{
+		"mem":  mem.NewMemHandler(),
+		"file": file.NewHandler(t.TempDir()),
+	} {
+		if err := bh.Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		b := blobs.NewBlobs(bh.(handler.BlobHandler), blobs.Config{}, log.New(io.Discard, "", 0))
+		path := "/v2/charts.example.com/app/blobs/" + h.String()
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Range", "bytes=4-9")
+		rec := httptest.NewRecorder()
+		if err := b.Handle(rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusPartialContent {
+			t.Errorf("%s: got status %d, want %d", name, rec.Code, http.StatusPartialContent)
+		}
+		if got := rec.Header().Get("Content-Range"); got != "bytes 4-9/16" {
+			t.Errorf("%s: got Content-Range %q", name, got)
+		}
+		if got := rec.Body.String(); got != "456789" {
+			t.Errorf("%s: got bytes %q, want 456789", name, got)
+		}
+
+		rec = httptest.NewRecorder()
+		if err := b.Handle(rec, httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+			t.Errorf("%s: got status %d and %q without range, want the whole blob", name, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: missing Accept-Ranges", name)
+		}
+	}
+}
+
+func TestHandleCacheHeaders(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh := mem.NewMemHandler()
+	if err := bh.Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	b := blobs.NewBlobs(bh, blobs.Config{CacheMaxAge: time.Hour}, log.New(io.Discard, "", 0))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := httptest.NewRecorder()
+		if err := b.Handle(rec, httptest.NewRequest(method, "/v2/charts.example.com/app/blobs/"+h.String(), nil)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rec.Header().Get("ETag"), `"`+h.String()+`"`; got != want {
+			t.Errorf("%s: got ETag %s, want %s", method, got, want)
+		}
+		if got, want := rec.Header().Get("Cache-Control"), "public, max-age=3600, immutable"; got != want {
+			t.Errorf("%s: got Cache-Control %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestHandleRedirect(t *testing.T) {
+	data := []byte("chart")
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh := file.NewRedirectHandler(t.TempDir(), "https://cdn.example.com/blobs/")
+	if err := bh.Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	b := blobs.NewBlobs(bh, blobs.Config{}, log.New(io.Discard, "", 0))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := httptest.NewRecorder()
+		if err := b.Handle(rec, httptest.NewRequest(method, "/v2/charts.example.com/app/blobs/"+h.String(), nil)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Errorf("%s: got status %d, want %d", method, rec.Code, http.StatusTemporaryRedirect)
+		}
+		if want := "https://cdn.example.com/blobs/" + h.String(); rec.Header().Get("Location") != want {
+			t.Errorf("%s: got location %q, want %q", method, rec.Header().Get("Location"), want)
+		}
+	}
+
+	// the proxy itself still reads the contents
+	rc, err := bh.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, _ := io.ReadAll(rc); !bytes.Equal(got, data) {
+		t.Errorf("got contents %q, want %q", got, data)
+	}
+
+	missing, _, _ := v1.SHA256(bytes.NewReader([]byte("missing")))
+	err = b.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/blobs/"+missing.String(), nil))
+	if regErr, ok := err.(*errors.RegError); !ok || regErr.Code != "BLOB_UNKNOWN" {
+		t.Errorf("got %v for a missing blob, want BLOB_UNKNOWN", err)
+	}
+}
+
+func TestHandleParentFallback(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, served := range map[string][]byte{
+		"verified": data,
+		"tampered": []byte("fedcba9876543210"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/charts.example.com/app/blobs/"+h.String() {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write(served)
+			}))
+			defer parent.Close()
+			bh := mem.NewMemHandler()
+			b := blobs.NewBlobs(bh, blobs.Config{ParentRegistry: parent.URL}, log.New(io.Discard, "", 0))
+
+			rec := httptest.NewRecorder()
+			err := b.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/blobs/"+h.String(), nil))
+			_, statErr := bh.Stat(context.Background(), "", h)
+			if bytes.Equal(served, data) {
+				if err != nil || !bytes.Equal(rec.Body.Bytes(), data) {
+					t.Fatalf("got %v and %q, want the parent's blob", err, rec.Body.String())
+				}
+				if statErr != nil {
+					t.Errorf("parent blob not stored: %v", statErr)
+				}
+				return
+			}
+			if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusNotFound {
+				t.Errorf("got %v for a blob with another digest, want a 404", err)
+			}
+			if statErr == nil {
+				t.Error("blob with another digest stored")
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package blobs
+
+import (
+	"net/http"
+	"time"
+)
+
+type Config struct {
+	Debug          bool
+	ParentRegistry string        // parent proxy/registry to pull missing blobs from
+	Client         *http.Client  // for requests to the parent registry, http.DefaultClient if nil
+	CacheMaxAge    time.Duration // Cache-Control max-age of served blobs, 0 sends no Cache-Control
+}
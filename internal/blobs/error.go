@@ -22,6 +22,17 @@ type redirectError struct {
 
 func (e redirectError) Error() string { return fmt.Sprintf("redirecting (%d): %s", e.Code, e.Location) }
 
+// NewRedirectError returns the error a blob handler signals with that clients should fetch the blob from location.
+func NewRedirectError(location string, code int) error {
+	return redirectError{Location: location, Code: code}
+}
+
+// IsRedirect tells whether the error of a blob handler redirects to the blob, which is stored then.
+func IsRedirect(err error) bool {
+	var rErr redirectError
+	return cerrors.As(err, &rErr)
+}
+
 var regErrBlobUnknown = &errors.RegError{
 	Status:  http.StatusNotFound,
 	Code:    "BLOB_UNKNOWN",
@@ -3,6 +3,7 @@ package badger
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/dgraph-io/badger/v3"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"io"
@@ -60,6 +61,14 @@ func (h2 Handler) Get(ctx context.Context, repo string, h v1.Hash) (io.ReadClose
 	return io.NopCloser(bytes.NewReader(data)), err
 }
 
+// Ping checks that the database is still open.
+func (h2 Handler) Ping(_ context.Context) error {
+	if h2.db.IsClosed() {
+		return errors.New("badger database is closed")
+	}
+	return nil
+}
+
 func NewHandler(db *badger.DB) *Handler {
 	return &Handler{db: db}
 }
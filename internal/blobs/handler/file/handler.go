@@ -1,28 +1,52 @@
 package file
 
 import (
-	"bytes"
 	"context"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
 type Handler struct {
 	path string
+	// clients are redirected to the blobs below it, empty serves them through the proxy
+	redirectURL string
 }
 
 func NewHandler(path string) *Handler {
 	return &Handler{path: path}
 }
 
+// NewRedirectHandler stores blobs in the directory like NewHandler, which is published at baseURL, e.g. through a CDN.
+// Clients get redirected to baseURL/<digest> rather than served the blobs by the proxy.
+func NewRedirectHandler(path string, baseURL string) *Handler {
+	return &Handler{path: path, redirectURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Ping checks that the blob directory is there.
+func (h2 Handler) Ping(_ context.Context) error {
+	_, err := os.Stat(h2.path)
+	return err
+}
+
 func (h2 Handler) Stat(ctx context.Context, _ string, h v1.Hash) (int64, error) {
 	filePath := path.Join(h2.path, h.String())
 
 	info, err := os.Stat(filePath)
 	if err != nil {
-		return 0, err
+		return 0, notFound(err)
+	}
+	if h2.redirectURL != "" {
+		// blobs are stat before being served, so HEAD and GET requests get redirected,
+		// while Get keeps returning the contents for the proxy's own reads
+		return 0, blobs.NewRedirectError(h2.redirectURL+"/"+h.String(), http.StatusTemporaryRedirect)
 	}
 	return info.Size(), nil
 }
@@ -40,15 +64,35 @@ func (h2 Handler) Put(ctx context.Context, repo string, h v1.Hash, rc io.ReadClo
 
 func (h2 Handler) Delete(ctx context.Context, repo string, h v1.Hash) error {
 	filePath := path.Join(h2.path, h.String())
-	return os.Remove(filePath)
+	return notFound(os.Remove(filePath))
 }
 
+// Get returns the opened file, which can seek to serve range requests.
 func (h2 Handler) Get(ctx context.Context, repo string, h v1.Hash) (io.ReadCloser, error) {
 	filePath := path.Join(h2.path, h.String())
 
-	data, err := os.ReadFile(filePath)
+	f, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
+	}
+	return f, nil
+}
+
+// StoredAt returns the modification time of the file, which is written once per Put.
+func (h2 Handler) StoredAt(ctx context.Context, repo string, h v1.Hash) (time.Time, error) {
+	filePath := path.Join(h2.path, h.String())
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}, notFound(err)
+	}
+	return info.ModTime(), nil
+}
+
+// notFound maps errors about missing files to blobs.ErrNotFound.
+func notFound(err error) error {
+	if cerrors.Is(err, fs.ErrNotExist) {
+		return blobs.ErrNotFound
 	}
-	return io.NopCloser(bytes.NewReader(data)), nil
+	return err
 }
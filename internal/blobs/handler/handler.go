@@ -4,6 +4,7 @@ import (
 	"context"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"io"
+	"time"
 )
 
 // BlobHandler represents a minimal Blob storage backend, capable of serving
@@ -33,7 +34,22 @@ type BlobPutHandler interface {
 	Put(ctx context.Context, repo string, h v1.Hash, rc io.ReadCloser) error
 }
 
+// BlobAgeHandler is an extension interface representing a Blob storage backend
+// that tracks when blobs were stored.
+type BlobAgeHandler interface {
+	// StoredAt returns when the Blob was last stored, or errNotFound if the
+	// Blob wasn't found.
+	StoredAt(ctx context.Context, repo string, h v1.Hash) (time.Time, error)
+}
+
 type BlobDeleteHandler interface {
 	// Delete the blob contents.
 	Delete(ctx context.Context, repo string, h v1.Hash) error
 }
+
+// BlobPingHandler is an extension interface representing a Blob storage backend
+// that can check it's reachable.
+type BlobPingHandler interface {
+	// Ping returns an error if the backend can't be used.
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,83 @@
+package hybrid
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/file"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"time"
+)
+
+// Handler keeps blobs up to a size threshold in memory and spills larger ones to the directory of a file handler,
+// so large charts don't hold memory while small ones, the common case, are served without disk I/O.
+type Handler struct {
+	threshold int64
+	mem       *mem.Handler
+	file      *file.Handler
+}
+
+// NewHandler keeps blobs of up to threshold bytes in memory and writes larger ones to dir, which must exist.
+func NewHandler(threshold int64, dir string) *Handler {
+	return &Handler{threshold: threshold, mem: mem.NewMemHandler(), file: file.NewHandler(dir)}
+}
+
+// Ping checks that the spill directory is there.
+func (h2 *Handler) Ping(ctx context.Context) error {
+	return h2.file.Ping(ctx)
+}
+
+func (h2 *Handler) Stat(ctx context.Context, repo string, h v1.Hash) (int64, error) {
+	size, err := h2.mem.Stat(ctx, repo, h)
+	if cerrors.Is(err, blobs.ErrNotFound) {
+		return h2.file.Stat(ctx, repo, h)
+	}
+	return size, err
+}
+
+func (h2 *Handler) Get(ctx context.Context, repo string, h v1.Hash) (io.ReadCloser, error) {
+	rc, err := h2.mem.Get(ctx, repo, h)
+	if cerrors.Is(err, blobs.ErrNotFound) {
+		return h2.file.Get(ctx, repo, h)
+	}
+	return rc, err
+}
+
+// Put reads up to the threshold to tell where the blob goes, a blob's size never changes, so it's always stored at the same place.
+func (h2 *Handler) Put(ctx context.Context, repo string, h v1.Hash, rc io.ReadCloser) error {
+	head, err := io.ReadAll(io.LimitReader(rc, h2.threshold+1))
+	if err != nil {
+		_ = rc.Close()
+		return err
+	}
+	if int64(len(head)) <= h2.threshold {
+		// rc is read to its end already, it only needs closing
+		return h2.mem.Put(ctx, repo, h, readCloser{bytes.NewReader(head), rc})
+	}
+	return h2.file.Put(ctx, repo, h, readCloser{io.MultiReader(bytes.NewReader(head), rc), rc})
+}
+
+func (h2 *Handler) Delete(ctx context.Context, repo string, h v1.Hash) error {
+	err := h2.mem.Delete(ctx, repo, h)
+	if cerrors.Is(err, blobs.ErrNotFound) {
+		return h2.file.Delete(ctx, repo, h)
+	}
+	return err
+}
+
+func (h2 *Handler) StoredAt(ctx context.Context, repo string, h v1.Hash) (time.Time, error) {
+	t, err := h2.mem.StoredAt(ctx, repo, h)
+	if cerrors.Is(err, blobs.ErrNotFound) {
+		return h2.file.StoredAt(ctx, repo, h)
+	}
+	return t, err
+}
+
+// readCloser reads from the reader and closes the closer, the original body of the Put.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,100 @@
+package hybrid
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestHandlerRoutesBySize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	h2 := NewHandler(1024, dir)
+
+	for name, tc := range map[string]struct {
+		data    []byte
+		spilled bool
+	}{
+		"small":     {bytes.Repeat([]byte("c"), 100), false},
+		"threshold": {bytes.Repeat([]byte("h"), 1024), false},
+		"large":     {bytes.Repeat([]byte("a"), 1025), true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, size, err := v1.SHA256(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrc, err := verify.ReadCloser(io.NopCloser(bytes.NewReader(tc.data)), size, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = h2.Put(ctx, "", h, vrc); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Stat(filepath.Join(dir, h.String()))
+			if spilled := err == nil; spilled != tc.spilled {
+				t.Errorf("got spilled to disk %v, want %v", spilled, tc.spilled)
+			}
+			if _, err = h2.mem.Stat(ctx, "", h); (err == nil) == tc.spilled {
+				t.Errorf("got kept in memory %v, want %v", err == nil, !tc.spilled)
+			}
+
+			if got, err := h2.Stat(ctx, "", h); err != nil || got != size {
+				t.Errorf("stat: got %d, %v, want %d", got, err, size)
+			}
+			rc, err := h2.Get(ctx, "", h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Error("got different blob contents")
+			}
+			if _, err = h2.StoredAt(ctx, "", h); err != nil {
+				t.Errorf("stored at: %v", err)
+			}
+
+			if err = h2.Delete(ctx, "", h); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = h2.Get(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+				t.Errorf("get of a deleted blob: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestHandlerPutDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	h2 := NewHandler(4, t.TempDir())
+
+	for _, data := range []string{"abc", "a chart larger than the threshold"} {
+		h, size, err := v1.SHA256(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vrc, err := verify.ReadCloser(io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), len(data)))), size, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = h2.Put(ctx, "", h, vrc); err == nil {
+			t.Errorf("%s: stored a blob not matching its digest", data)
+		}
+		if _, err = h2.Stat(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+			t.Errorf("%s: got %v for a rejected blob, want ErrNotFound", data, err)
+		}
+	}
+}
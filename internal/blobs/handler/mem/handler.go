@@ -7,16 +7,19 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"io"
 	"sync"
+	"time"
 )
 
 type Handler struct {
-	m    map[string][]byte
-	lock sync.Mutex
+	m      map[string][]byte
+	stored map[string]time.Time
+	lock   sync.Mutex
 }
 
 func NewMemHandler() *Handler {
 	return &Handler{
-		m: map[string][]byte{},
+		m:      map[string][]byte{},
+		stored: map[string]time.Time{},
 	}
 }
 
@@ -50,6 +53,7 @@ func (m *Handler) Put(_ context.Context, _ string, h v1.Hash, rc io.ReadCloser)
 		return err
 	}
 	m.m[h.String()] = all
+	m.stored[h.String()] = time.Now()
 	return nil
 }
 func (m *Handler) Delete(_ context.Context, _ string, h v1.Hash) error {
@@ -61,5 +65,17 @@ func (m *Handler) Delete(_ context.Context, _ string, h v1.Hash) error {
 	}
 
 	delete(m.m, h.String())
+	delete(m.stored, h.String())
 	return nil
 }
+
+func (m *Handler) StoredAt(_ context.Context, _ string, h v1.Hash) (time.Time, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, found := m.stored[h.String()]
+	if !found {
+		return time.Time{}, blobs.ErrNotFound
+	}
+	return t, nil
+}
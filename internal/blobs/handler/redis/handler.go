@@ -0,0 +1,118 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"time"
+)
+
+// chunkSize is how much of a blob is sent to redis at once while storing it
+const chunkSize = 1 << 20
+
+// Handler stores blobs in redis, so they survive restarts and are shared by all instances behind a load balancer.
+type Handler struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewHandler returns a handler storing blobs with the client, blobs expire after ttl unless it's 0.
+func NewHandler(client *redis.Client, ttl time.Duration) *Handler {
+	return &Handler{client: client, ttl: ttl}
+}
+
+// Ping checks that redis answers.
+func (h2 *Handler) Ping(ctx context.Context) error {
+	return h2.client.Ping(ctx).Err()
+}
+
+func (h2 *Handler) Stat(ctx context.Context, _ string, h v1.Hash) (int64, error) {
+	size, err := h2.client.StrLen(ctx, h.String()).Result()
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		// missing keys have no length either
+		n, err := h2.client.Exists(ctx, h.String()).Result()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, blobs.ErrNotFound
+		}
+	}
+	return size, nil
+}
+
+func (h2 *Handler) Get(ctx context.Context, _ string, h v1.Hash) (io.ReadCloser, error) {
+	data, err := h2.client.Get(ctx, h.String()).Bytes()
+	if cerrors.Is(err, redis.Nil) {
+		return nil, blobs.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Put appends the blob to a temporary key chunk by chunk, instead of buffering it whole,
+// then renames it, so readers never see a partial blob.
+func (h2 *Handler) Put(ctx context.Context, _ string, h v1.Hash, rc io.ReadCloser) error {
+	defer rc.Close()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpKey := h.String() + ".upload." + hex.EncodeToString(suffix)
+
+	if err := h2.client.Set(ctx, tmpKey, "", time.Hour).Err(); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			if aerr := h2.client.Append(ctx, tmpKey, string(buf[:n])).Err(); aerr != nil {
+				h2.client.Del(ctx, tmpKey)
+				return aerr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			// e.g. a digest mismatch reported by the verifying reader
+			h2.client.Del(ctx, tmpKey)
+			return err
+		}
+	}
+
+	_, err := h2.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Rename(ctx, tmpKey, h.String())
+		if h2.ttl > 0 {
+			pipe.Expire(ctx, h.String(), h2.ttl)
+		} else {
+			pipe.Persist(ctx, h.String())
+		}
+		return nil
+	})
+	return err
+}
+
+func (h2 *Handler) Delete(ctx context.Context, _ string, h v1.Hash) error {
+	n, err := h2.client.Del(ctx, h.String()).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return blobs.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/redis/go-redis/v9"
+)
+
+// testClient connects to the redis at REDIS_ADDR, tests are skipped without one.
+func testClient(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h2 := NewHandler(testClient(t), time.Minute)
+
+	data := bytes.Repeat([]byte("chart"), chunkSize/2) // more than one chunk
+	h, size, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Delete(ctx, "", h)
+
+	if _, err = h2.Stat(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Fatalf("stat of a missing blob: got %v, want ErrNotFound", err)
+	}
+	vrc, err := verify.ReadCloser(io.NopCloser(bytes.NewReader(data)), size, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h2.Put(ctx, "", h, vrc); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := h2.Stat(ctx, "", h); err != nil || got != size {
+		t.Errorf("stat: got %d, %v, want %d", got, err, size)
+	}
+	rc, err := h2.Get(ctx, "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("got different blob contents")
+	}
+	if ttl := h2.client.TTL(ctx, h.String()).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("got ttl %v, want up to a minute", ttl)
+	}
+
+	if err = h2.Delete(ctx, "", h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = h2.Get(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("get of a deleted blob: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestHandlerPutDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	h2 := NewHandler(testClient(t), 0)
+
+	h, size, err := v1.SHA256(bytes.NewReader([]byte("chart")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vrc, err := verify.ReadCloser(io.NopCloser(bytes.NewReader([]byte("trash"))), size, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h2.Put(ctx, "", h, vrc); err == nil {
+		t.Fatal("stored a blob not matching its digest")
+	}
+	if _, err = h2.Stat(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("got %v for a rejected blob, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/minio/minio-go/v7"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Handler stores blobs as objects of an S3 compatible bucket, so they are persistent and shared by all replicas.
+type Handler struct {
+	client *minio.Client
+	bucket string
+	// for how long presigned URLs clients get redirected to are valid, 0 serves blobs through the proxy
+	presignTTL time.Duration
+}
+
+// NewHandler returns a handler storing blobs in the bucket.
+func NewHandler(client *minio.Client, bucket string, presignTTL time.Duration) *Handler {
+	return &Handler{client: client, bucket: bucket, presignTTL: presignTTL}
+}
+
+// Ping checks that the bucket exists and is accessible.
+func (h2 *Handler) Ping(ctx context.Context) error {
+	ok, err := h2.client.BucketExists(ctx, h2.bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", h2.bucket)
+	}
+	return nil
+}
+
+func (h2 *Handler) Stat(ctx context.Context, _ string, h v1.Hash) (int64, error) {
+	info, err := h2.client.StatObject(ctx, h2.bucket, h.String(), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, notFound(err)
+	}
+	return info.Size, nil
+}
+
+// Get streams the object, or redirects to a presigned URL of it if presigning is enabled.
+func (h2 *Handler) Get(ctx context.Context, _ string, h v1.Hash) (io.ReadCloser, error) {
+	if h2.presignTTL > 0 {
+		u, err := h2.client.PresignedGetObject(ctx, h2.bucket, h.String(), h2.presignTTL, url.Values{})
+		if err != nil {
+			return nil, err
+		}
+		return nil, blobs.NewRedirectError(u.String(), http.StatusTemporaryRedirect)
+	}
+	obj, err := h2.client.GetObject(ctx, h2.bucket, h.String(), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	// GetObject is lazy, missing objects show up on first access
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, notFound(err)
+	}
+	return obj, nil
+}
+
+// Put uploads the blob in parts as it's read, without knowing its size upfront.
+func (h2 *Handler) Put(ctx context.Context, _ string, h v1.Hash, rc io.ReadCloser) error {
+	defer rc.Close()
+	_, err := h2.client.PutObject(ctx, h2.bucket, h.String(), rc, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (h2 *Handler) Delete(ctx context.Context, _ string, h v1.Hash) error {
+	if _, err := h2.Stat(ctx, "", h); err != nil {
+		return err
+	}
+	return h2.client.RemoveObject(ctx, h2.bucket, h.String(), minio.RemoveObjectOptions{})
+}
+
+// StoredAt returns the last modification of the object, so BLOB_CACHE_TTL works with S3 too.
+func (h2 *Handler) StoredAt(ctx context.Context, _ string, h v1.Hash) (time.Time, error) {
+	info, err := h2.client.StatObject(ctx, h2.bucket, h.String(), minio.StatObjectOptions{})
+	if err != nil {
+		return time.Time{}, notFound(err)
+	}
+	return info.LastModified, nil
+}
+
+// notFound maps errors about missing objects to blobs.ErrNotFound.
+func notFound(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return blobs.ErrNotFound
+	}
+	return err
+}
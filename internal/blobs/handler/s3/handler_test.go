@@ -0,0 +1,127 @@
+//go:build integration
+
+// Run against minio with:
+//
+//	docker run -d -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	S3_ENDPOINT=localhost:9000 S3_ACCESS_KEY=minio S3_SECRET_KEY=minio123 go test -tags integration ./internal/blobs/handler/s3/
+package s3
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// testHandler returns a handler on a fresh bucket of the S3 endpoint at S3_ENDPOINT.
+func testHandler(t *testing.T, presignTTL time.Duration) *Handler {
+	t.Helper()
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_ENDPOINT not set")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bucket := fmt.Sprintf("blobs-test-%d", time.Now().UnixNano())
+	if err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			_ = client.RemoveObject(ctx, bucket, obj.Key, minio.RemoveObjectOptions{})
+		}
+		_ = client.RemoveBucket(ctx, bucket)
+	})
+	return NewHandler(client, bucket, presignTTL)
+}
+
+func putBlob(t *testing.T, h2 *Handler, data []byte) v1.Hash {
+	t.Helper()
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h2.Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h2 := testHandler(t, 0)
+
+	missing, _, _ := v1.SHA256(bytes.NewReader([]byte("missing")))
+	if _, err := h2.Stat(ctx, "", missing); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("stat of a missing blob: got %v, want ErrNotFound", err)
+	}
+	if _, err := h2.Get(ctx, "", missing); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("get of a missing blob: got %v, want ErrNotFound", err)
+	}
+
+	h := putBlob(t, h2, []byte("chart"))
+	if size, err := h2.Stat(ctx, "", h); err != nil || size != 5 {
+		t.Errorf("stat: got %d, %v, want 5", size, err)
+	}
+	rc, err := h2.Get(ctx, "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != "chart" {
+		t.Errorf("get: got %q, %v", data, err)
+	}
+	if storedAt, err := h2.StoredAt(ctx, "", h); err != nil || time.Since(storedAt) > time.Minute {
+		t.Errorf("stored at: got %v, %v", storedAt, err)
+	}
+
+	if err = h2.Delete(ctx, "", h); err != nil {
+		t.Fatal(err)
+	}
+	if err = h2.Delete(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("delete of a deleted blob: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestHandlerPresignedRedirect(t *testing.T) {
+	h2 := testHandler(t, time.Minute)
+	h := putBlob(t, h2, []byte("chart"))
+
+	// the blobs service turns the redirect error into a redirect
+	rec := httptest.NewRecorder()
+	b := blobs.NewBlobs(h2, blobs.Config{}, log.New(io.Discard, "", 0))
+	if err := b.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/blobs/"+h.String(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("got status %d, want a redirect", rec.Code)
+	}
+
+	resp, err := http.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "chart" {
+		t.Errorf("presigned url: got %s %q", resp.Status, data)
+	}
+}
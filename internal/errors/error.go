@@ -24,6 +24,8 @@ type RegError struct {
 	Status  int
 	Code    string
 	Message string
+	// set on the response in addition, like Retry-After
+	Header http.Header
 }
 
 func (r *RegError) Error() string {
@@ -31,6 +33,9 @@ func (r *RegError) Error() string {
 }
 
 func (r *RegError) Write(resp http.ResponseWriter) error {
+	for k, v := range r.Header {
+		resp.Header()[k] = v
+	}
 	resp.WriteHeader(r.Status)
 
 	type err struct {
@@ -65,6 +70,23 @@ var RegErrUnsupported = &RegError{
 	Message: "Unsupported operation",
 }
 
+// RegErrReadOnly answers writes like pushes, which the proxy doesn't support.
+var RegErrReadOnly = &RegError{
+	Status:  http.StatusMethodNotAllowed,
+	Code:    "UNSUPPORTED",
+	Message: "The proxy is read-only, pushing is not supported",
+	Header:  http.Header{"Allow": {"GET, HEAD"}},
+}
+
+// IsWrite tells whether the method would change the registry contents.
+func IsWrite(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
 var RegErrDigestMismatch = &RegError{
 	Status:  http.StatusBadRequest,
 	Code:    "DIGEST_INVALID",
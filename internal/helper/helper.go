@@ -15,8 +15,11 @@
 package helper
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Returns whether this url should be handled by the Blob handler
@@ -54,6 +57,17 @@ func IsTags(req *http.Request) bool {
 	return elems[len(elems)-2] == "tags"
 }
 
+// IsReferrers tells whether the url lists the referrers of a manifest digest.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func IsReferrers(req *http.Request) bool {
+	elems := strings.Split(req.URL.Path, "/")
+	elems = elems[1:]
+	if len(elems) < 4 {
+		return false
+	}
+	return elems[len(elems)-2] == "referrers"
+}
+
 func IsCatalog(req *http.Request) bool {
 	elems := strings.Split(req.URL.Path, "/")
 	elems = elems[1:]
@@ -71,3 +85,63 @@ func IsV2(req *http.Request) bool {
 	}
 	return elems[len(elems)-1] == "v2"
 }
+
+// IsRegistryPath tells whether the url could be a registry operation at all.
+// Every operation has a v2 element and no element is a dotfile, which rules out most scanner probes like /.env or /wp-login.php.
+func IsRegistryPath(req *http.Request) bool {
+	var v2 bool
+	for _, e := range strings.Split(req.URL.Path, "/") {
+		if strings.HasPrefix(e, ".") {
+			return false
+		}
+		if e == "v2" {
+			v2 = true
+		}
+	}
+	return v2
+}
+
+// IsIndex tells whether the url asks for the index.yaml of a chart repository.
+func IsIndex(req *http.Request) bool {
+	elems := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(elems) < 2 {
+		return false
+	}
+	return elems[len(elems)-1] == "index.yaml"
+}
+
+// IsChartArchive tells whether the url asks for a chart archive next to the index.yaml of a chart repository.
+func IsChartArchive(req *http.Request) bool {
+	elems := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(elems) < 2 || elems[0] == "v2" {
+		return false
+	}
+	return strings.HasSuffix(elems[len(elems)-1], ".tgz")
+}
+
+// SetCacheHeaders lets HTTP caches in front of the proxy cache a response for maxAge, 0 sets no Cache-Control.
+// Content addressed by digest never changes and is immutable, the digest is its ETag either way.
+func SetCacheHeaders(resp http.ResponseWriter, digest string, maxAge time.Duration, immutable bool) {
+	resp.Header().Set("ETag", fmt.Sprintf("%q", digest))
+	if maxAge <= 0 {
+		return
+	}
+	cc := fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second))
+	if immutable {
+		cc += ", immutable"
+	}
+	resp.Header().Set("Cache-Control", cc)
+}
+
+type pathPrefixKey struct{}
+
+// WithPathPrefix records the prefix stripped from the path of the request, for links back to the registry.
+func WithPathPrefix(req *http.Request, prefix string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pathPrefixKey{}, prefix))
+}
+
+// PathPrefix returns the prefix stripped from the path of the request, empty if the registry is served at the root.
+func PathPrefix(req *http.Request) string {
+	prefix, _ := req.Context().Value(pathPrefixKey{}).(string)
+	return prefix
+}
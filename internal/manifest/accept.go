@@ -0,0 +1,41 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// checkAccept returns a 406 unless the Accept header of the request allows the manifest's content type.
+// Requests without Accept header accept anything. Manifests aren't converted between the OCI and Docker media types,
+// that would change their digest.
+func checkAccept(req *http.Request, contentType string) *errors.RegError {
+	accepted := req.Header.Values("Accept")
+	if len(accepted) == 0 {
+		return nil
+	}
+	var types []string
+	for _, value := range accepted {
+		for _, t := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(t))
+			if err != nil || params["q"] == "0" {
+				continue
+			}
+			if mediaType == "*/*" || mediaType == contentType || mediaType == strings.SplitN(contentType, "/", 2)[0]+"/*" {
+				return nil
+			}
+			types = append(types, mediaType)
+		}
+	}
+	if len(types) == 0 {
+		// nothing parsable, as good as no header
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusNotAcceptable,
+		Code:    "MANIFEST_UNACCEPTABLE",
+		Message: fmt.Sprintf("manifest is %s, the client accepts %s", contentType, strings.Join(types, ", ")),
+	}
+}
@@ -0,0 +1,82 @@
+package manifest
+
+import (
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestHandleAccept(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	for _, tc := range []struct {
+		accept []string
+		status int
+	}{
+		{nil, http.StatusOK},
+		{[]string{ocispec.MediaTypeImageManifest}, http.StatusOK},
+		{[]string{"application/vnd.docker.distribution.manifest.v2+json, " + ocispec.MediaTypeImageManifest}, http.StatusOK},
+		{[]string{"application/vnd.docker.distribution.manifest.v2+json", ocispec.MediaTypeImageManifest}, http.StatusOK},
+		{[]string{"*/*"}, http.StatusOK},
+		{[]string{"application/vnd.docker.distribution.manifest.v2+json"}, http.StatusNotAcceptable},
+		{[]string{ocispec.MediaTypeImageManifest + ";q=0", "application/vnd.docker.distribution.manifest.v2+json"}, http.StatusNotAcceptable},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := httptest.NewRequest(method, "/v2/charts.example.com/app/manifests/1.0.0", nil)
+			for _, a := range tc.accept {
+				req.Header.Add("Accept", a)
+			}
+			rec := httptest.NewRecorder()
+			status := http.StatusOK
+			if err := m.Handle(rec, req); err != nil {
+				status = err.(*errors.RegError).Status
+			} else if got := rec.Header().Get("Content-Type"); got != ocispec.MediaTypeImageManifest {
+				t.Errorf("%s %v: got content type %s", method, tc.accept, got)
+			}
+			if status != tc.status {
+				t.Errorf("%s %v: got status %d, want %d", method, tc.accept, status, tc.status)
+			}
+		}
+	}
+}
+
+// Artifact manifests and the version index aren't offered as image manifests,
+// clients which don't accept their type get a 406 as documented for ARTIFACT_MANIFESTS and SERVE_VERSION_INDEX.
+func TestHandleAcceptArtifactManifest(t *testing.T) {
+	m := newTestManifests(t, Config{ArtifactManifests: true, VersionIndex: true})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	for _, tc := range []struct {
+		ref    string
+		accept string
+		status int
+	}{
+		{"1.0.0", "", http.StatusOK},
+		{"1.0.0", ocispec.MediaTypeArtifactManifest, http.StatusOK},
+		{"1.0.0", ocispec.MediaTypeImageManifest + ", " + ocispec.MediaTypeArtifactManifest, http.StatusOK},
+		// older Helm clients only accept image manifests
+		{"1.0.0", ocispec.MediaTypeImageManifest, http.StatusNotAcceptable},
+		{"", ocispec.MediaTypeImageIndex, http.StatusOK},
+		{"", ocispec.MediaTypeImageManifest, http.StatusNotAcceptable},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/"+tc.ref, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		status := http.StatusOK
+		if err := m.Handle(httptest.NewRecorder(), req); err != nil {
+			regErr := err.(*errors.RegError)
+			if regErr.Code != "MANIFEST_UNACCEPTABLE" {
+				t.Errorf("%q %q: got error %v", tc.ref, tc.accept, err)
+			}
+			status = regErr.Status
+		}
+		if status != tc.status {
+			t.Errorf("%q %q: got status %d, want %d", tc.ref, tc.accept, status, tc.status)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package manifest
+
+import (
+	"strings"
+)
+
+// expandAlias replaces a leading alias of the repo with the upstream path it stands for,
+// e.g. otel/opentelemetry-operator becomes open-telemetry.github.io/opentelemetry-helm-charts/opentelemetry-operator.
+func (m *Manifests) expandAlias(repo string) string {
+	alias, rest, _ := strings.Cut(repo, "/")
+	target, ok := m.config.RepoAliases[alias]
+	if !ok {
+		return repo
+	}
+	if rest == "" {
+		return target
+	}
+	return target + "/" + rest
+}
+
+// aliasRepo is the reverse of expandAlias, repos below an aliased upstream path are listed by their alias.
+// The longest matching upstream path wins.
+func (m *Manifests) aliasRepo(repo string) string {
+	var alias, target string
+	for a, t := range m.config.RepoAliases {
+		if (repo == t || strings.HasPrefix(repo, t+"/")) && len(t) > len(target) {
+			alias, target = a, t
+		}
+	}
+	if target == "" {
+		return repo
+	}
+	return alias + strings.TrimPrefix(repo, target)
+}
@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRepoAliases(t *testing.T) {
+	m := newTestManifests(t, Config{RepoAliases: map[string]string{"apps": "charts.example.com"}})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/apps/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("charts.example.com/app", "1.0.0"); !ok {
+		t.Error("aliased chart not cached under its upstream path")
+	}
+
+	rec = httptest.NewRecorder()
+	if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, "/v2/apps/app/tags/list", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var tags listTags
+	if err := json.Unmarshal(rec.Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags.Name != "apps/app" || strings.Join(tags.Tags, ",") != "1.0.0" {
+		t.Errorf("got tags %+v, want 1.0.0 of apps/app", tags)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := m.HandleCatalog(rec, httptest.NewRequest(http.MethodGet, "/v2/_catalog", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(catalog.Repos, ",") != "apps/app" {
+		t.Errorf("got catalog %v, want [apps/app]", catalog.Repos)
+	}
+}
+
+func TestAliasRepoPrefersLongestMatch(t *testing.T) {
+	m := newTestManifests(t, Config{RepoAliases: map[string]string{
+		"gh":   "example.github.io",
+		"otel": "example.github.io/otel-charts",
+	}})
+	for repo, want := range map[string]string{
+		"example.github.io/otel-charts/collector": "otel/collector",
+		"example.github.io/other/app":             "gh/other/app",
+		"example.github.iox/app":                  "example.github.iox/app",
+	} {
+		if got := m.aliasRepo(repo); got != want {
+			t.Errorf("aliasRepo(%s): got %s, want %s", repo, got, want)
+		}
+		if got := m.expandAlias(want); got != repo {
+			t.Errorf("expandAlias(%s): got %s, want %s", want, got, repo)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package manifest
+
+import (
+	"bytes"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	AppVersionAnnotation = "com.container-registry.app-version"
+	ChartTypeAnnotation  = "com.container-registry.chart-type"
+)
+
+// extractChartMeta is used to extract a chart metadata from a chart archive
+func extractChartMeta(chartData []byte) (*chart.Metadata, error) {
+	ch, err := loader.LoadArchive(bytes.NewReader(chartData))
+	if err != nil {
+		return nil, err
+	}
+	return ch.Metadata, nil
+}
+
+// generateOCIAnnotations maps chart metadata to the annotations of the OCI manifest.
+// The created time is passed in rather than taken from the clock, so the manifest digest stays the same on every pack.
+func generateOCIAnnotations(meta *chart.Metadata, created time.Time) map[string]string {
+	annotations := map[string]string{}
+	addToMap(annotations, ocispec.AnnotationTitle, meta.Name)
+	addToMap(annotations, ocispec.AnnotationVersion, meta.Version)
+	addToMap(annotations, ocispec.AnnotationDescription, meta.Description)
+	addToMap(annotations, ocispec.AnnotationURL, meta.Home)
+	if len(meta.Sources) > 0 {
+		addToMap(annotations, ocispec.AnnotationSource, meta.Sources[0])
+	}
+	annotations[ocispec.AnnotationCreated] = created.UTC().Format(time.RFC3339)
+	addToMap(annotations, AppVersionAnnotation, meta.AppVersion)
+	addToMap(annotations, ChartTypeAnnotation, chartType(meta))
+	return annotations
+}
+
+// chartType returns the type of the chart, charts without a type are applications
+func chartType(meta *chart.Metadata) string {
+	if meta.Type == "" {
+		return "application"
+	}
+	return meta.Type
+}
+
+func addToMap(m map[string]string, k, v string) {
+	if len(strings.TrimSpace(v)) > 0 {
+		m[k] = v
+	}
+}
@@ -0,0 +1,98 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testChart returns a packaged chart with the given Chart.yaml and additional files.
+func testChart(t *testing.T, chartYAML string, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+
+	write := func(name, content string) {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: "testchart/" + name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Chart.yaml", chartYAML)
+	for name, content := range files {
+		write(name, content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGenerateOCIAnnotationsAppVersion(t *testing.T) {
+	data := testChart(t, `apiVersion: v2
+name: testchart
+version: 1.2.3
+appVersion: "4.5.6"
+`, nil)
+
+	meta, err := extractChartMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := generateOCIAnnotations(meta, time.Time{})
+
+	for k, want := range map[string]string{
+		ocispec.AnnotationTitle:   "testchart",
+		ocispec.AnnotationVersion: "1.2.3",
+		AppVersionAnnotation:      "4.5.6",
+	} {
+		if got := annotations[k]; got != want {
+			t.Errorf("annotation %s: got %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestGenerateOCIAnnotationsWithoutAppVersion(t *testing.T) {
+	data := testChart(t, `apiVersion: v2
+name: testchart
+version: 1.2.3
+`, nil)
+
+	meta, err := extractChartMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := generateOCIAnnotations(meta, time.Time{})[AppVersionAnnotation]; ok {
+		t.Errorf("got app version annotation %q for a chart without appVersion", v)
+	}
+}
+
+func TestGenerateOCIAnnotationsChartType(t *testing.T) {
+	for chartYAML, want := range map[string]string{
+		"apiVersion: v2\nname: testchart\nversion: 1.2.3\n":                    "application",
+		"apiVersion: v2\nname: testchart\nversion: 1.2.3\ntype: application\n": "application",
+		"apiVersion: v2\nname: testchart\nversion: 1.2.3\ntype: library\n":     "library",
+	} {
+		meta, err := extractChartMeta(testChart(t, chartYAML, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := generateOCIAnnotations(meta, time.Time{})[ChartTypeAnnotation]; got != want {
+			t.Errorf("got chart type %q, want %q for:\n%s", got, want, chartYAML)
+		}
+	}
+}
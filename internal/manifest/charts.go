@@ -1,27 +1,79 @@
 package manifest
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	cerrors "errors"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/metrics"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/tracing"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/upstream"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"helm.sh/helm/v3/pkg/chart"
 	helmregistry "helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/repo"
 	"io"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/memory"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 func (m *Manifests) prepareChart(ctx context.Context, repo string, reference string) *errors.RegError {
+	ctx, span := tracing.Start(ctx, "prepareChart", trace.WithAttributes(
+		attribute.String("repo", repo),
+		attribute.String("reference", reference),
+	))
+	defer span.End()
+
+	start := time.Now()
+	err := m.packChart(ctx, repo, reference)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Message)
+	}
+
+	result := "ok"
+	if err != nil && err.Status == http.StatusNotFound {
+		result = "notfound"
+	} else if err != nil {
+		result = "error"
+	}
+	metrics.ObservePrepare(start, result)
+	return err
+}
+
+// packChart downloads the chart and packs it as OCI artifact.
+func (m *Manifests) packChart(ctx context.Context, repo string, reference string) *errors.RegError {
+	if m.isOCIUpstream(repo) {
+		return m.prepareOCIChart(ctx, repo, reference)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		// indexes list versions, digests are only known from charts packed before
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "MANIFEST_UNKNOWN",
+			Message: fmt.Sprintf("Chart: %s digest: %s not known", repo, reference),
+		}
+	}
 	elem := strings.Split(repo, "/")
 
 	if len(elem) < 2 {
@@ -31,8 +83,11 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 	path := strings.Join(elem[:len(elem)-1], "/")
 	chart := elem[len(elem)-1]
 
-	index, err := m.GetIndex(path)
+	index, err := m.GetIndex(ctx, path)
 	if err != nil {
+		if regErr := failedDownload(err); regErr != nil {
+			return regErr
+		}
 		return &errors.RegError{
 			Status:  http.StatusNotFound,
 			Code:    "NAME_UNKNOWN",
@@ -40,58 +95,57 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 		}
 	}
 
-	if reference != "" && !strings.HasPrefix(reference, "v") {
-		reference = fmt.Sprintf("v%s", reference)
-	}
-
-	m.log.Printf("searching index for %s with reference %s\n", chart, reference)
-	chartVer, err := index.Get(chart, reference)
-	if err != nil {
+	if m.knownMissing(repo, reference, index) {
 		return &errors.RegError{
 			Status:  http.StatusNotFound,
 			Code:    "NOT FOUND",
-			Message: fmt.Sprintf("Chart: %s version: %s not found: %v", chart, reference, err),
+			Message: fmt.Sprintf("Chart: %s version: %s not found", chart, reference),
 		}
 	}
-
-	if len(chartVer.URLs) == 0 {
+	m.log.Printf("searching index for %s with reference %s\n", chart, reference)
+	chartVer, err := m.resolveVersion(index, chart, reference)
+	if err != nil {
+		m.recordMissing(repo, reference, index)
 		return &errors.RegError{
 			Status:  http.StatusNotFound,
 			Code:    "NOT FOUND",
-			Message: fmt.Sprintf("Chart has no URLs"),
+			Message: fmt.Sprintf("Chart: %s version: %s not found: %v", chart, reference, err),
 		}
 	}
-	reference = strings.TrimPrefix(chartVer.Version, "v")
 
-	var downloadUrl string
+	reference = chartTag(chartVer.Version)
 
-	u, err := url.Parse(chartVer.URLs[0])
-	if err != nil {
-		return errors.RegErrInternal(err)
-	}
-	if u.IsAbs() {
-		downloadUrl = u.String()
-	} else {
-		downloadUrl = fmt.Sprintf("https://%s/%s", path, chartVer.URLs[0])
-	}
-
-	manifestData, err := m.download(downloadUrl)
-	if err != nil {
-		return errors.RegErrInternal(err)
+	manifestData, u, downloadUrl, regErr := m.downloadChart(ctx, path, chartVer)
+	if regErr != nil {
+		return regErr
 	}
 
 	packOpts := oras.PackOptions{}
 	memStore := memory.New()
 
+	// like helm push, the config is the chart's metadata, the empty object if it's not readable
 	configData := []byte("{}")
+	if meta, err := extractChartMeta(manifestData); err != nil {
+		m.log.Printf("chart metadata of %s/%s:%s not readable: %v\n", path, chart, reference, err)
+	} else {
+		if m.config.RejectLibraryCharts && chartType(meta) == "library" {
+			return &errors.RegError{
+				Status:  http.StatusForbidden,
+				Code:    "DENIED",
+				Message: fmt.Sprintf("Chart: %s version: %s is a library chart, which can't be installed", chart, reference),
+			}
+		}
+		packOpts.ManifestAnnotations = generateOCIAnnotations(meta, m.chartCreated(chartVer, manifestData))
+		if configData, err = json.Marshal(meta); err != nil {
+			return errors.RegErrInternal(err)
+		}
+	}
 
+	// like helm push, the config descriptor has no annotations, the manifest carries them
 	desc := ocispec.Descriptor{
 		MediaType: helmregistry.ConfigMediaType,
 		Digest:    digest.FromBytes(configData),
 		Size:      int64(len(configData)),
-		Annotations: map[string]string{
-			ocispec.AnnotationTitle: "$config",
-		},
 	}
 
 	err = memStore.Push(ctx, desc, bytes.NewReader(configData))
@@ -99,11 +153,15 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 		return errors.RegErrInternal(err)
 	}
 
-	desc.Annotations = packOpts.ConfigAnnotations
 	packOpts.ConfigDescriptor = &desc
 	packOpts.PackImageManifest = true
 	name := filepath.Clean(filepath.Base(downloadUrl))
+	if u.Scheme == "oci" {
+		// the base of an OCI reference is chart:version
+		name = fmt.Sprintf("%s-%s.tgz", chartVer.Name, chartVer.Version)
+	}
 
+	// downloadChart refused anything which isn't a chart archive
 	manifestFile := ocispec.Descriptor{
 		MediaType: helmregistry.ChartLayerMediaType,
 		Digest:    digest.FromBytes(manifestData),
@@ -114,31 +172,87 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 	}
 
 	err = memStore.Push(ctx, manifestFile, bytes.NewReader(manifestData))
-	copyOptions := oras.DefaultCopyOptions
-	copyOptions.Concurrency = 1
-
-	root, err := oras.Pack(ctx, memStore, "", []ocispec.Descriptor{manifestFile}, packOpts)
 	if err != nil {
 		return errors.RegErrInternal(err)
 	}
-	if err = memStore.Tag(ctx, root, root.Digest.String()); err != nil {
-		return errors.RegErrInternal(err)
-	}
+	layers := []ocispec.Descriptor{manifestFile}
 
-	var refs []string
-
-	copyOptions.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
-		if desc.MediaType == ocispec.MediaTypeImageManifest {
-			// oci manifest
-			for k, ref := range refs {
-				desc.Annotations[fmt.Sprintf("%s%d", ProxyRefAnnotationPrefix, k)] = ref
+	siblings := m.config.SiblingPolicy.siblings()
+	if u.Scheme == "oci" {
+		// OCI sources have no files next to the chart to download
+		siblings = nil
+	}
+	for _, sibling := range siblings {
+		data, err := m.download(ctx, downloadUrl+sibling.suffix, m.config.MaxChartSize)
+		if cerrors.Is(err, errTooManyDownloads) {
+			// packing without the sibling would cache a different manifest
+			return refusedDownload(err)
+		}
+		if err != nil {
+			// siblings are optional
+			if m.config.Debug {
+				m.log.Printf("no %s sibling for %s: %v\n", sibling.suffix, downloadUrl, err)
 			}
+			continue
+		}
+		desc := ocispec.Descriptor{
+			MediaType: sibling.mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+			Annotations: map[string]string{
+				ocispec.AnnotationTitle: name + sibling.suffix,
+			},
+		}
+		if err = memStore.Push(ctx, desc, bytes.NewReader(data)); err != nil {
+			return errors.RegErrInternal(err)
+		}
+		layers = append(layers, desc)
+	}
+
+	if m.config.ExposeValuesLayer {
+		values, err := extractValuesYAML(manifestData)
+		if err != nil {
+			// the chart layer has the values anyway
+			m.log.Printf("values of %s/%s:%s not extracted: %v\n", path, chart, reference, err)
 		} else {
-			refs = append(refs, desc.Digest.String())
+			desc := ocispec.Descriptor{
+				MediaType: ValuesLayerMediaType,
+				Digest:    digest.FromBytes(values),
+				Size:      int64(len(values)),
+				Annotations: map[string]string{
+					ocispec.AnnotationTitle: "values.yaml",
+				},
+			}
+			if err = memStore.Push(ctx, desc, bytes.NewReader(values)); err != nil {
+				return errors.RegErrInternal(err)
+			}
+			layers = append(layers, desc)
 		}
-		return nil
 	}
 
+	copyOptions := oras.DefaultCopyOptions
+	copyOptions.Concurrency = m.copyConcurrency()
+
+	artifactType := ""
+	if m.config.ArtifactManifests {
+		// artifact manifests have no config, their artifact type tells they hold a chart
+		artifactType = helmregistry.ConfigMediaType
+		packOpts.PackImageManifest = false
+		if created, ok := packOpts.ManifestAnnotations[ocispec.AnnotationCreated]; ok {
+			// oras sets the artifact created annotation to the current time otherwise, changing the digest on every pack
+			packOpts.ManifestAnnotations[ocispec.AnnotationArtifactCreated] = created
+		}
+	}
+	root, err := oras.Pack(ctx, memStore, artifactType, layers, packOpts)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if err = memStore.Tag(ctx, root, root.Digest.String()); err != nil {
+		return errors.RegErrInternal(err)
+	}
+
+	copyOptions.PreCopy = (&refCollector{}).preCopy
+
 	dst := NewInternalDst(fmt.Sprintf("%s/%s", path, chartVer.Name), m.blobHandler.(handler.BlobPutHandler), m)
 	// push
 	if reference == "" {
@@ -149,58 +263,272 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 	if err != nil {
 		return errors.RegErrInternal(err)
 	}
+	if m.config.Signer != nil {
+		ma, err := m.Read(dst.repo, root.Digest.String())
+		if err != nil {
+			return errors.RegErrInternal(err)
+		}
+		if err = m.signManifest(ctx, dst.repo, ma); err != nil {
+			return errors.RegErrInternal(err)
+		}
+	}
 	return nil
 }
 
-func (m *Manifests) GetIndex(repoURLPath string) (*repo.IndexFile, error) {
+// downloadChart returns the archive of the chart version listed in the index of the repo,
+// from the blob store if it was stored by an earlier pull, downloaded otherwise.
+// It also returns the parsed URL of the chart and the URL it's downloaded from.
+func (m *Manifests) downloadChart(ctx context.Context, path string, chartVer *repo.ChartVersion) ([]byte, *url.URL, string, *errors.RegError) {
+	if len(chartVer.URLs) == 0 {
+		return nil, nil, "", &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NOT FOUND",
+			Message: fmt.Sprintf("Chart has no URLs"),
+		}
+	}
 
-	type cacheResp struct {
-		c   *repo.IndexFile
-		err error
+	u, err := url.Parse(chartVer.URLs[0])
+	if err != nil {
+		return nil, nil, "", errors.RegErrInternal(err)
+	}
+	// like helm, relative URLs are resolved against the index URL, so ../ and absolute paths work too
+	indexURL, err := url.Parse(m.upstreamURL(path, "index.yaml"))
+	if err != nil {
+		return nil, nil, "", errors.RegErrInternal(err)
+	}
+	downloadUrl := indexURL.ResolveReference(u).String()
+
+	data, ok := m.storedChart(ctx, chartVer.Digest)
+	if !ok && u.Scheme == "oci" {
+		data, err = m.pullOCIChart(ctx, u, chartVer.Version)
+		if err != nil {
+			if regErr := failedDownload(err); regErr != nil {
+				return nil, nil, "", regErr
+			}
+			return nil, nil, "", errors.RegErrInternal(err)
+		}
+	} else if !ok {
+		data, err = m.download(ctx, downloadUrl, m.config.MaxChartSize)
+		if err != nil {
+			if regErr := failedDownload(err); regErr != nil {
+				return nil, nil, "", regErr
+			}
+			return nil, nil, "", errors.RegErrInternal(err)
+		}
+	}
+	// upstreams answering with an error or login page must not get the page cached as chart,
+	// stored and OCI pulled charts are checked as well
+	if err = checkChartArchive(data); err != nil {
+		return nil, nil, "", &errors.RegError{
+			Status:  http.StatusBadGateway,
+			Code:    "UPSTREAM_INVALID",
+			Message: fmt.Sprintf("upstream did not return a valid chart tarball for %s: %v", downloadUrl, err),
+		}
+	}
+	if !ok && m.config.VerifyChartDigest && chartVer.Digest != "" {
+		if got, want := digest.FromBytes(data).Encoded(), strings.TrimPrefix(strings.ToLower(chartVer.Digest), "sha256:"); got != want {
+			return nil, nil, "", &errors.RegError{
+				Status:  http.StatusBadGateway,
+				Code:    "DIGEST_INVALID",
+				Message: fmt.Sprintf("Chart: %s version: %s has digest sha256:%s, the index lists sha256:%s", chartVer.Name, chartVer.Version, got, want),
+			}
+		}
+	}
+	return data, u, downloadUrl, nil
+}
+
+// refCollector records the digests of the copied blobs and annotates the manifest with them,
+// so InternalDst.Push stores the manifest with the blobs it references.
+// oras copies a manifest only once all its successors are copied, so every blob digest is known by then,
+// no matter how many blobs get copied concurrently.
+type refCollector struct {
+	lock sync.Mutex
+	refs []string
+}
+
+func (c *refCollector) preCopy(_ context.Context, desc ocispec.Descriptor) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if desc.MediaType != ocispec.MediaTypeImageManifest && desc.MediaType != ocispec.MediaTypeArtifactManifest {
+		c.refs = append(c.refs, desc.Digest.String())
+		return nil
+	}
+	if desc.Annotations == nil {
+		return fmt.Errorf("manifest %s has no annotations to record its blobs", desc.Digest)
+	}
+	// sorted, so the annotations don't depend on the order blobs got copied in
+	sort.Strings(c.refs)
+	for k, ref := range c.refs {
+		desc.Annotations[fmt.Sprintf("%s%d", ProxyRefAnnotationPrefix, k)] = ref
+	}
+	return nil
+}
+
+// copyConcurrency returns how many blobs get copied at once, at least 1.
+func (m *Manifests) copyConcurrency() int {
+	if m.config.CopyConcurrency < 1 {
+		return 1
+	}
+	return m.config.CopyConcurrency
+}
+
+// storedChart returns the chart archive with the digest listed in the index if it's still stored from an earlier pull.
+func (m *Manifests) storedChart(ctx context.Context, chartDigest string) ([]byte, bool) {
+	if chartDigest == "" {
+		return nil, false
+	}
+	h, err := v1.NewHash("sha256:" + strings.TrimPrefix(chartDigest, "sha256:"))
+	if err != nil {
+		return nil, false
+	}
+	rc, err := m.blobHandler.Get(ctx, "", h)
+	if err != nil {
+		return nil, false
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, false
+	}
+	if m.config.Debug {
+		m.log.Printf("reusing stored chart %s\n", h.String())
+	}
+	return data, true
+}
+
+// missingVersion is a cached negative version lookup, valid for the index it was looked up in.
+type missingVersion struct {
+	index *repo.IndexFile
+}
+
+func missingKey(repo string, reference string) string {
+	return "notfound\x00" + repo + "@" + reference
+}
+
+// knownMissing tells whether the reference was recently not found in this very index.
+// A refreshed index is a different object, so its versions get looked up again.
+func (m *Manifests) knownMissing(repo string, reference string, index *repo.IndexFile) bool {
+	if m.config.NotFoundCacheTTL <= 0 {
+		return false
+	}
+	c, ok := m.cache.Get(missingKey(repo, reference))
+	if !ok {
+		return false
 	}
+	missing, ok := c.(*missingVersion)
+	return ok && missing.index == index
+}
+
+// recordMissing caches that the reference is not in the index for NotFoundCacheTTL.
+func (m *Manifests) recordMissing(repo string, reference string, index *repo.IndexFile) {
+	if m.config.NotFoundCacheTTL <= 0 {
+		return
+	}
+	m.cache.SetWithTTL(missingKey(repo, reference), &missingVersion{index: index}, 1, m.config.NotFoundCacheTTL)
+}
+
+// indexCacheResp is the cached result of an index download
+type indexCacheResp struct {
+	c   *repo.IndexFile
+	err error
+}
+
+func (m *Manifests) GetIndex(ctx context.Context, repoURLPath string) (*repo.IndexFile, error) {
+	ctx, span := tracing.Start(ctx, "GetIndex", trace.WithAttributes(attribute.String("repo.path", repoURLPath)))
+	defer span.End()
 
 	c, ok := m.cache.Get(repoURLPath)
+	span.SetAttributes(attribute.Bool("cache.hit", ok && c != nil))
 
 	if !ok || c == nil {
-		// nothing in the cache
-		res := &cacheResp{}
-		res.c, res.err = m.downloadIndex(repoURLPath)
-
-		var ttl = m.config.IndexCacheTTL
-		if res.err != nil {
-			// cache error too to avoid external resource exhausting
-			ttl = m.config.IndexErrorCacheTTl
-		}
-		m.cache.SetWithTTL(repoURLPath, res, 1000, ttl)
+		metrics.IndexCacheMisses.WithLabelValues("parsed").Inc()
+		// nothing in the cache, download once for all concurrent requests
+		v, _, _ := m.indexes.Do(repoURLPath, func() (interface{}, error) {
+			ctx, cancel := detached(ctx, sharedTimeout)
+			defer cancel()
+			res := &indexCacheResp{}
+			res.c, res.err = m.downloadIndex(ctx, repoURLPath)
+
+			if !cachesError(res.err) {
+				return res, nil
+			}
+			var ttl = m.indexCacheTTL(repoURLPath)
+			if res.err != nil {
+				// cache error too to avoid external resource exhausting
+				ttl = m.indexErrorTTL(res.err)
+			}
+			m.cache.SetWithTTL(repoURLPath, res, 1000, ttl)
+			return res, nil
+		})
+		res := v.(*indexCacheResp)
 		return res.c, res.err
 	}
 
-	res, ok := c.(*cacheResp)
+	metrics.IndexCacheHits.WithLabelValues("parsed").Inc()
+	res, ok := c.(*indexCacheResp)
 	if !ok {
 		return nil, fmt.Errorf("internal error")
 	}
 	return res.c, res.err
 }
 
-func (m *Manifests) downloadIndex(repoURLPath string) (*repo.IndexFile, error) {
-	url := fmt.Sprintf("https://%s/index.yaml", repoURLPath)
+func (m *Manifests) downloadIndex(ctx context.Context, repoURLPath string) (*repo.IndexFile, error) {
+	if paths, ok := m.virtualRepo(repoURLPath); ok {
+		return m.downloadVirtualIndex(ctx, paths)
+	}
+	// held until the index is parsed, virtual repos take the slots of their members
+	release, err := m.acquireIndexDownload()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	url := m.upstreamURL(repoURLPath, "index.yaml")
+	prev := m.lastIndex(repoURLPath)
+	if prev != nil {
+		// ask for the index which was fetched last, if it's unchanged it's not downloaded and parsed again
+		url = prev.url
+	}
 	if m.config.Debug {
 		m.log.Printf("download index: %s\n", url)
 	}
-	data, err := m.getIndexBytes(url)
+	f, err := m.getIndexBytes(ctx, url, prev.conditionalHeader())
+	if isNotFound(err) && prev == nil {
+		// some mirrors only publish a JSON index, which parses like the YAML one
+		url = m.upstreamURL(repoURLPath, "index.json")
+		f, err = m.getIndexBytes(ctx, url, nil)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if f.notModified {
+		return prev.index, nil
+	}
+	i, err := m.parseIndex(url, f.data)
+	if err == nil {
+		m.rememberIndex(repoURLPath, url, f, i)
+	}
+	return i, err
+}
+
+// parseIndex parses the index downloaded from url, dropping invalid chart versions
+// unless KeepInvalidChartVersions keeps them for their charts to stay pullable. Either way they get logged.
+func (m *Manifests) parseIndex(url string, data []byte) (*repo.IndexFile, error) {
 	i := repo.NewIndexFile()
 
 	if len(data) == 0 {
 		return i, repo.ErrEmptyIndexYaml
 	}
-	if err = yaml.UnmarshalStrict(data, i); err != nil {
-		return nil, err
+	if err := yaml.UnmarshalStrict(data, i); err != nil {
+		// upstreams add fields of their own, which don't make the index less usable
+		i = repo.NewIndexFile()
+		if lenientErr := yaml.Unmarshal(data, i); lenientErr != nil {
+			return nil, lenientErr
+		}
+		m.log.Printf("warning: index %s parsed ignoring unexpected fields: %v\n", url, err)
 	}
 
-	for _, cvs := range i.Entries {
+	for name, cvs := range i.Entries {
 		for idx := len(cvs) - 1; idx >= 0; idx-- {
 			if cvs[idx] == nil {
 				continue
@@ -209,9 +537,15 @@ func (m *Manifests) downloadIndex(repoURLPath string) (*repo.IndexFile, error) {
 				cvs[idx].APIVersion = chart.APIVersionV1
 			}
 			if err := cvs[idx].Validate(); err != nil {
+				if m.config.KeepInvalidChartVersions {
+					m.log.Printf("warning: keeping invalid chart version %s %s of %s: %v\n", name, cvs[idx].Version, url, err)
+					continue
+				}
+				m.log.Printf("warning: dropping invalid chart version %s %s of %s: %v\n", name, cvs[idx].Version, url, err)
 				cvs = append(cvs[:idx], cvs[idx+1:]...)
 			}
 		}
+		i.Entries[name] = cvs
 	}
 	i.SortEntries()
 	if i.APIVersion == "" {
@@ -220,29 +554,44 @@ func (m *Manifests) downloadIndex(repoURLPath string) (*repo.IndexFile, error) {
 	return i, nil
 }
 
-func (m *Manifests) getIndexBytes(url string) ([]byte, error) {
+// getIndexBytes fetches the index with the conditional request header, if any.
+func (m *Manifests) getIndexBytes(ctx context.Context, url string, header http.Header) (*fetched, error) {
 
 	type cacheResp struct {
-		c   []byte
+		c   *fetched
 		err error
 	}
 
 	c, ok := m.cache.Get(url)
 
 	if !ok || c == nil {
+		metrics.IndexCacheMisses.WithLabelValues("raw").Inc()
 		// nothing in the cache
 		res := &cacheResp{}
-		res.c, res.err = m.download(url)
+		// indexes compress well, they are decompressed by downloadOnce and limited by their decompressed size
+		h := http.Header{"Accept-Encoding": {"gzip"}}
+		for k, v := range header {
+			h[k] = v
+		}
+		res.c, res.err = m.fetch(ctx, url, m.config.MaxIndexSize, h)
+		if res.err == nil && res.c.notModified {
+			// only means something to the request which was conditional
+			return res.c, nil
+		}
+		if !cachesError(res.err) {
+			return nil, res.err
+		}
 
-		var ttl = m.config.IndexCacheTTL
+		var ttl = m.indexCacheTTL(indexRepo(url))
 		if res.err != nil {
 			// cache error too to avoid external resource exhausting
-			ttl = m.config.IndexErrorCacheTTl
+			ttl = m.indexErrorTTL(res.err)
 		}
 		m.cache.SetWithTTL(url, res, 1000, ttl)
 		return res.c, res.err
 	}
 
+	metrics.IndexCacheHits.WithLabelValues("raw").Inc()
 	res, ok := c.(*cacheResp)
 	if !ok {
 		return nil, fmt.Errorf("internal error")
@@ -251,14 +600,254 @@ func (m *Manifests) getIndexBytes(url string) ([]byte, error) {
 
 }
 
-func (m *Manifests) download(url string) ([]byte, error) {
+// cachesError tells whether a failed index download is cached. Downloads which got no slot never asked the upstream,
+// canceled or timed out ones didn't get its answer, so the next request tries again.
+func cachesError(err error) bool {
+	return !cerrors.Is(err, errTooManyDownloads) && !cerrors.Is(err, context.Canceled) && !cerrors.Is(err, context.DeadlineExceeded)
+}
+
+// sharedTimeout bounds index downloads and chart preparations shared by concurrent requests
+const sharedTimeout = 5 * time.Minute
+
+// detached returns a context carrying only the span of ctx which times out after timeout,
+// for work shared by concurrent requests, so the first one going away doesn't fail the others.
+func detached(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), timeout)
+}
+
+// indexErrorTTL returns for how long the failed index download is cached.
+// Client errors like a 404 won't go away soon and are cached for IndexNotFoundCacheTTL, others for IndexErrorCacheTTl.
+// Up to a fifth is added at random, so repos failing together, e.g. during an upstream outage, aren't retried all at once.
+func (m *Manifests) indexErrorTTL(err error) time.Duration {
+	ttl := m.config.IndexErrorCacheTTl
+	if isClientError(err) && m.config.IndexNotFoundCacheTTL > 0 {
+		ttl = m.config.IndexNotFoundCacheTTL
+	}
+	if ttl <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(int64(ttl/5)+1))
+}
+
+// download fetches the url, retrying transient failures with exponential backoff.
+// Responses larger than limit bytes are refused without reading them fully, 0 means no limit.
+// Canceling the context stops retrying, downloads shared by concurrent requests get a detached one, see detached.
+func (m *Manifests) download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	f, err := m.fetch(ctx, url, limit, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.data, nil
+}
+
+// fetched is a downloaded file with the validators of its response.
+// A conditional request answered with 304 Not Modified has no data.
+type fetched struct {
+	data         []byte
+	etag         string
+	lastModified string
+	notModified  bool
+}
+
+// fetch is download sending the additional request header.
+func (m *Manifests) fetch(ctx context.Context, url string, limit int64, header http.Header) (*fetched, error) {
+	_, span := tracing.Start(ctx, "download", trace.WithAttributes(attribute.String("http.url", url)))
+	defer span.End()
+
+	backoff := m.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		release, err := m.acquireDownload()
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		f, retryable, err := m.downloadOnce(url, limit, header)
+		release()
+		if err == nil || !retryable || attempt >= m.config.MaxRetries {
+			if f != nil {
+				span.SetAttributes(attribute.Int("bytes", len(f.data)), attribute.Bool("not_modified", f.notModified))
+			}
+			span.SetAttributes(attribute.Int("retries", attempt))
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return f, err
+		}
+		m.log.Printf("download %s failed, retrying in %s: %v\n", url, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			span.SetAttributes(attribute.Int("retries", attempt))
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// downloadOnce fetches the url and tells whether a failure is worth retrying, which are 5xx responses and network errors
+// other than hosts which don't resolve.
+// Redirects are followed, the final response must be a 200 which is no HTML page, as served by upstreams redirecting to a login or error page.
+func (m *Manifests) downloadOnce(url string, limit int64, header http.Header) (*fetched, bool, error) {
 	if m.config.Debug {
 		m.log.Printf("downloading : %s\n", url)
 	}
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if creds, ok := m.upstreamCredentials(req.URL); ok {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// refused private addresses stay refused, unknown hosts stay unknown
+		var dnsErr *net.DNSError
+		notFound := cerrors.As(err, &dnsErr) && dnsErr.IsNotFound
+		return nil, !notFound && !cerrors.Is(err, upstream.ErrPrivateAddress), err
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotModified && len(header) > 0 {
+		return &fetched{notModified: true}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= http.StatusInternalServerError, &statusError{url: url, status: resp.StatusCode, text: resp.Status}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		return nil, false, fmt.Errorf("download %s: got an HTML page from %s", url, resp.Request.URL)
+	}
+	// the transport only decompresses transparently if it asked for compression itself
+	gzipped := !resp.Uncompressed && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+	if limit > 0 && resp.ContentLength > limit && !gzipped {
+		return nil, false, &sizeError{url: url, limit: limit}
+	}
+	// label by host only to bound the metric's cardinality
+	counted := &countingReader{r: metrics.CountReader(resp.Body, resp.Request.URL.Host)}
+	var body io.Reader = counted
+	if gzipped {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, true, fmt.Errorf("download %s: %w", url, err)
+		}
+		defer gr.Close()
+		body = gr
+	}
+	if limit > 0 {
+		// one more byte tells bodies beyond the limit apart
+		body = io.LimitReader(body, limit+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, true, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, false, &sizeError{url: url, limit: limit}
+	}
+	if resp.ContentLength >= 0 && counted.n != resp.ContentLength {
+		return nil, true, fmt.Errorf("download %s: got %d bytes, want %d", url, counted.n, resp.ContentLength)
+	}
+	return &fetched{data: data, etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}, false, nil
+}
+
+// countingReader counts the bytes read, to compare compressed bodies with their Content-Length.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// statusError is a download failing with an unexpected status.
+type statusError struct {
+	url    string
+	status int
+	text   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("download %s: %s", e.url, e.text)
+}
+
+// sizeError is a download exceeding its size limit.
+type sizeError struct {
+	url   string
+	limit int64
+}
+
+func (e *sizeError) Error() string {
+	return fmt.Sprintf("download %s: larger than the limit of %d bytes", e.url, e.limit)
+}
+
+// isClientError tells whether the download failed with a 4xx status the upstream keeps answering, unlike a 408 or 429.
+func isClientError(err error) bool {
+	var se *statusError
+	return cerrors.As(err, &se) && se.status >= 400 && se.status < 500 &&
+		se.status != http.StatusRequestTimeout && se.status != http.StatusTooManyRequests
+}
+
+// isNotFound tells whether the download failed because the upstream has no such file.
+func isNotFound(err error) bool {
+	var se *statusError
+	return cerrors.As(err, &se) && se.status == http.StatusNotFound
+}
+
+// checkChartArchive checks that the data is a gzipped tar archive, as charts are packaged.
+// Anything else is refused rather than labeled as chart, the error names the content type it looks like.
+func checkChartArchive(data []byte) error {
+	if err := readTarHeader(data); err != nil {
+		return fmt.Errorf("%w, detected %s", err, http.DetectContentType(data))
+	}
+	return nil
+}
+
+// readTarHeader gunzips the data up to its first tar header.
+func readTarHeader(data []byte) error {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return fmt.Errorf("not gzip compressed")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	if _, err = tar.NewReader(gr).Next(); err != nil {
+		return fmt.Errorf("not a tar archive: %w", err)
+	}
+	return nil
+}
+
+// upstreamCredentials returns the credentials configured for the host of the url.
+func (m *Manifests) upstreamCredentials(u *url.URL) (BasicCredentials, bool) {
+	for _, host := range []string{u.Host, u.Hostname()} {
+		if creds, ok := m.config.UpstreamAuth[strings.ToLower(host)]; ok {
+			return creds, true
+		}
+	}
+	return BasicCredentials{}, false
+}
+
+// upstreamURL returns the URL of the file in the upstream repo, using the scheme configured for its host.
+func (m *Manifests) upstreamURL(repoURLPath string, file string) string {
+	return fmt.Sprintf("%s://%s/%s", m.upstreamScheme(strings.SplitN(repoURLPath, "/", 2)[0]), repoURLPath, file)
+}
+
+// upstreamScheme returns the scheme configured for the host, https by default.
+func (m *Manifests) upstreamScheme(host string) string {
+	scheme, ok := m.config.UpstreamSchemes[strings.ToLower(host)]
+	if !ok {
+		scheme = m.config.UpstreamScheme
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme
 }
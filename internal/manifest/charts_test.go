@@ -0,0 +1,1261 @@
+package manifest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/metrics"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testChartYAML = `apiVersion: v2
+name: app
+version: 1.0.0
+`
+
+// serveCharts serves the files over HTTP and caches an index for charts.example.com
+// listing app 1.0.0 at the absolute URL of app-1.0.0.tgz.
+func serveCharts(t *testing.T, m *Manifests, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	return serveChartsHandler(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+}
+
+// serveChartsHandler is serveCharts with a custom handler serving the chart.
+func serveChartsHandler(t *testing.T, m *Manifests, h http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	index := repo.NewIndexFile()
+	index.Entries["app"] = repo.ChartVersions{{
+		Metadata: &chart.Metadata{Name: "app", Version: "1.0.0"},
+		URLs:     []string{srv.URL + "/app-1.0.0.tgz"},
+	}}
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: index}, 1, time.Hour)
+	return srv
+}
+
+// preparedManifest prepares app 1.0.0 and returns its parsed manifest.
+func preparedManifest(t *testing.T, m *Manifests) ocispec.Manifest {
+	t.Helper()
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	ma, ok := m.manifests["charts.example.com/app"]["1.0.0"]
+	if !ok {
+		t.Fatal("manifest not prepared")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(ma.Blob, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func layerMediaTypes(manifest ocispec.Manifest) []string {
+	var res []string
+	for _, l := range manifest.Layers {
+		res = append(res, l.MediaType)
+	}
+	return res
+}
+
+func TestPrepareChartSiblingPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy SiblingPolicy
+		want   []string
+	}{{
+		policy: SiblingsNone,
+		want:   []string{helmregistry.ChartLayerMediaType},
+	}, {
+		policy: SiblingsProvenance,
+		want:   []string{helmregistry.ChartLayerMediaType, helmregistry.ProvLayerMediaType},
+	}, {
+		// the signature is not published, which must not fail the pull
+		policy: SiblingsAll,
+		want:   []string{helmregistry.ChartLayerMediaType, helmregistry.ProvLayerMediaType},
+	}} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			m := newTestManifests(t, Config{SiblingPolicy: tc.policy})
+			serveCharts(t, m, map[string][]byte{
+				"/app-1.0.0.tgz":      testChart(t, testChartYAML, nil),
+				"/app-1.0.0.tgz.prov": []byte("-----BEGIN PGP SIGNED MESSAGE-----"),
+			})
+
+			got := layerMediaTypes(preparedManifest(t, m))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got layers %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("layer %d: got %s, want %s", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareChartReusesStoredChart(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	data := testChart(t, testChartYAML, nil)
+	// the chart is not downloadable, it must come from the blob store
+	serveCharts(t, m, map[string][]byte{})
+
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.blobHandler.(handler.BlobPutHandler).Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	index, err := m.GetIndex(context.Background(), "charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Entries["app"][0].Digest = h.Hex
+
+	got := layerMediaTypes(preparedManifest(t, m))
+	if len(got) != 1 || got[0] != helmregistry.ChartLayerMediaType {
+		t.Errorf("got layers %v, want the chart layer", got)
+	}
+}
+
+func TestCheckChartArchive(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte("not a tar archive"))
+	_ = gw.Close()
+
+	if err := checkChartArchive(testChart(t, testChartYAML, nil)); err != nil {
+		t.Errorf("chart: got %v", err)
+	}
+	for name, tc := range map[string]struct {
+		data     []byte
+		detected string
+	}{
+		"provenance": {[]byte("-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n"), "text/plain"},
+		"html":       {[]byte("<html><body>Sign in</body></html>"), "text/html"},
+		"gzipped":    {gzipped.Bytes(), "application/x-gzip"},
+	} {
+		if err := checkChartArchive(tc.data); err == nil || !strings.Contains(err.Error(), tc.detected) {
+			t.Errorf("%s: got %v, want an error detecting %s", name, err, tc.detected)
+		}
+	}
+}
+
+func TestPrepareChartRejectsStoredNonChart(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	data := []byte("-----BEGIN PGP SIGNED MESSAGE-----\n")
+	serveCharts(t, m, map[string][]byte{})
+
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.blobHandler.(handler.BlobPutHandler).Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	index, err := m.GetIndex(context.Background(), "charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Entries["app"][0].Digest = h.Hex
+
+	regErr := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+	if regErr == nil || regErr.Code != "UPSTREAM_INVALID" {
+		t.Fatalf("got %v, want UPSTREAM_INVALID", regErr)
+	}
+	if _, ok := m.lookup("charts.example.com/app", "1.0.0"); ok {
+		t.Error("non-chart content got cached as chart")
+	}
+}
+
+func TestPrepareChartRejectLibraryCharts(t *testing.T) {
+	m := newTestManifests(t, Config{RejectLibraryCharts: true})
+	serveCharts(t, m, map[string][]byte{
+		"/app-1.0.0.tgz": testChart(t, testChartYAML+"type: library\n", nil),
+	})
+
+	err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+	if err == nil || err.Status != http.StatusForbidden {
+		t.Fatalf("got %v, want 403", err)
+	}
+	if _, ok := m.manifests["charts.example.com/app"]; ok {
+		t.Error("library chart got cached")
+	}
+}
+
+func TestDownloadIndexWithUpstreamAuth(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ci" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	m := newTestManifests(t, Config{
+		Client:       srv.Client(),
+		UpstreamAuth: map[string]BasicCredentials{host: {Username: "ci", Password: "secret"}},
+	})
+	if _, err = m.GetIndex(context.Background(), host); err != nil {
+		t.Fatalf("index with credentials: %v", err)
+	}
+
+	m = newTestManifests(t, Config{Client: srv.Client()})
+	if _, err = m.GetIndex(context.Background(), host); err == nil {
+		t.Fatal("got the index without credentials")
+	}
+}
+
+func TestPrepareChartMetrics(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	ok := testutil.ToFloat64(metrics.ChartPrepares.WithLabelValues("ok"))
+	notFound := testutil.ToFloat64(metrics.ChartPrepares.WithLabelValues("notfound"))
+	hits := testutil.ToFloat64(metrics.IndexCacheHits.WithLabelValues("parsed"))
+
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "9.9.9"); err == nil {
+		t.Fatal("prepared a version which is not listed")
+	}
+
+	if got := testutil.ToFloat64(metrics.ChartPrepares.WithLabelValues("ok")) - ok; got != 1 {
+		t.Errorf("got %v ok prepares, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ChartPrepares.WithLabelValues("notfound")) - notFound; got != 1 {
+		t.Errorf("got %v notfound prepares, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.IndexCacheHits.WithLabelValues("parsed")) - hits; got != 2 {
+		t.Errorf("got %v index cache hits, want 2", got)
+	}
+}
+
+func TestPrepareChartWithoutProvenance(t *testing.T) {
+	m := newTestManifests(t, Config{SiblingPolicy: SiblingsProvenance})
+	// no .prov published, the upstream answers 404
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	got := layerMediaTypes(preparedManifest(t, m))
+	if len(got) != 1 || got[0] != helmregistry.ChartLayerMediaType {
+		t.Errorf("got layers %v, want the chart layer only", got)
+	}
+}
+
+func TestUpstreamURLScheme(t *testing.T) {
+	m := newTestManifests(t, Config{
+		UpstreamScheme:  "https",
+		UpstreamSchemes: map[string]string{"charts.internal": "http"},
+	})
+	for _, tc := range []struct{ repoPath, file, want string }{
+		{"charts.example.com", "index.yaml", "https://charts.example.com/index.yaml"},
+		{"charts.internal/stable", "index.yaml", "http://charts.internal/stable/index.yaml"},
+		{"Charts.Internal", "app-1.0.0.tgz", "http://Charts.Internal/app-1.0.0.tgz"},
+	} {
+		if got := m.upstreamURL(tc.repoPath, tc.file); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+
+	if got := newTestManifests(t, Config{}).upstreamURL("charts.example.com", "index.yaml"); got != "https://charts.example.com/index.yaml" {
+		t.Errorf("got %s without a configured scheme, want https", got)
+	}
+}
+
+func TestDownloadIndexPlainHTTP(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+	if _, err = m.GetIndex(context.Background(), host); err != nil {
+		t.Fatalf("index over plain HTTP: %v", err)
+	}
+}
+
+func TestGetIndexConcurrentDownloadsOnce(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloads int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&downloads, 1) == 1 {
+			entered <- struct{}{}
+		}
+		<-release
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := m.GetIndex(context.Background(), host)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err = findVersion(got, "app", "1.0.0"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-entered
+	// give the other requests time to join the download
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("got %d downloads of the index for concurrent requests, want 1", n)
+	}
+}
+
+func TestPrepareChartRelativeURLs(t *testing.T) {
+	chartData := testChart(t, testChartYAML, nil)
+	for chartURL, served := range map[string]string{
+		"app-1.0.0.tgz":                    "/org/charts/app-1.0.0.tgz",
+		"./stable/app-1.0.0.tgz":           "/org/charts/stable/app-1.0.0.tgz",
+		"../packages/app-1.0.0.tgz":        "/org/packages/app-1.0.0.tgz",
+		"../../dl/app-1.0.0.tgz?token=abc": "/dl/app-1.0.0.tgz",
+		"/downloads/app-1.0.0.tgz":         "/downloads/app-1.0.0.tgz",
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != served {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(chartData)
+		}))
+		host := strings.TrimPrefix(srv.URL, "http://")
+		m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+		index := testIndex("app", "1.0.0")
+		index.Entries["app"][0].URLs = []string{chartURL}
+		m.cache.SetWithTTL(host+"/org/charts", &indexCacheResp{c: index}, 1, time.Hour)
+
+		if err := m.prepareChart(context.Background(), host+"/org/charts/app", "1.0.0"); err != nil {
+			t.Errorf("%s: %v", chartURL, err)
+		}
+		srv.Close()
+	}
+}
+
+// ttlCache is a mapCache recording the TTL of every key.
+type ttlCache struct {
+	*mapCache
+	ttls sync.Map
+}
+
+func (c *ttlCache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	c.ttls.Store(key, ttl)
+	return c.mapCache.SetWithTTL(key, value, cost, ttl)
+}
+
+func TestGetIndexErrorTTL(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		min    time.Duration
+	}{
+		{http.StatusNotFound, 5 * time.Minute},
+		{http.StatusForbidden, 5 * time.Minute},
+		{http.StatusServiceUnavailable, 30 * time.Second},
+		{http.StatusTooManyRequests, 30 * time.Second},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		host := strings.TrimPrefix(srv.URL, "http://")
+		cache := &ttlCache{mapCache: newMapCache()}
+		ctx, cancel := context.WithCancel(context.Background())
+		m := NewManifests(ctx, mem.NewMemHandler(), Config{
+			UpstreamSchemes:       map[string]string{host: "http"},
+			IndexErrorCacheTTl:    30 * time.Second,
+			IndexNotFoundCacheTTL: 5 * time.Minute,
+		}, cache, log.New(io.Discard, "", 0))
+
+		if _, err := m.GetIndex(context.Background(), host); err == nil {
+			t.Errorf("%d: got an index", tc.status)
+		}
+		v, _ := cache.ttls.Load(host)
+		// with up to a fifth of jitter
+		if ttl, _ := v.(time.Duration); ttl < tc.min || ttl > tc.min+tc.min/5 {
+			t.Errorf("%d: got the error cached for %s, want %s plus jitter", tc.status, ttl, tc.min)
+		}
+		cancel()
+		srv.Close()
+	}
+}
+
+func TestPrepareChartAnnotations(t *testing.T) {
+	chartData := testChart(t, testChartYAML+`description: An app
+home: https://app.example.com
+sources:
+  - https://github.com/example/app
+`, nil)
+
+	var digests []string
+	for i := 0; i < 2; i++ {
+		m := newTestManifests(t, Config{})
+		serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": chartData})
+		manifest := preparedManifest(t, m)
+
+		for k, want := range map[string]string{
+			ocispec.AnnotationTitle:       "app",
+			ocispec.AnnotationVersion:     "1.0.0",
+			ocispec.AnnotationDescription: "An app",
+			ocispec.AnnotationURL:         "https://app.example.com",
+			ocispec.AnnotationSource:      "https://github.com/example/app",
+			ocispec.AnnotationCreated:     "1970-01-01T00:00:00Z",
+		} {
+			if got := manifest.Annotations[k]; got != want {
+				t.Errorf("annotation %s: got %q, want %q", k, got, want)
+			}
+		}
+		digests = append(digests, preparedDigest(t, m))
+	}
+	// packing the same chart again gives the same manifest
+	if digests[0] != digests[1] {
+		t.Errorf("got manifest digests %s and %s, want them equal", digests[0], digests[1])
+	}
+}
+
+// preparedDigest returns the digest of the prepared app 1.0.0 manifest.
+func preparedDigest(t *testing.T, m *Manifests) string {
+	t.Helper()
+	d, ok := m.digests["charts.example.com/app"]["1.0.0"]
+	if !ok {
+		t.Fatal("no digest recorded")
+	}
+	return d.Digest
+}
+
+func TestDownloadRetriesTransientFailures(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case atomic.AddInt32(&requests, 1) <= 2:
+			http.Error(w, "try again", http.StatusBadGateway)
+		default:
+			_, _ = w.Write([]byte("chart"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{MaxRetries: 3, RetryBackoff: time.Millisecond})
+
+	data, err := m.download(context.Background(), srv.URL+"/app-1.0.0.tgz", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "chart" {
+		t.Errorf("got %q, want %q", data, "chart")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	// not found is final
+	atomic.StoreInt32(&requests, 0)
+	if _, err = m.download(context.Background(), srv.URL+"/missing", 0); err == nil {
+		t.Error("got no error for a missing file")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("got %d retried requests for a missing file, want none", n)
+	}
+}
+
+func TestDownloadGivesUpAfterMaxRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	if _, err := m.download(context.Background(), srv.URL+"/index.yaml", 0); err == nil {
+		t.Fatal("got no error from a failing upstream")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestDownloadStopsRetryingOnCancel(t *testing.T) {
+	var requests int32
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{MaxRetries: 3, RetryBackoff: time.Hour})
+
+	if _, err := m.download(ctx, srv.URL+"/index.yaml", 0); !cerrors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestSharedDownloadsOutliveCanceledRequest(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := testChart(t, testChartYAML, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt of each file fails, the request goes away during the backoff
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			cancel()
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write(index)
+		case "/app-1.0.0.tgz":
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}, MaxRetries: 1, RetryBackoff: 10 * time.Millisecond})
+
+	if _, err := m.GetIndex(ctx, host); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	// the handler cancels the request preparing the chart now
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.prepare(ctx, host+"/app", "1.0.0"); err != nil {
+		t.Fatalf("chart: %v", err)
+	}
+}
+
+func TestCanceledIndexDownloadNotCached(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try again", http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{MaxRetries: 1, RetryBackoff: time.Hour, IndexErrorCacheTTl: time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	url := srv.URL + "/index.yaml"
+	if _, err := m.getIndexBytes(ctx, url, nil); !cerrors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if _, ok := m.cache.Get(url); ok {
+		t.Error("canceled download got cached")
+	}
+}
+
+func TestDownloadUnknownHostNotRetried(t *testing.T) {
+	var dials int32
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "charts.invalid", IsNotFound: true}}
+		},
+	}}
+	m := newTestManifests(t, Config{Client: client, MaxRetries: 3, RetryBackoff: time.Hour})
+
+	if _, err := m.download(context.Background(), "https://charts.invalid/index.yaml", 0); err == nil {
+		t.Fatal("got no error for an unknown host")
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("got %d dials, want 1", n)
+	}
+}
+
+func TestPrepareChartValuesLayer(t *testing.T) {
+	values := "replicas: 2\n"
+	chartData := testChart(t, testChartYAML, map[string]string{
+		"values.yaml":            values,
+		"charts/sub/values.yaml": "sub: true\n",
+		"templates/service.yaml": "kind: Service\n",
+	})
+	m := newTestManifests(t, Config{ExposeValuesLayer: true})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": chartData})
+
+	manifest := preparedManifest(t, m)
+	got := layerMediaTypes(manifest)
+	if len(got) != 2 || got[0] != helmregistry.ChartLayerMediaType || got[1] != ValuesLayerMediaType {
+		t.Fatalf("got layers %v, want the chart and its values", got)
+	}
+	if manifest.Layers[0].Digest.String() != digest.FromBytes(chartData).String() {
+		t.Error("chart layer differs from the chart")
+	}
+	if title := manifest.Layers[1].Annotations[ocispec.AnnotationTitle]; title != "values.yaml" {
+		t.Errorf("got values layer title %q, want values.yaml", title)
+	}
+
+	h, err := v1.NewHash(manifest.Layers[1].Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != values {
+		t.Errorf("got values %q, want %q", data, values)
+	}
+}
+
+func TestDownloadIndexJSONFallback(t *testing.T) {
+	index, err := json.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartData := testChart(t, testChartYAML, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.json":
+			_, _ = w.Write(index)
+		case "/app-1.0.0.tgz":
+			_, _ = w.Write(chartData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	m := newTestManifests(t, Config{UpstreamScheme: "http"})
+	if err := m.prepareChart(context.Background(), host+"/app", "1.0.0"); err != nil {
+		t.Fatalf("chart of a JSON index: %v", err)
+	}
+	if _, ok := m.lookup(host+"/app", "1.0.0"); !ok {
+		t.Error("chart of a JSON index not prepared")
+	}
+}
+
+func TestPrepareChartCachesMissingVersions(t *testing.T) {
+	m := newTestManifests(t, Config{NotFoundCacheTTL: time.Minute})
+	srv := serveCharts(t, m, map[string][]byte{"/app-2.0.0.tgz": testChart(t, "apiVersion: v2\nname: app\nversion: 2.0.0\n", nil)})
+
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "2.0.0"); err == nil || err.Status != http.StatusNotFound {
+		t.Fatalf("got %v, want not found", err)
+	}
+
+	// the cached index gains the version, the cached lookup doesn't scan it again
+	c, _ := m.cache.Get("charts.example.com")
+	index := c.(*indexCacheResp).c
+	index.Entries["app"] = append(index.Entries["app"], &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "app", Version: "2.0.0"},
+		URLs:     []string{srv.URL + "/app-2.0.0.tgz"},
+	})
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "2.0.0"); err == nil || err.Status != http.StatusNotFound {
+		t.Fatalf("got %v, want the cached not found", err)
+	}
+
+	// a refreshed index invalidates it
+	refreshed := repo.NewIndexFile()
+	refreshed.Entries["app"] = index.Entries["app"]
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: refreshed}, 1, time.Hour)
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "2.0.0"); err != nil {
+		t.Fatalf("version of the refreshed index: %v", err)
+	}
+}
+
+func TestPrepareChartConfigIsChartMetadata(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML+"description: An app\n", nil)})
+	manifest := preparedManifest(t, m)
+
+	if manifest.Config.MediaType != helmregistry.ConfigMediaType {
+		t.Errorf("got config media type %s, want %s", manifest.Config.MediaType, helmregistry.ConfigMediaType)
+	}
+	h, err := v1.NewHash(manifest.Config.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var meta chart.Metadata
+	if err = json.NewDecoder(rc).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "app" || meta.Version != "1.0.0" || meta.Description != "An app" {
+		t.Errorf("got config %+v, want the chart's metadata", meta)
+	}
+}
+
+func TestPrepareChartSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartData := testChart(t, testChartYAML, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write(index)
+		case "/app-1.0.0.tgz":
+			_, _ = w.Write(chartData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "request")
+	if err := m.prepareChart(ctx, host+"/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	var downloads []sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.Name() == "download" {
+			downloads = append(downloads, s)
+		}
+		spans[s.Name()] = s
+	}
+	for _, name := range []string{"request", "prepareChart", "GetIndex"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("no %s span recorded", name)
+		}
+	}
+	parent := func(s sdktrace.ReadOnlySpan) trace.SpanID { return s.Parent().SpanID() }
+	if parent(spans["prepareChart"]) != spans["request"].SpanContext().SpanID() {
+		t.Error("prepareChart span is not a child of the request span")
+	}
+	if parent(spans["GetIndex"]) != spans["prepareChart"].SpanContext().SpanID() {
+		t.Error("GetIndex span is not a child of the prepareChart span")
+	}
+	if len(downloads) != 2 {
+		t.Fatalf("got %d download spans, want the index and the chart", len(downloads))
+	}
+	for _, d := range downloads {
+		want := spans["prepareChart"]
+		if strings.HasSuffix(attributeValue(d, "http.url"), "/index.yaml") {
+			want = spans["GetIndex"]
+		}
+		if parent(d) != want.SpanContext().SpanID() {
+			t.Errorf("download span of %s is not a child of the %s span", attributeValue(d, "http.url"), want.Name())
+		}
+	}
+}
+
+func attributeValue(s sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestPrepareChartRejectsInvalidTarball(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte("not a tar archive"))
+	_ = gw.Close()
+
+	for name, data := range map[string][]byte{
+		"text":    []byte("Sign in to continue"),
+		"empty":   {},
+		"gzipped": gzipped.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newTestManifests(t, Config{})
+			serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": data})
+
+			err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+			if err == nil {
+				t.Fatal("got no error for an invalid chart tarball")
+			}
+			if err.Status != http.StatusBadGateway || !strings.Contains(err.Message, "did not return a valid chart tarball") {
+				t.Errorf("got error %v", err)
+			}
+			if _, ok := m.lookup("charts.example.com/app", "1.0.0"); ok {
+				t.Error("invalid chart got cached")
+			}
+		})
+	}
+}
+
+func TestDownloadRejectsRedirectToHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app-1.0.0.tgz":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case "/login":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<html><body>Sign in</body></html>"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{})
+
+	_, err := m.download(context.Background(), srv.URL+"/app-1.0.0.tgz", 0)
+	if err == nil || !strings.Contains(err.Error(), "HTML page") {
+		t.Errorf("got error %v, want the HTML page rejected", err)
+	}
+}
+
+func TestDownloadRejectsShortBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("truncated"))
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{})
+
+	if _, err := m.download(context.Background(), srv.URL+"/app-1.0.0.tgz", 0); err == nil {
+		t.Error("got no error for a body shorter than its Content-Length")
+	}
+}
+
+func TestPrepareChartVerifiesDigest(t *testing.T) {
+	data := testChart(t, testChartYAML, nil)
+	for _, tc := range []struct {
+		name   string
+		digest string
+		verify bool
+		ok     bool
+	}{
+		{name: "match", digest: digest.FromBytes(data).Encoded(), verify: true, ok: true},
+		{name: "prefixed", digest: digest.FromBytes(data).String(), verify: true, ok: true},
+		{name: "mismatch", digest: digest.FromString("other").Encoded(), verify: true, ok: false},
+		{name: "disabled", digest: digest.FromString("other").Encoded(), verify: false, ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, Config{VerifyChartDigest: tc.verify})
+			serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": data})
+			index, err := m.GetIndex(context.Background(), "charts.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			index.Entries["app"][0].Digest = tc.digest
+
+			regErr := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+			if tc.ok && regErr != nil {
+				t.Fatal(regErr)
+			}
+			if !tc.ok {
+				if regErr == nil || regErr.Code != "DIGEST_INVALID" {
+					t.Fatalf("got error %v, want a digest mismatch", regErr)
+				}
+				if _, ok := m.lookup("charts.example.com/app", "1.0.0"); ok {
+					t.Error("chart with mismatching digest got cached")
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareChartConcurrentCopy(t *testing.T) {
+	m := newTestManifests(t, Config{CopyConcurrency: 4, SiblingPolicy: SiblingsProvenance, ExposeValuesLayer: true})
+	serveCharts(t, m, map[string][]byte{
+		"/app-1.0.0.tgz":      testChart(t, testChartYAML, map[string]string{"values.yaml": "replicas: 1\n"}),
+		"/app-1.0.0.tgz.prov": []byte("-----BEGIN PGP SIGNED MESSAGE-----"),
+	})
+
+	manifest := preparedManifest(t, m)
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("got layers %v, want chart, provenance and values", layerMediaTypes(manifest))
+	}
+	want := []string{manifest.Config.Digest.String()}
+	for _, l := range manifest.Layers {
+		want = append(want, l.Digest.String())
+	}
+	sort.Strings(want)
+	refs := m.manifests["charts.example.com/app"]["1.0.0"].Refs
+	sort.Strings(refs)
+	if strings.Join(refs, ",") != strings.Join(want, ",") {
+		t.Errorf("got refs %v, want %v", refs, want)
+	}
+}
+
+func TestRefCollectorAnnotatesAllBlobs(t *testing.T) {
+	c := &refCollector{}
+	var want []string
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		d := digest.FromString(fmt.Sprint(i))
+		want = append(want, d.String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.preCopy(context.Background(), ocispec.Descriptor{MediaType: helmregistry.ChartLayerMediaType, Digest: d}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	manifest := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Annotations: map[string]string{}}
+	if err := c.preCopy(context.Background(), manifest); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for k, v := range manifest.Annotations {
+		if strings.HasPrefix(k, ProxyRefAnnotationPrefix) {
+			got = append(got, v)
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got ref annotations %v, want %v", got, want)
+	}
+}
+
+func TestDownloadSizeLimit(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/declared.tgz" {
+			w.Header().Set("Content-Length", "1073741824")
+		}
+		// an endless body, which must not be buffered
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	m := newTestManifests(t, Config{MaxRetries: 2, RetryBackoff: time.Millisecond})
+
+	for _, path := range []string{"/declared.tgz", "/chunked.tgz"} {
+		_, err := m.download(context.Background(), srv.URL+path, 64*1024)
+		var se *sizeError
+		if !cerrors.As(err, &se) {
+			t.Errorf("%s: got error %v, want the size limit exceeded", path, err)
+		}
+	}
+}
+
+func TestDownloadIndexNotModified(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloads, notModified int32
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+	expire := func() {
+		c := m.cache.(*mapCache)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.m, host)
+		delete(c.m, srv.URL+"/index.yaml")
+	}
+
+	first, err := m.GetIndex(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire()
+	second, err := m.GetIndex(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Error("unchanged index was parsed again")
+	}
+	if d, n := atomic.LoadInt32(&downloads), atomic.LoadInt32(&notModified); d != 1 || n != 1 {
+		t.Errorf("got %d downloads and %d not modified responses, want 1 each", d, n)
+	}
+
+	// changed upstream
+	etag = `"v2"`
+	expire()
+	if _, err = m.GetIndex(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	if d := atomic.LoadInt32(&downloads); d != 2 {
+		t.Errorf("got %d downloads, want the changed index downloaded again", d)
+	}
+}
+
+func TestDownloadIndexGzipEncoded(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0", "1.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, _ = gw.Write(index)
+	_ = gw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write(index)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", fmt.Sprint(compressed.Len()))
+		_, _ = w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+	i, err := m.GetIndex(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(i.Entries["app"]); n != 2 {
+		t.Errorf("got %d versions of app, want 2", n)
+	}
+
+	// the limit applies to the decompressed index
+	m = newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}, MaxIndexSize: int64(compressed.Len())})
+	var se *sizeError
+	if _, err = m.GetIndex(context.Background(), host); !cerrors.As(err, &se) {
+		t.Errorf("got error %v, want the size limit exceeded", err)
+	}
+}
+
+func TestPrepareChartIsReproducible(t *testing.T) {
+	files := map[string][]byte{
+		"/app-1.0.0.tgz":      testChart(t, testChartYAML+"description: An app\n", map[string]string{"values.yaml": "replicas: 1\n"}),
+		"/app-1.0.0.tgz.prov": []byte("-----BEGIN PGP SIGNED MESSAGE-----"),
+	}
+	var packed []Manifest
+	for i := 0; i < 2; i++ {
+		m := newTestManifests(t, Config{SiblingPolicy: SiblingsProvenance, ExposeValuesLayer: true, CopyConcurrency: 4})
+		serveCharts(t, m, files)
+		preparedManifest(t, m)
+		packed = append(packed, m.manifests["charts.example.com/app"]["1.0.0"])
+	}
+	if !bytes.Equal(packed[0].Blob, packed[1].Blob) {
+		t.Errorf("packing the chart twice gave different manifests:\n%s\n%s", packed[0].Blob, packed[1].Blob)
+	}
+	if strings.Join(packed[0].Refs, ",") != strings.Join(packed[1].Refs, ",") {
+		t.Errorf("packing the chart twice gave different refs: %v and %v", packed[0].Refs, packed[1].Refs)
+	}
+}
+
+func TestDownloadIndexMissingAPIVersion(t *testing.T) {
+	archive := testChart(t, testChartYAML, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = w.Write([]byte("entries:\n  app:\n  - name: app\n    version: 1.0.0\n    urls: [app-1.0.0.tgz]\n"))
+		case "/app-1.0.0.tgz":
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}})
+
+	// the parsed index starts out as v1, which an index without apiVersion keeps
+	index, err := m.GetIndex(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.APIVersion != repo.APIVersionV1 {
+		t.Errorf("got apiVersion %q, want %s", index.APIVersion, repo.APIVersionV1)
+	}
+	if err := m.prepareChart(context.Background(), host+"/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup(host+"/app", "1.0.0"); !ok {
+		t.Error("chart of the index without apiVersion not cached")
+	}
+}
+
+func TestParseIndexInvalidChartVersion(t *testing.T) {
+	data := []byte(`apiVersion: v1
+entries:
+  app:
+  - {name: app, version: 2.0.0, urls: [app-2.0.0.tgz]}
+  - {name: app, version: 1.1.0, type: operator, urls: [app-1.1.0.tgz]}
+  - {name: app, version: 1.0.0, urls: [app-1.0.0.tgz]}
+`)
+	for _, keep := range []bool{false, true} {
+		var logs bytes.Buffer
+		m := newTestManifests(t, Config{KeepInvalidChartVersions: keep})
+		m.log = log.New(&logs, "", 0)
+
+		index, err := m.parseIndex("https://charts.example.com/index.yaml", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []string
+		for _, v := range index.Entries["app"] {
+			versions = append(versions, v.Version)
+		}
+		want := "2.0.0 1.0.0"
+		if keep {
+			want = "2.0.0 1.1.0 1.0.0"
+		}
+		if got := strings.Join(versions, " "); got != want {
+			t.Errorf("keep %v: got versions %s, want %s", keep, got, want)
+		}
+		if !strings.Contains(logs.String(), "app 1.1.0 of https://charts.example.com/index.yaml") {
+			t.Errorf("keep %v: invalid version not logged: %q", keep, logs.String())
+		}
+	}
+}
+
+func TestParseIndexUnexpectedFields(t *testing.T) {
+	var logs bytes.Buffer
+	m := newTestManifests(t, Config{})
+	m.log = log.New(&logs, "", 0)
+
+	index, err := m.parseIndex("https://charts.example.com/index.yaml", []byte(`apiVersion: v1
+publisher: charts.example.com
+entries:
+  app:
+  - {name: app, version: 1.0.0, urls: [app-1.0.0.tgz], x-build: 42}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = findVersion(index, "app", "1.0.0"); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(logs.String(), "https://charts.example.com/index.yaml") {
+		t.Errorf("lenient parsing not logged: %q", logs.String())
+	}
+
+	if _, err = m.parseIndex("https://charts.example.com/index.yaml", []byte("entries: [")); err == nil {
+		t.Error("got no error for an index which is no YAML")
+	}
+}
+
+func TestPrepareChartArtifactManifest(t *testing.T) {
+	m := newTestManifests(t, Config{ArtifactManifests: true})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	ma, ok := m.manifests["charts.example.com/app"]["1.0.0"]
+	if !ok {
+		t.Fatal("manifest not prepared")
+	}
+	if ma.ContentType != ocispec.MediaTypeArtifactManifest {
+		t.Errorf("got content type %s, want %s", ma.ContentType, ocispec.MediaTypeArtifactManifest)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ma.Blob, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"subject", "config"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("artifact manifest has a %s: %s", field, fields[field])
+		}
+	}
+	var manifest ocispec.Artifact
+	if err := json.Unmarshal(ma.Blob, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.MediaType != ocispec.MediaTypeArtifactManifest {
+		t.Errorf("got media type %s, want %s", manifest.MediaType, ocispec.MediaTypeArtifactManifest)
+	}
+	if manifest.ArtifactType != helmregistry.ConfigMediaType {
+		t.Errorf("got artifact type %s, want %s", manifest.ArtifactType, helmregistry.ConfigMediaType)
+	}
+	if len(manifest.Blobs) != 1 || manifest.Blobs[0].MediaType != helmregistry.ChartLayerMediaType {
+		t.Fatalf("got blobs %v, want the chart", manifest.Blobs)
+	}
+	if got, want := manifest.Annotations[ocispec.AnnotationArtifactCreated], manifest.Annotations[ocispec.AnnotationCreated]; got != want {
+		t.Errorf("got artifact created %q, want the chart's %q", got, want)
+	}
+	if len(ma.Refs) != 1 || ma.Refs[0] != manifest.Blobs[0].Digest.String() {
+		t.Errorf("got refs %v, want the chart blob", ma.Refs)
+	}
+}
@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"helm.sh/helm/v3/pkg/repo"
+	"net/http"
+)
+
+// lastIndexKeyPrefix prefixes the cache keys of the last index fetched per repo, kept beyond the index cache TTL
+// to refresh the index with a conditional request.
+const lastIndexKeyPrefix = "lastindex\x00"
+
+// lastIndex is the index last fetched from an upstream repo with the validators of its response.
+type lastIndex struct {
+	url          string
+	etag         string
+	lastModified string
+	index        *repo.IndexFile
+}
+
+// conditionalHeader returns the header asking for the index only if it changed, nil if there is nothing to compare it with.
+func (l *lastIndex) conditionalHeader() http.Header {
+	if l == nil {
+		return nil
+	}
+	header := http.Header{}
+	if l.etag != "" {
+		header.Set("If-None-Match", l.etag)
+	}
+	if l.lastModified != "" {
+		header.Set("If-Modified-Since", l.lastModified)
+	}
+	return header
+}
+
+// lastIndex returns the index last fetched for the repo, nil if unknown.
+func (m *Manifests) lastIndex(repoURLPath string) *lastIndex {
+	c, ok := m.cache.Get(lastIndexKeyPrefix + repoURLPath)
+	if !ok {
+		return nil
+	}
+	l, _ := c.(*lastIndex)
+	return l
+}
+
+// rememberIndex keeps the fetched index if its response has validators. It doesn't expire,
+// the cost bounded cache evicts it like any other index.
+func (m *Manifests) rememberIndex(repoURLPath string, url string, f *fetched, index *repo.IndexFile) {
+	if f.etag == "" && f.lastModified == "" {
+		return
+	}
+	m.cache.SetWithTTL(lastIndexKeyPrefix+repoURLPath, &lastIndex{
+		url:          url,
+		etag:         f.etag,
+		lastModified: f.lastModified,
+		index:        index,
+	}, 1000, 0)
+}
@@ -1,10 +1,98 @@
 package manifest
 
-import "time"
+import (
+	"crypto"
+	"net/http"
+	"time"
+)
 
 type Config struct {
 	Debug              bool
 	CacheTTL           time.Duration // for how long store manifest
 	IndexCacheTTL      time.Duration
 	IndexErrorCacheTTl time.Duration
+	VersionIndex       bool   // serve an image index of all versions for an empty reference
+	ParentRegistry     string // parent proxy/registry to forward pulls to on a local miss
+	// reject manifest requests without a concrete reference, tag listing is not affected
+	RequireExplicitVersion bool
+	MaxRepos               int      // max distinct repos cached, least recently used repos get evicted; 0 means unlimited
+	OCIUpstreams           []string // upstream hosts which are OCI registries instead of chart repositories
+	// cached manifests older than this get checked against the upstream index before being served; 0 disables it
+	RevalidateMaxAge time.Duration
+	SiblingPolicy    SiblingPolicy // which files next to the chart (provenance, signatures) get packed too
+	Client           *http.Client  // for all upstream requests, http.DefaultClient if nil
+	BlobCacheTTL     time.Duration // for how long blobs outlive their expired manifests, 0 deletes them together
+	// refuse pulling charts of type library, they can only be used as dependencies
+	RejectLibraryCharts bool
+	Signer              crypto.Signer // signs generated manifests cosign style, nil disables signing
+	// credentials for upstream hosts, keyed by lower case host with or without port
+	UpstreamAuth map[string]BasicCredentials
+	// scheme of upstream index and relative chart URLs, https if empty, overridden per lower case host by UpstreamSchemes
+	UpstreamScheme  string
+	UpstreamSchemes map[string]string
+	Store           ManifestStore // persists manifests across restarts, nil keeps them in memory only
+	// retries of upstream downloads failing with 5xx or network errors, waiting RetryBackoff doubling per attempt
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// list tags with the "v" prefix of their version, either spelling is accepted as reference anyway
+	PreserveVersionPrefix bool
+	// pack the chart's values.yaml as extra layer, so it can be inspected without pulling the chart
+	ExposeValuesLayer bool
+	// for how long chart versions missing from the index are answered from cache, 0 disables it
+	NotFoundCacheTTL time.Duration
+	// maps the first path element of requested repos to the upstream path it stands for
+	RepoAliases map[string]string
+	// reject downloaded charts whose sha256 differs from the digest listed in the index
+	VerifyChartDigest bool
+	// glob patterns of upstream hosts which may be proxied, all if empty, DeniedUpstreamHosts take precedence
+	AllowedUpstreamHosts []string
+	DeniedUpstreamHosts  []string
+	// blobs copied at once when packing or pulling a chart, 1 if less
+	CopyConcurrency int
+	// max bytes of downloaded charts and their siblings, and of indexes, 0 means no limit
+	MaxChartSize int64
+	MaxIndexSize int64
+	// let the latest tag resolve to prereleases too, it resolves to the highest stable version otherwise
+	AllowPrereleaseLatest bool
+	// where the created annotation of packed charts takes its time from, the index if empty
+	CreatedPolicy CreatedPolicy
+	// upstream downloads running at once across all repos, 0 means no limit,
+	// downloads waiting longer than DownloadQueueTimeout for a free slot get a 503
+	MaxConcurrentDownloads int
+	DownloadQueueTimeout   time.Duration
+	// max manifests cached, counting tags and digests, the oldest get evicted; 0 means unlimited
+	MaxManifests int
+	// list the chart archives served next to the index in served indexes, instead of the upstream URLs
+	HelmHTTP bool
+	// for how long index downloads failing with a 404 or another client error are cached, IndexErrorCacheTTl if 0
+	IndexNotFoundCacheTTL time.Duration
+	// Cache-Control max-age of served manifests, which are immutable if pulled by digest; 0 sends no Cache-Control
+	ResponseCacheMaxAge time.Duration
+	// CacheTTL and IndexCacheTTL of repos by lower case host, or host and path, the longest match wins
+	CacheTTLOverrides map[string]time.Duration
+	// maps the lower case first path element of virtual repos to the upstream paths whose indexes they merge,
+	// VirtualRepoConflicts tells what happens to charts listed by several of them, later ones override if empty
+	VirtualRepos         map[string][]string
+	VirtualRepoConflicts MergePolicy
+	// keep chart versions failing validation in parsed indexes, so they can still be pulled, rather than dropping them
+	KeepInvalidChartVersions bool
+	// index downloads running at once, on top of MaxConcurrentDownloads; 0 means no limit,
+	// they wait up to DownloadQueueTimeout for a free slot too
+	MaxConcurrentIndexDownloads int
+	// page size of tag and catalog lists requested without n, 0 lists all tags and up to 10000 repos;
+	// larger n than MaxPageSize get cut to it, 0 means no limit
+	DefaultPageSize int
+	MaxPageSize     int
+	// pack charts as OCI 1.1 artifact manifests of the Helm chart artifact type rather than image manifests,
+	// for referrers tooling; they have no config, which Helm clients need to pull them,
+	// and clients whose Accept header doesn't list the artifact manifest type get a 406
+	ArtifactManifests bool
+	// for how long the digest of a tag is remembered after it was packed, answering HEAD and digest requests
+	// once its manifest expired or got evicted; 0 forgets it once the manifest is gone
+	KnownDigestTTL time.Duration
+}
+
+type BasicCredentials struct {
+	Username string
+	Password string
 }
@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"helm.sh/helm/v3/pkg/repo"
+	"path"
+	"strings"
+	"time"
+)
+
+// CreatedPolicy defines where the created annotation of packed manifests takes its time from.
+// Whichever is picked, it never is the current time, so packing a chart twice gives the same manifest digest.
+type CreatedPolicy string
+
+const (
+	// CreatedFromChart takes the modification time of Chart.yaml in the chart archive, falling back to CreatedFromIndex
+	CreatedFromChart CreatedPolicy = "chart-created"
+	// CreatedFromIndex takes the creation time the index lists for the chart version, falling back to CreatedEpoch
+	CreatedFromIndex CreatedPolicy = "index-created"
+	// CreatedEpoch always takes the Unix epoch
+	CreatedEpoch CreatedPolicy = "epoch"
+)
+
+// Valid tells whether the policy is known.
+func (p CreatedPolicy) Valid() bool {
+	switch p {
+	case CreatedFromChart, CreatedFromIndex, CreatedEpoch:
+		return true
+	}
+	return false
+}
+
+// chartCreated returns the creation time of the chart version according to the configured policy.
+// An empty policy keeps taking the time from the index.
+func (m *Manifests) chartCreated(chartVer *repo.ChartVersion, chartData []byte) time.Time {
+	switch m.config.CreatedPolicy {
+	case CreatedEpoch:
+		return time.Unix(0, 0)
+	case CreatedFromChart:
+		if t, ok := chartYAMLModTime(chartData); ok {
+			return t
+		}
+	}
+	if chartVer.Created.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return chartVer.Created
+}
+
+// chartYAMLModTime returns the modification time of the top level Chart.yaml in the chart archive.
+// Archives packed without modification times have the epoch there, which is not taken.
+func chartYAMLModTime(chartData []byte) (time.Time, bool) {
+	gr, err := gzip.NewReader(bytes.NewReader(chartData))
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil { // io.EOF without a Chart.yaml
+			return time.Time{}, false
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "/")
+		if path.Base(name) != "Chart.yaml" || strings.Count(name, "/") != 1 {
+			continue
+		}
+		if hdr.ModTime.Unix() <= 0 {
+			return time.Time{}, false
+		}
+		return hdr.ModTime, true
+	}
+}
@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testChartModTime returns a packaged chart whose Chart.yaml was modified at the given time.
+func testChartModTime(t *testing.T, modTime time.Time) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    "app/Chart.yaml",
+		Mode:    0644,
+		Size:    int64(len(testChartYAML)),
+		ModTime: modTime,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(testChartYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPrepareChartCreatedPolicy(t *testing.T) {
+	chartTime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	indexTime := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	for _, tc := range []struct {
+		policy    CreatedPolicy
+		chartData []byte
+		indexTime time.Time
+		want      string
+	}{
+		{CreatedFromChart, testChartModTime(t, chartTime), indexTime, "2023-04-05T06:07:08Z"},
+		{CreatedFromChart, testChart(t, testChartYAML, nil), indexTime, "2023-05-06T07:08:09Z"},
+		{CreatedFromChart, testChart(t, testChartYAML, nil), time.Time{}, "1970-01-01T00:00:00Z"},
+		{CreatedFromIndex, testChartModTime(t, chartTime), indexTime, "2023-05-06T07:08:09Z"},
+		{CreatedFromIndex, testChartModTime(t, chartTime), time.Time{}, "1970-01-01T00:00:00Z"},
+		{CreatedEpoch, testChartModTime(t, chartTime), indexTime, "1970-01-01T00:00:00Z"},
+		{"", testChartModTime(t, chartTime), indexTime, "2023-05-06T07:08:09Z"},
+	} {
+		m := newTestManifests(t, Config{CreatedPolicy: tc.policy})
+		serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": tc.chartData})
+		cached, _ := m.cache.Get("charts.example.com")
+		cached.(*indexCacheResp).c.Entries["app"][0].Created = tc.indexTime
+
+		before := time.Now()
+		manifest := preparedManifest(t, m)
+		if got := manifest.Annotations[ocispec.AnnotationCreated]; got != tc.want {
+			t.Errorf("policy %q: got created %q, want %q", tc.policy, got, tc.want)
+		}
+		// the cache age is unaffected by the policy
+		if ma := m.manifests["charts.example.com/app"]["1.0.0"]; ma.CreatedAt.Before(before) {
+			t.Errorf("policy %q: manifest cached at %v, before it was prepared", tc.policy, ma.CreatedAt)
+		}
+	}
+}
+
+func TestCreatedPolicyValid(t *testing.T) {
+	for p, want := range map[CreatedPolicy]bool{
+		CreatedFromChart: true,
+		CreatedFromIndex: true,
+		CreatedEpoch:     true,
+		"":               false,
+		"now":            false,
+	} {
+		if got := p.Valid(); got != want {
+			t.Errorf("%q valid: got %v, want %v", p, got, want)
+		}
+	}
+}
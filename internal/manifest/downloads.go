@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"context"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// errTooManyDownloads is returned for downloads which got no slot within DownloadQueueTimeout.
+var errTooManyDownloads = cerrors.New("too many concurrent upstream downloads")
+
+// acquireDownload takes one of the MaxConcurrentDownloads slots, waiting up to DownloadQueueTimeout for one getting free.
+// The returned func frees the slot again.
+func (m *Manifests) acquireDownload() (func(), error) {
+	return m.acquireSlot(m.downloads)
+}
+
+// acquireIndexDownload takes one of the MaxConcurrentIndexDownloads slots like acquireDownload does.
+// Index downloads take a download slot as well, this one additionally caps how many indexes are held in memory at once.
+func (m *Manifests) acquireIndexDownload() (func(), error) {
+	return m.acquireSlot(m.indexDownloads)
+}
+
+// acquireSlot takes one of the slots, nil means unlimited ones.
+func (m *Manifests) acquireSlot(slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	// no context to wait on, downloads are shared by concurrent requests
+	timer := time.NewTimer(m.config.DownloadQueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errTooManyDownloads
+	}
+}
+
+// refusedDownload returns the error answering a download which was refused before asking the upstream, nil for other failures.
+func refusedDownload(err error) *errors.RegError {
+	if regErr := privateUpstream(err); regErr != nil {
+		return regErr
+	}
+	if !cerrors.Is(err, errTooManyDownloads) {
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "UNAVAILABLE",
+		Message: fmt.Sprintf("%v, retry later", err),
+		Header:  http.Header{"Retry-After": {"1"}},
+	}
+}
+
+// failedDownload returns the error answering a download which was refused or couldn't reach the upstream, nil for other failures.
+func failedDownload(err error) *errors.RegError {
+	if regErr := refusedDownload(err); regErr != nil {
+		return regErr
+	}
+	return unreachableUpstream(err)
+}
+
+// unreachableUpstream returns the error answering a download whose upstream couldn't be reached, nil for other failures.
+// Hosts which don't resolve are unknown names, connections failing or timing out leave the upstream unavailable.
+func unreachableUpstream(err error) *errors.RegError {
+	var dnsErr *net.DNSError
+	if cerrors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("upstream host %s not found", dnsErr.Name),
+		}
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	timeout := cerrors.As(err, &netErr) && netErr.Timeout()
+	if !cerrors.As(err, &opErr) && !timeout && !cerrors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusBadGateway,
+		Code:    "UPSTREAM_UNAVAILABLE",
+		Message: fmt.Sprintf("upstream unavailable: %v", err),
+	}
+}
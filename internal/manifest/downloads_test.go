@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+func TestPrepareChartMaxConcurrentDownloads(t *testing.T) {
+	const limit, versions = 2, 8
+	m := newTestManifests(t, Config{MaxConcurrentDownloads: limit, DownloadQueueTimeout: time.Minute})
+	chartData := testChart(t, testChartYAML, nil)
+
+	var running, peak int32
+	srv := serveChartsHandler(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write(chartData)
+	}))
+	index, err := m.GetIndex(context.Background(), "charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Entries["app"] = nil
+	for i := 0; i < versions; i++ {
+		version := fmt.Sprintf("1.0.%d", i)
+		index.Entries["app"] = append(index.Entries["app"], &repo.ChartVersion{
+			Metadata: &chart.Metadata{Name: "app", Version: version},
+			URLs:     []string{srv.URL + "/app-" + version + ".tgz"},
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < versions; i++ {
+		wg.Add(1)
+		go func(version string) {
+			defer wg.Done()
+			if err := m.prepare(context.Background(), "charts.example.com/app", version); err != nil {
+				t.Errorf("prepare %s: %v", version, err)
+			}
+		}(fmt.Sprintf("1.0.%d", i))
+	}
+	wg.Wait()
+
+	if peak > limit {
+		t.Errorf("got %d downloads at once, want at most %d", peak, limit)
+	}
+}
+
+func TestPrepareChartDownloadQueueTimeout(t *testing.T) {
+	m := newTestManifests(t, Config{MaxConcurrentDownloads: 1, DownloadQueueTimeout: 10 * time.Millisecond})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	// another download takes the only slot
+	m.downloads <- struct{}{}
+	err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+	if err == nil || err.Status != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want a 503", err)
+	}
+	if got := err.Header.Get("Retry-After"); got == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	<-m.downloads
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatalf("prepare once the slot is free: %v", err)
+	}
+}
+
+func TestGetIndexMaxConcurrentIndexDownloads(t *testing.T) {
+	const limit, repos = 2, 8
+	var running, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		data, _ := yaml.Marshal(testIndex("app", "1.0.0"))
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{
+		UpstreamSchemes:             map[string]string{host: "http"},
+		MaxConcurrentIndexDownloads: limit,
+		DownloadQueueTimeout:        time.Minute,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < repos; i++ {
+		wg.Add(1)
+		go func(repoURLPath string) {
+			defer wg.Done()
+			if _, err := m.GetIndex(context.Background(), repoURLPath); err != nil {
+				t.Errorf("get index %s: %v", repoURLPath, err)
+			}
+		}(fmt.Sprintf("%s/repo%d", host, i))
+	}
+	wg.Wait()
+
+	if peak > limit {
+		t.Errorf("got %d index downloads at once, want at most %d", peak, limit)
+	}
+	if peak < limit {
+		t.Errorf("got %d index downloads at once, want %d", peak, limit)
+	}
+}
+
+func TestPrepareChartUnreachableUpstream(t *testing.T) {
+	// nothing listens on the address of a closed server, connecting to it is refused
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	refusedHost := strings.TrimPrefix(closed.URL, "http://")
+	noSuchHost := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "charts.invalid", IsNotFound: true}}
+		},
+	}}
+
+	for _, tc := range []struct {
+		name       string
+		config     Config
+		repo       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "index connection refused",
+			config:     Config{UpstreamSchemes: map[string]string{refusedHost: "http"}},
+			repo:       refusedHost + "/app",
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "UPSTREAM_UNAVAILABLE",
+		},
+		{
+			name:       "index host not found",
+			config:     Config{Client: noSuchHost},
+			repo:       "charts.invalid/app",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "NAME_UNKNOWN",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, tc.config)
+			err := m.prepareChart(context.Background(), tc.repo, "1.0.0")
+			if err == nil || err.Status != tc.wantStatus || err.Code != tc.wantCode {
+				t.Fatalf("got %v, want a %d %s", err, tc.wantStatus, tc.wantCode)
+			}
+		})
+	}
+
+	t.Run("chart connection refused", func(t *testing.T) {
+		m := newTestManifests(t, Config{})
+		serveCharts(t, m, nil).Close()
+		err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0")
+		if err == nil || err.Status != http.StatusBadGateway || err.Code != "UPSTREAM_UNAVAILABLE" {
+			t.Fatalf("got %v, want a 502 UPSTREAM_UNAVAILABLE", err)
+		}
+	})
+}
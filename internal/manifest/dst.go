@@ -7,6 +7,7 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"io"
+	"sort"
 	"strings"
 	"time"
 )
@@ -67,7 +68,7 @@ func (f *InternalDst) Exists(ctx context.Context, target ocispec.Descriptor) (bo
 	return false, nil
 }
 
-// Push no need lock
+// Push no need lock, it's called concurrently for the blobs of a copy
 func (f *InternalDst) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
 	h, err := v1.NewHash(expected.Digest.String())
 	if err != nil {
@@ -94,6 +95,8 @@ func (f *InternalDst) Push(ctx context.Context, expected ocispec.Descriptor, con
 				refs = append(refs, a)
 			}
 		}
+		// map order is random, the stored manifest should not be
+		sort.Strings(refs)
 
 		return f.manifests.Write(f.repo, h.String(), Manifest{
 			ContentType: expected.MediaType,
@@ -0,0 +1,138 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/repo"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileCache is a Cache persisting the parsed indexes stored in it to a directory, so they survive restarts.
+// Everything else is only kept by the wrapped cache.
+type fileCache struct {
+	Cache
+	dir string
+	log logrus.StdLogger
+}
+
+// persistedIndex is the file an index is persisted to.
+type persistedIndex struct {
+	Key string `json:"key"`
+	// zero never expires
+	Expires time.Time       `json:"expires"`
+	Index   *repo.IndexFile `json:"index"`
+}
+
+// NewFileCache wraps the cache, persisting parsed indexes to dir.
+// Persisted indexes which didn't expire yet are loaded into the cache right away, expired ones are deleted.
+func NewFileCache(dir string, cache Cache, log logrus.StdLogger) (Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &fileCache{Cache: cache, dir: dir, log: log}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *fileCache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	if k, ok := key.(string); ok {
+		if res, ok := value.(*indexCacheResp); ok && res.err == nil && res.c != nil {
+			c.save(k, res.c, ttl)
+		}
+	}
+	return c.Cache.SetWithTTL(key, value, cost, ttl)
+}
+
+func (c *fileCache) Del(key interface{}) {
+	if k, ok := key.(string); ok {
+		if err := os.Remove(c.file(k)); err != nil && !os.IsNotExist(err) {
+			c.log.Printf("removing persisted index %s: %v\n", k, err)
+		}
+	}
+	c.Cache.Del(key)
+}
+
+// save writes the index to its file, through a temporary file so a crash never leaves a partial one.
+func (c *fileCache) save(key string, index *repo.IndexFile, ttl time.Duration) {
+	p := persistedIndex{Key: key, Index: index}
+	if ttl > 0 {
+		p.Expires = time.Now().Add(ttl)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		c.log.Printf("persisting index %s: %v\n", key, err)
+		return
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		c.log.Printf("persisting index %s: %v\n", key, err)
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.file(key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		c.log.Printf("persisting index %s: %v\n", key, err)
+	}
+}
+
+// load puts the persisted indexes into the wrapped cache, with the TTL they have left.
+func (c *fileCache) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		name := filepath.Join(c.dir, e.Name())
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			// left behind by a crash while saving
+			_ = os.Remove(name)
+			continue
+		}
+		if e.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var p persistedIndex
+		if err = json.Unmarshal(data, &p); err != nil || p.Index == nil {
+			c.log.Printf("dropping unreadable persisted index %s: %v\n", name, err)
+			_ = os.Remove(name)
+			continue
+		}
+		var ttl time.Duration
+		if !p.Expires.IsZero() {
+			if ttl = p.Expires.Sub(now); ttl <= 0 {
+				_ = os.Remove(name)
+				continue
+			}
+		}
+		c.Cache.SetWithTTL(p.Key, &indexCacheResp{c: p.Index}, 1000, ttl)
+	}
+	if w, ok := c.Cache.(interface{ Wait() }); ok {
+		// ristretto applies sets asynchronously
+		w.Wait()
+	}
+	return nil
+}
+
+// file returns the path of the file the index of the key is persisted to, keys are hashed as they contain slashes.
+func (c *fileCache) file(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:])+".json")
+}
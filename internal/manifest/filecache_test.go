@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"sigs.k8s.io/yaml"
+)
+
+func TestFileCacheSurvivesRestart(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(index)
+	}))
+	host := strings.TrimPrefix(srv.URL, "http://")
+	dir := t.TempDir()
+	config := Config{UpstreamSchemes: map[string]string{host: "http"}, IndexCacheTTL: time.Hour}
+
+	start := func() *Manifests {
+		cache, err := NewFileCache(dir, newMapCache(), log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		return NewManifests(ctx, mem.NewMemHandler(), config, cache, log.New(io.Discard, "", 0))
+	}
+
+	if _, err := start().GetIndex(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	// restarted while the upstream is gone
+	srv.Close()
+	got, err := start().GetIndex(context.Background(), host)
+	if err != nil {
+		t.Fatalf("index not loaded from disk: %v", err)
+	}
+	if _, err = findVersion(got, "app", "1.0.0"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileCacheDropsExpired(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewFileCache(dir, newMapCache(), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithTTL("expiring.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Millisecond)
+	cache.SetWithTTL("lasting.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+	cache.SetWithTTL("failing.example.com", &indexCacheResp{err: fmt.Errorf("not found")}, 1, time.Hour)
+	time.Sleep(10 * time.Millisecond)
+
+	inner := newMapCache()
+	if _, err = NewFileCache(dir, inner, log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"expiring.example.com": false,
+		"lasting.example.com":  true,
+		"failing.example.com":  false,
+	} {
+		if _, ok := inner.Get(key); ok != want {
+			t.Errorf("%s loaded: got %v, want %v", key, ok, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d persisted indexes, want the lasting one only", len(entries))
+	}
+}
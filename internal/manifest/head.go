@@ -0,0 +1,89 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// knownDigest is what a HEAD request needs to know about a manifest, kept after the manifest itself expired.
+type knownDigest struct {
+	Digest      string
+	ContentType string
+	Size        int
+	RecordedAt  time.Time
+}
+
+// recordDigest remembers the digest of the manifest stored under a tag, the caller must hold the lock.
+func (m *Manifests) recordDigest(repo string, name string, ma Manifest) {
+	if name == "" || strings.HasPrefix(name, "sha256:") {
+		return
+	}
+	rd := sha256.Sum256(ma.Blob)
+	if _, ok := m.digests[repo]; !ok {
+		m.digests[repo] = map[string]knownDigest{}
+	}
+	m.digests[repo][name] = knownDigest{
+		Digest:      "sha256:" + hex.EncodeToString(rd[:]),
+		ContentType: ma.ContentType,
+		Size:        len(ma.Blob),
+		RecordedAt:  time.Now(),
+	}
+}
+
+// expireDigests drops the digests of tags which aren't cached anymore once they were recorded longer than KnownDigestTTL ago,
+// the caller must hold the lock.
+func (m *Manifests) expireDigests() {
+	for repo, tags := range m.digests {
+		for tag, d := range tags {
+			if _, cached := m.manifests[repo][tag]; !cached && time.Since(d.RecordedAt) >= m.config.KnownDigestTTL {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(m.digests, repo)
+		}
+	}
+}
+
+// forgetDigest drops the digest recorded for the tag, whose manifest is stale, the caller must hold the lock.
+func (m *Manifests) forgetDigest(repo string, name string) {
+	delete(m.digests[repo], name)
+	if len(m.digests[repo]) == 0 {
+		delete(m.digests, repo)
+	}
+}
+
+// digestTag returns a tag whose manifest had the digest, to resolve digest references of expired manifests.
+func (m *Manifests) digestTag(repo string, digest string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for tag, d := range m.digests[repo] {
+		if d.Digest == digest {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// headKnownDigest answers a HEAD request for an expired manifest from its last known digest,
+// as long as the upstream index still lists the version, so existence checks don't download and pack the chart again.
+// Requests not accepting its content type are left to the full lookup, which answers them with a 406.
+func (m *Manifests) headKnownDigest(req *http.Request, resp http.ResponseWriter, repo string, target string) bool {
+	m.lock.Lock()
+	d, ok := m.digests[repo][target]
+	m.lock.Unlock()
+	if !ok || m.isOCIUpstream(repo) || checkAccept(req, d.ContentType) != nil || !m.versionListed(req.Context(), repo, target) {
+		return false
+	}
+	resp.Header().Set("Docker-Content-Digest", d.Digest)
+	helper.SetCacheHeaders(resp, d.Digest, m.config.ResponseCacheMaxAge, false)
+	resp.Header().Set("Content-Type", d.ContentType)
+	resp.Header().Set("Content-Length", fmt.Sprint(d.Size))
+	resp.WriteHeader(http.StatusOK)
+	return true
+}
@@ -0,0 +1,155 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+)
+
+// expireManifests ages the cached manifests of the repo past CacheTTL and runs the cleanup dropping them.
+func expireManifests(t *testing.T, m *Manifests, repo string) {
+	t.Helper()
+	m.lock.Lock()
+	for name, ma := range m.manifests[repo] {
+		ma.CreatedAt = ma.CreatedAt.Add(-m.manifestCacheTTL(repo) - time.Hour)
+		m.manifests[repo][name] = ma
+	}
+	m.lock.Unlock()
+	m.cleanup(context.Background())
+	if _, ok := m.manifests[repo]; ok {
+		t.Fatalf("manifests of %s didn't expire", repo)
+	}
+}
+
+func TestHeadExpiredManifestFromKnownDigest(t *testing.T) {
+	m := newTestManifests(t, Config{CacheTTL: time.Minute, KnownDigestTTL: time.Hour})
+	// chart URLs of the test index can't be downloaded, so only known digests can answer
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+
+	for _, v := range []string{"1.0.0", "2.0.0"} {
+		if err := m.Write("charts.example.com/app", v, Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expireManifests(t, m, "charts.example.com/app")
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodHead, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("Docker-Content-Digest"), "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"; got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "2" {
+		t.Errorf("got content length %s, want 2", got)
+	}
+
+	// no longer listed upstream
+	err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/v2/charts.example.com/app/manifests/2.0.0", nil))
+	if err == nil {
+		t.Error("got known digest of a version removed upstream")
+	}
+}
+
+func TestHandleDigestReference(t *testing.T) {
+	m := newTestManifests(t, Config{CacheTTL: time.Minute, KnownDigestTTL: time.Hour})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	preparedManifest(t, m)
+	d := preparedDigest(t, m)
+
+	get := func(ref string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		return rec, m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/"+ref, nil))
+	}
+	for _, expired := range []bool{false, true} {
+		if expired {
+			expireManifests(t, m, "charts.example.com/app")
+		}
+		rec, err := get(d)
+		if err != nil {
+			t.Fatalf("expired %v: %v", expired, err)
+		}
+		if got := rec.Header().Get("Docker-Content-Digest"); got != d {
+			t.Errorf("expired %v: got digest %s, want %s", expired, got, d)
+		}
+	}
+
+	if _, err := get("sha256:" + strings.Repeat("0", 64)); err == nil || err.(*errors.RegError).Status != http.StatusNotFound {
+		t.Errorf("got error %v for an unknown digest, want 404", err)
+	}
+	if _, err := get("sha256:abc"); err == nil || err.(*errors.RegError).Status != http.StatusBadRequest {
+		t.Errorf("got error %v for an invalid digest, want 400", err)
+	}
+}
+
+func TestKnownDigestTTL(t *testing.T) {
+	m := newTestManifests(t, Config{CacheTTL: time.Minute, MaxManifests: 2, KnownDigestTTL: time.Hour})
+	write := func(tag string, created time.Time) {
+		t.Helper()
+		if err := m.Write("charts.example.com/app", tag, Manifest{ContentType: "application/json", Blob: []byte(tag), CreatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known := func(tag string) bool {
+		_, ok := m.digests["charts.example.com/app"][tag]
+		return ok
+	}
+
+	// expired and evicted manifests leave their digests
+	write("1.0.0", time.Now().Add(-time.Hour))
+	m.cleanup(context.Background())
+	write("1.0.1", time.Now().Add(-time.Second))
+	write("1.0.2", time.Now())
+	write("1.0.3", time.Now())
+	if _, ok := m.lookup("charts.example.com/app", "1.0.1"); ok {
+		t.Fatal("oldest manifest was not evicted")
+	}
+	for _, tag := range []string{"1.0.0", "1.0.1"} {
+		if !known(tag) {
+			t.Errorf("digest of %s was dropped with its manifest", tag)
+		}
+	}
+
+	// forgotten as stale
+	m.forget("charts.example.com/app", "1.0.2")
+	if known("1.0.2") {
+		t.Error("digest of a forgotten manifest was kept")
+	}
+
+	// past KnownDigestTTL, unless the manifest is still cached
+	for _, tag := range []string{"1.0.0", "1.0.3"} {
+		d := m.digests["charts.example.com/app"][tag]
+		d.RecordedAt = time.Now().Add(-2 * time.Hour)
+		m.digests["charts.example.com/app"][tag] = d
+	}
+	m.cleanup(context.Background())
+	if known("1.0.0") {
+		t.Error("digest recorded longer than KnownDigestTTL ago was kept")
+	}
+	if !known("1.0.1") || !known("1.0.3") {
+		t.Error("digest within KnownDigestTTL or of a cached manifest was dropped")
+	}
+
+	// invalidated, the chart might have been replaced
+	m.Invalidate(context.Background(), "charts.example.com", "app", "1.0.1")
+	if known("1.0.1") || !known("1.0.3") {
+		t.Error("invalidating a version didn't drop just its digest")
+	}
+	m.Invalidate(context.Background(), "charts.example.com", "", "")
+	if _, ok := m.digests["charts.example.com/app"]; ok {
+		t.Error("invalidating the repo kept digests")
+	}
+
+	// without KnownDigestTTL they go with the manifest
+	m = newTestManifests(t, Config{CacheTTL: time.Minute})
+	write("1.0.0", time.Now().Add(-time.Hour))
+	m.cleanup(context.Background())
+	if _, ok := m.digests["charts.example.com/app"]; ok {
+		t.Error("digest kept without KnownDigestTTL")
+	}
+}
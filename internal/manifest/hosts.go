@@ -0,0 +1,82 @@
+package manifest
+
+import (
+	cerrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/upstream"
+)
+
+// checkUpstreamHost refuses repos of upstream hosts which are denied or missing from the allowed hosts,
+// so the proxy can't be used to fetch from arbitrary hosts.
+func (m *Manifests) checkUpstreamHost(repo string) *errors.RegError {
+	host := strings.SplitN(repo, "/", 2)[0]
+	if paths, ok := m.virtualRepo(host); ok {
+		if strings.Count(repo, "/") > 1 {
+			// the merged index lists charts only, nested paths would be fetched from a host of that name
+			return &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    "NAME_UNKNOWN",
+				Message: fmt.Sprintf("virtual repo %s has no nested repos", host),
+			}
+		}
+		// virtual repos are allowed as long as all of their upstreams are
+		for _, p := range paths {
+			if err := m.checkUpstreamHost(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if m.upstreamHostAllowed(host) {
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusForbidden,
+		Code:    "DENIED",
+		Message: fmt.Sprintf("upstream host %s is not allowed", host),
+	}
+}
+
+// privateUpstream returns a 403 if the upstream request failed for connecting to a private address, nil otherwise.
+func privateUpstream(err error) *errors.RegError {
+	if !cerrors.Is(err, upstream.ErrPrivateAddress) {
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusForbidden,
+		Code:    "DENIED",
+		Message: err.Error(),
+	}
+}
+
+// upstreamHostAllowed matches the host against the glob patterns of the denied and allowed hosts, denied ones win.
+// Without allowed hosts configured every host not denied is allowed.
+func (m *Manifests) upstreamHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	if matchHost(m.config.DeniedUpstreamHosts, host) {
+		return false
+	}
+	return len(m.config.AllowedUpstreamHosts) == 0 || matchHost(m.config.AllowedUpstreamHosts, host)
+}
+
+// matchHost tells whether one of the patterns matches the host, with or without its port.
+func matchHost(patterns []string, host string) bool {
+	names := []string{host}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		names = append(names, hostname)
+	}
+	for _, p := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(strings.ToLower(p), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/upstream"
+)
+
+func TestUpstreamHostAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []string
+		denied  []string
+		host    string
+		want    bool
+	}{
+		{name: "default allow", host: "charts.example.com", want: true},
+		{name: "allowed", allowed: []string{"charts.example.com"}, host: "charts.example.com", want: true},
+		{name: "allowed glob", allowed: []string{"*.github.io"}, host: "example.github.io", want: true},
+		{name: "allowed with port", allowed: []string{"charts.example.com"}, host: "charts.example.com:8443", want: true},
+		{name: "not allowed", allowed: []string{"*.github.io"}, host: "charts.example.com", want: false},
+		{name: "denied", denied: []string{"169.254.*"}, host: "169.254.169.254", want: false},
+		{name: "denied case insensitive", denied: []string{"Charts.Example.com"}, host: "charts.example.COM", want: false},
+		{name: "denied wins", allowed: []string{"*.example.com"}, denied: []string{"internal.example.com"}, host: "internal.example.com", want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, Config{AllowedUpstreamHosts: tc.allowed, DeniedUpstreamHosts: tc.denied})
+			if got := m.upstreamHostAllowed(tc.host); got != tc.want {
+				t.Errorf("got allowed %v for %s, want %v", got, tc.host, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeniedUpstreamHostForbidden(t *testing.T) {
+	m := newTestManifests(t, Config{AllowedUpstreamHosts: []string{"*.github.io"}})
+
+	for _, tc := range []struct {
+		handle func(http.ResponseWriter, *http.Request) error
+		path   string
+	}{
+		{m.Handle, "/v2/charts.example.com/app/manifests/1.0.0"},
+		{m.HandleTags, "/v2/charts.example.com/app/tags/list"},
+		{m.HandleCatalog, "/charts.example.com/v2/_catalog"},
+		{m.HandleIndex, "/charts.example.com/index.yaml"},
+	} {
+		err := tc.handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusForbidden {
+			t.Errorf("%s: got error %v, want 403", tc.path, err)
+		}
+	}
+}
+
+func TestPrivateUpstreamForbidden(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("apiVersion: v1\n"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{
+		Client:          upstream.NewClient(upstream.Config{}),
+		UpstreamSchemes: map[string]string{host: "http"},
+		MaxRetries:      2,
+	})
+
+	err := m.prepareChart(context.Background(), host+"/app", "1.0.0")
+	if err == nil || err.Status != http.StatusForbidden {
+		t.Errorf("got error %v, want 403", err)
+	}
+}
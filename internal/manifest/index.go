@@ -0,0 +1,192 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"helm.sh/helm/v3/pkg/repo"
+	"io"
+	"net/http"
+	"path"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// HandleIndex serves the cached index of a chart repository at /<repo-path>/index.yaml,
+// so the proxy can act as a plain Helm repository mirror.
+func (m *Manifests) HandleIndex(resp http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+	repoPath := m.expandAlias(strings.TrimSuffix(strings.Trim(req.URL.Path, "/"), "/index.yaml"))
+	if err := m.checkUpstreamHost(repoPath); err != nil {
+		return err
+	}
+
+	index, err := m.GetIndex(req.Context(), repoPath)
+	if err != nil {
+		if regErr := failedDownload(err); regErr != nil {
+			return regErr
+		}
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("index file fetch error: %s", repoPath),
+		}
+	}
+	if m.config.HelmHTTP {
+		index = proxiedIndex(index)
+	}
+	msg, err := yaml.Marshal(index)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Header().Set("Content-Length", fmt.Sprint(len(msg)))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.Copy(resp, bytes.NewReader(msg))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
+
+// proxiedIndex returns a copy of the index listing the chart archives served by HandleArchive next to it,
+// so classic Helm clients download them through the proxy too.
+func proxiedIndex(index *repo.IndexFile) *repo.IndexFile {
+	res := *index
+	res.Entries = make(map[string]repo.ChartVersions, len(index.Entries))
+	for name, versions := range index.Entries {
+		for _, v := range versions {
+			cv := *v
+			cv.URLs = []string{archiveName(v)}
+			res.Entries[name] = append(res.Entries[name], &cv)
+		}
+	}
+	return &res
+}
+
+// archiveName is the file name the chart version is served at by HandleArchive.
+func archiveName(v *repo.ChartVersion) string {
+	return fmt.Sprintf("%s-%s.tgz", v.Name, v.Version)
+}
+
+// HandleArchive serves the archive of a chart version at /<repo-path>/<chart>-<version>.tgz,
+// so the proxy can act as a classic Helm repository along the OCI endpoints.
+func (m *Manifests) HandleArchive(resp http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+	repoPath, file := path.Split(strings.Trim(req.URL.Path, "/"))
+	repoPath = m.expandAlias(strings.TrimSuffix(repoPath, "/"))
+	if err := m.checkUpstreamHost(repoPath); err != nil {
+		return err
+	}
+
+	index, err := m.GetIndex(req.Context(), repoPath)
+	if err != nil {
+		if regErr := failedDownload(err); regErr != nil {
+			return regErr
+		}
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("index file fetch error: %s", repoPath),
+		}
+	}
+	var chartVer *repo.ChartVersion
+	for _, versions := range index.Entries {
+		for _, v := range versions {
+			if archiveName(v) == file {
+				chartVer = v
+			}
+		}
+	}
+	if chartVer == nil {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NOT FOUND",
+			Message: fmt.Sprintf("Chart archive: %s not found in %s", file, repoPath),
+		}
+	}
+
+	data, _, _, regErr := m.downloadChart(req.Context(), repoPath, chartVer)
+	if regErr != nil {
+		return regErr
+	}
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err = io.Copy(resp, bytes.NewReader(data))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
+
+// debugIndexPath is the path prefix of HandleDebugIndex, followed by the repo path.
+const debugIndexPath = "/debug/index/"
+
+// HandleDebugIndex lists the chart versions of the parsed index of the repo at /debug/index/<repo-path>, as JSON.
+// It shows what the proxy made of the upstream index, e.g. which versions were dropped as invalid.
+func (m *Manifests) HandleDebugIndex(resp http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+	repoPath := m.expandAlias(strings.Trim(strings.TrimPrefix(req.URL.Path, debugIndexPath), "/"))
+	if err := m.checkUpstreamHost(repoPath); err != nil {
+		return err
+	}
+
+	index, err := m.GetIndex(req.Context(), repoPath)
+	if err != nil {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("index file fetch error: %s: %v", repoPath, err),
+		}
+	}
+	res := struct {
+		Repo       string              `json:"repo"`
+		APIVersion string              `json:"apiVersion"`
+		Entries    map[string][]string `json:"entries"`
+	}{
+		Repo:       repoPath,
+		APIVersion: index.APIVersion,
+		Entries:    map[string][]string{},
+	}
+	for name, versions := range index.Entries {
+		res.Entries[name] = []string{}
+		for _, v := range versions {
+			res.Entries[name] = append(res.Entries[name], v.Version)
+		}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(resp).Encode(res); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"helm.sh/helm/v3/pkg/repo"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sigs.k8s.io/yaml"
+	"testing"
+	"time"
+)
+
+func TestHandleIndex(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	m.cache.SetWithTTL("charts.example.com/stable", &indexCacheResp{c: testIndex("app", "1.0.0", "2.0.0")}, 1, time.Hour)
+
+	rec := httptest.NewRecorder()
+	if err := m.HandleIndex(rec, httptest.NewRequest(http.MethodGet, "/charts.example.com/stable/index.yaml", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var index repo.IndexFile
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(index.Entries["app"]); got != 2 {
+		t.Errorf("got %d versions of app, want 2", got)
+	}
+
+	err := m.HandleIndex(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown.example.com/index.yaml", nil))
+	if err == nil {
+		t.Error("got an index for an unknown repo")
+	}
+}
+
+func TestHandleHelmHTTP(t *testing.T) {
+	m := newTestManifests(t, Config{HelmHTTP: true})
+	archive := testChart(t, testChartYAML, nil)
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": archive})
+
+	// like helm repo add and helm pull, the chart URL is resolved against the index URL
+	indexURL, _ := url.Parse("http://proxy.example.com/charts.example.com/index.yaml")
+	rec := httptest.NewRecorder()
+	if err := m.HandleIndex(rec, httptest.NewRequest(http.MethodGet, indexURL.String(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	var index repo.IndexFile
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	versions := index.Entries["app"]
+	if len(versions) != 1 || len(versions[0].URLs) != 1 {
+		t.Fatalf("got versions %v of app, want 1.0.0 with one URL", versions)
+	}
+	chartURL, err := indexURL.Parse(versions[0].URLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chartURL.Host != indexURL.Host {
+		t.Errorf("chart URL %s doesn't point to the proxy", chartURL)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := m.HandleArchive(rec, httptest.NewRequest(http.MethodGet, chartURL.String(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), archive) {
+		t.Error("got a different chart archive than the upstream one")
+	}
+
+	cached, _ := m.cache.Get("charts.example.com")
+	if cached.(*indexCacheResp).c.Entries["app"][0].URLs[0] == versions[0].URLs[0] {
+		t.Error("the cached index got rewritten")
+	}
+
+	err = m.HandleArchive(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/charts.example.com/app-2.0.0.tgz", nil))
+	if err == nil || err.(*errors.RegError).Status != http.StatusNotFound {
+		t.Errorf("got %v for an unknown version, want a 404", err)
+	}
+}
+
+func TestHandleDebugIndex(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	index := testIndex("app", "1.0.0", "2.0.0")
+	index.Entries["other"] = testIndex("other", "0.1.0").Entries["other"]
+	m.cache.SetWithTTL("charts.example.com/stable", &indexCacheResp{c: index}, 1, time.Hour)
+
+	rec := httptest.NewRecorder()
+	if err := m.HandleDebugIndex(rec, httptest.NewRequest(http.MethodGet, "/debug/index/charts.example.com/stable", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Repo    string              `json:"repo"`
+		Entries map[string][]string `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Repo != "charts.example.com/stable" {
+		t.Errorf("got repo %q", res.Repo)
+	}
+	if got := res.Entries["app"]; len(got) != 2 || got[0] != "2.0.0" || got[1] != "1.0.0" {
+		t.Errorf("got app versions %v, want [2.0.0 1.0.0]", got)
+	}
+	if got := res.Entries["other"]; len(got) != 1 || got[0] != "0.1.0" {
+		t.Errorf("got other versions %v, want [0.1.0]", got)
+	}
+}
@@ -0,0 +1,124 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/metrics"
+	"net/http"
+	"strings"
+)
+
+// Invalidate drops the cached index of the repo and the manifests cached for its charts, with their blobs no other
+// cached manifest references, so the next pull fetches them from the upstream again.
+// With a chart only its manifests are dropped, with a version too only the manifest of that version.
+// It returns how many manifests, counting tags and digests, were dropped.
+func (m *Manifests) Invalidate(ctx context.Context, repoPath string, chart string, version string) int {
+	repoPath = strings.Trim(m.expandAlias(repoPath), "/")
+
+	keys := []string{
+		repoPath,
+		lastIndexKeyPrefix + repoPath,
+		m.upstreamURL(repoPath, "index.yaml"),
+		m.upstreamURL(repoPath, "index.json"),
+	}
+	if prev := m.lastIndex(repoPath); prev != nil {
+		keys = append(keys, prev.url)
+	}
+	for _, key := range keys {
+		m.cache.Del(key)
+	}
+
+	inScope := func(repo string) bool {
+		return chart != "" && repo == repoPath+"/"+chart || chart == "" && strings.HasPrefix(repo, repoPath+"/")
+	}
+
+	m.lock.Lock()
+	var dropped int
+	var refs []string
+	for repo, mRepo := range m.manifests {
+		if !inScope(repo) {
+			continue
+		}
+		var match *Manifest
+		if version != "" {
+			ma, ok := mRepo[chartTag(version)]
+			if !ok {
+				continue
+			}
+			match = &ma
+		}
+		for name, v := range mRepo {
+			// the tag and digest of a manifest are written together
+			if match != nil && !(v.CreatedAt.Equal(match.CreatedAt) && bytes.Equal(v.Blob, match.Blob)) {
+				continue
+			}
+			delete(mRepo, name)
+			m.unpersist(repo, name)
+			refs = append(refs, v.Refs...)
+			dropped++
+		}
+		if len(mRepo) == 0 {
+			delete(m.manifests, repo)
+			delete(m.accessed, repo)
+		}
+	}
+	// known digests of expired manifests go too, the chart might have been replaced
+	for repo := range m.digests {
+		if !inScope(repo) {
+			continue
+		}
+		if version != "" {
+			m.forgetDigest(repo, chartTag(version))
+		} else {
+			delete(m.digests, repo)
+		}
+	}
+	metrics.CachedManifests.Set(float64(m.countManifests()))
+	refs = m.unreferenced(refs)
+	m.lock.Unlock()
+
+	// unlike expired ones, invalidated blobs aren't retained for BlobCacheTTL, the chart might have been replaced
+	m.deleteBlobs(ctx, refs)
+	return dropped
+}
+
+// HandleInvalidate serves Invalidate for POST requests, taking the repo, chart and version from the query or form.
+func (m *Manifests) HandleInvalidate(resp http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return &errors.RegError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    "UNSUPPORTED",
+			Message: "invalidate with POST",
+			Header:  http.Header{"Allow": {http.MethodPost}},
+		}
+	}
+	repoPath, chart, version := req.FormValue("repo"), req.FormValue("chart"), req.FormValue("version")
+	if strings.Trim(repoPath, "/") == "" || version != "" && chart == "" {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "BAD_REQUEST",
+			Message: "expected a repo, optionally a chart and a version of it",
+		}
+	}
+	if err := m.checkUpstreamHost(m.expandAlias(strings.Trim(repoPath, "/"))); err != nil {
+		return err
+	}
+	dropped := m.Invalidate(req.Context(), repoPath, chart, version)
+	m.log.Printf("invalidated %s, chart %q version %q: %d manifests dropped\n", repoPath, chart, version, dropped)
+
+	res := struct {
+		Repo      string `json:"repo"`
+		Chart     string `json:"chart,omitempty"`
+		Version   string `json:"version,omitempty"`
+		Manifests int    `json:"manifests"`
+	}{Repo: repoPath, Chart: chart, Version: version, Manifests: dropped}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(resp).Encode(res); err != nil {
+		return errors.RegErrInternal(fmt.Errorf("writing invalidation result: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"sigs.k8s.io/yaml"
+)
+
+func TestInvalidateDownloadsAgain(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := testChart(t, testChartYAML, nil)
+	var indexDownloads, chartDownloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			atomic.AddInt32(&indexDownloads, 1)
+			_, _ = w.Write(index)
+		case "/app-1.0.0.tgz":
+			atomic.AddInt32(&chartDownloads, 1)
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{UpstreamSchemes: map[string]string{host: "http"}, IndexCacheTTL: time.Hour})
+
+	pull := func() {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/"+host+"/app/manifests/1.0.0", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pull()
+	pull()
+	if indexDownloads != 1 || chartDownloads != 1 {
+		t.Fatalf("got %d index and %d chart downloads before invalidating, want 1 each", indexDownloads, chartDownloads)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/invalidate?repo="+host+"&chart=app&version=1.0.0", nil)
+	if err := m.HandleInvalidate(rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec.Body.String(), `"manifests":2`) {
+		t.Errorf("got %s, want the tag and digest of the manifest dropped", rec.Body.String())
+	}
+	if _, ok := m.lookup(host+"/app", "1.0.0"); ok {
+		t.Error("manifest still cached")
+	}
+
+	pull()
+	if indexDownloads != 2 || chartDownloads != 2 {
+		t.Errorf("got %d index and %d chart downloads after invalidating, want 2 each", indexDownloads, chartDownloads)
+	}
+}
+
+func TestInvalidateScope(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	ma := Manifest{Blob: []byte("{}"), CreatedAt: time.Now()}
+	for _, ref := range []string{
+		"charts.example.com/app:1.0.0",
+		"charts.example.com/app:2.0.0",
+		"charts.example.com/other:1.0.0",
+		"charts.example.com/stable/app:1.0.0",
+		"other.example.com/app:1.0.0",
+	} {
+		repo, tag, _ := strings.Cut(ref, ":")
+		// distinct creation times, so the versions aren't taken for names of the same manifest
+		ma.CreatedAt = ma.CreatedAt.Add(time.Second)
+		if err := m.Write(repo, tag, ma); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := m.Invalidate(context.Background(), "charts.example.com", "app", "1.0.0"); n != 1 {
+		t.Errorf("version: got %d manifests dropped, want 1", n)
+	}
+	if _, ok := m.lookup("charts.example.com/app", "2.0.0"); !ok {
+		t.Error("version: other version dropped")
+	}
+	if n := m.Invalidate(context.Background(), "charts.example.com", "", ""); n != 3 {
+		t.Errorf("repo: got %d manifests dropped, want the remaining 3 below the repo", n)
+	}
+	if _, ok := m.lookup("other.example.com/app", "1.0.0"); !ok {
+		t.Error("repo: manifest of another upstream dropped")
+	}
+}
+
+func TestHandleInvalidateBadRequest(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	for _, target := range []string{
+		"/admin/invalidate",
+		"/admin/invalidate?repo=charts.example.com&version=1.0.0",
+	} {
+		err := m.HandleInvalidate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, target, nil))
+		if err == nil || err.(*errors.RegError).Status != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want status %d", target, err, http.StatusBadRequest)
+		}
+	}
+	err := m.HandleInvalidate(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/invalidate?repo=charts.example.com", nil))
+	if err == nil || err.(*errors.RegError).Status != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %v, want status %d", err, http.StatusMethodNotAllowed)
+	}
+}
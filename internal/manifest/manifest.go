@@ -9,10 +9,15 @@ import (
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/metrics"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/parent"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 	"io"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -38,22 +43,65 @@ type Manifest struct {
 
 type Manifests struct {
 	// maps repo -> Manifest tag/digest -> Manifest
-	manifests   map[string]map[string]Manifest
+	manifests map[string]map[string]Manifest
+	// maps repo -> last access, to evict least recently used repos
+	accessed map[string]time.Time
+	// maps repo -> tag -> last known digest, outlives the manifests by up to KnownDigestTTL to answer HEAD requests cheaply
+	digests map[string]map[string]knownDigest
+	// digests of blobs whose manifests expired, kept until they are older than BlobCacheTTL
+	retained    map[string]struct{}
 	lock        sync.Mutex
 	log         logrus.StdLogger
 	cache       Cache
 	blobHandler handler.BlobHandler
 	config      Config
+	parent      *parent.Registry
+	client      *http.Client
+	// deduplicates concurrent preparations and index downloads
+	prepares singleflight.Group
+	indexes  singleflight.Group
+	// changes waiting to be persisted, nil without a ManifestStore
+	storeOps chan storeOp
+	// closed once runStore stopped taking changes off storeOps
+	storeStopped chan struct{}
+	// slots of the upstream downloads running at once, nil without MaxConcurrentDownloads
+	downloads chan struct{}
+	// slots of the index downloads running at once, nil without MaxConcurrentIndexDownloads
+	indexDownloads chan struct{}
 }
 
 func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config Config, cache Cache, log logrus.StdLogger) *Manifests {
 	ma := &Manifests{
 
 		manifests:   map[string]map[string]Manifest{},
+		accessed:    map[string]time.Time{},
+		digests:     map[string]map[string]knownDigest{},
+		retained:    map[string]struct{}{},
 		blobHandler: blobHandler,
 		log:         log,
 		config:      config,
 		cache:       cache,
+		client:      config.Client,
+	}
+	if ma.client == nil {
+		ma.client = http.DefaultClient
+	}
+	if config.ParentRegistry != "" {
+		ma.parent = parent.New(config.ParentRegistry, ma.client)
+	}
+	if config.MaxConcurrentDownloads > 0 {
+		ma.downloads = make(chan struct{}, config.MaxConcurrentDownloads)
+	}
+	if config.MaxConcurrentIndexDownloads > 0 {
+		ma.indexDownloads = make(chan struct{}, config.MaxConcurrentIndexDownloads)
+	}
+	if config.Store != nil {
+		ma.storeOps = make(chan storeOp, storeQueueSize)
+		ma.storeStopped = make(chan struct{})
+		if err := ma.loadStore(ctx); err != nil {
+			ma.log.Printf("loading persisted manifests: %v\n", err)
+		}
+		go ma.runStore(ctx)
 	}
 
 	go func() {
@@ -65,30 +113,7 @@ func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config C
 				if ma.config.Debug {
 					ma.log.Println("cleanup cycle")
 				}
-				ma.lock.Lock()
-				for _, m := range ma.manifests {
-					for k, v := range m {
-						if v.CreatedAt.Before(time.Now().Add(-ma.config.CacheTTL)) {
-							// delete
-							delete(m, k)
-							if delHandler, ok := ma.blobHandler.(handler.BlobDeleteHandler); ok {
-								for _, ref := range v.Refs {
-									h, err := v1.NewHash(ref)
-									if err != nil {
-										continue
-									}
-									if ma.config.Debug {
-										log.Printf("deleting blob %s", h.String())
-									}
-									if err = delHandler.Delete(ctx, "", h); err != nil {
-										log.Println(err)
-									}
-								}
-							}
-						}
-					}
-				}
-				ma.lock.Unlock()
+				ma.cleanup(ctx)
 			case <-ctx.Done():
 				return
 			}
@@ -98,6 +123,30 @@ func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config C
 	return ma
 }
 
+// cleanup drops expired manifests and blobs.
+func (m *Manifests) cleanup(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for repo, mRepo := range m.manifests {
+		ttl := m.manifestCacheTTL(repo)
+		for k, v := range mRepo {
+			if v.CreatedAt.Before(time.Now().Add(-ttl)) {
+				// delete
+				delete(mRepo, k)
+				m.unpersist(repo, k)
+				m.releaseBlobs(ctx, v.Refs)
+			}
+		}
+		if len(mRepo) == 0 {
+			delete(m.manifests, repo)
+			delete(m.accessed, repo)
+		}
+	}
+	metrics.CachedManifests.Set(float64(m.countManifests()))
+	m.expireDigests()
+	m.expireBlobs(ctx)
+}
+
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pulling-an-image-manifest
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pushing-an-image
 func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
@@ -113,108 +162,115 @@ func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
 
 	elem = elem[1:]
 	target := elem[len(elem)-1]
-	if target != "" && strings.HasPrefix(target, "v") {
-		target = target[1:]
+
+	name, regErr := repoFromPath(req.URL.Path)
+	if regErr != nil {
+		return regErr
+	}
+	repo := m.expandAlias(name)
+	if err := m.checkUpstreamHost(repo); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(target, "sha256:") && !m.isOCIUpstream(repo) {
+		// OCI upstreams are asked for the tag as it is, they tag as they like
+		target = chartTag(target)
 	}
 
-	var repoParts []string
-	for i := len(elem) - 3; i > 0; i-- {
-		if elem[i] == "v2" {
-			//enough
-			break
+	if target == "" && !m.config.VersionIndex && m.config.RequireExplicitVersion {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "TAG_INVALID",
+			Message: fmt.Sprintf("Chart: %s requires an explicit version", repo),
 		}
-		repoParts = append(repoParts, elem[i])
 	}
-	sort.SliceStable(repoParts, func(i, j int) bool {
-		//reverse
-		return i > j
-	})
-	repo := strings.Join(repoParts, "/")
 
 	switch req.Method {
-	case http.MethodGet:
-		m.lock.Lock()
-		defer m.lock.Unlock()
-
-		var prepared bool
+	case http.MethodGet, http.MethodHead:
+		body := req.Method == http.MethodGet
+		m.touch(repo)
+		write := func(ma Manifest) error {
+			if err := checkAccept(req, ma.ContentType); err != nil {
+				return err
+			}
+			helper.SetCacheHeaders(resp, manifestDigest(ma), m.config.ResponseCacheMaxAge, strings.HasPrefix(target, "sha256:"))
+			return writeManifest(resp, ma, body)
+		}
 
-		c, ok := m.manifests[repo]
-		if !ok {
-			err := m.prepareChart(req.Context(), repo, target)
+		if target == "" && m.config.VersionIndex {
+			ma, err := m.versionIndex(req.Context(), repo)
 			if err != nil {
 				return err
 			}
-			prepared = true
-			// re-find
-			c = m.manifests[repo]
+			return write(ma)
 		}
-
-		ma, ok := c[target]
-		if !ok {
-			if !prepared {
-				err := m.prepareChart(req.Context(), repo, target)
-				if err != nil {
-					return err
-				}
+		if target == LatestTag && !m.isOCIUpstream(repo) {
+			// served as the concrete version, whose manifest is annotated with it
+			tag, err := m.resolveLatest(req.Context(), repo)
+			if err != nil {
+				return err
 			}
+			target = tag
+		}
 
-			ma, ok = c[target]
-			if !ok {
-				// we failed
+		ma, ok := m.lookup(repo, target)
+		if !ok && referrersTagPattern.MatchString(target) {
+			// fallback tag schema, such tags never name a chart version
+			descs := m.referrers(repo, strings.Replace(target, "-", ":", 1), "")
+			if len(descs) == 0 {
 				return &errors.RegError{
 					Status:  http.StatusNotFound,
-					Code:    "NOT FOUND",
-					Message: fmt.Sprintf("Chart prepare's result not found: %v, %v", repo, target),
+					Code:    "MANIFEST_UNKNOWN",
+					Message: fmt.Sprintf("no referrers of %s in %s", target, repo),
 				}
 			}
-		}
-		rd := sha256.Sum256(ma.Blob)
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		resp.Header().Set("Docker-Content-Digest", d)
-		resp.Header().Set("Content-Type", ma.ContentType)
-		resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
-		resp.WriteHeader(http.StatusOK)
-		_, err := io.Copy(resp, bytes.NewReader(ma.Blob))
-		if err != nil {
-			return errors.RegErrInternal(err)
-		}
-		return nil
-
-	case http.MethodHead:
-		m.lock.Lock()
-		defer m.lock.Unlock()
-		if _, ok := m.manifests[repo]; !ok {
-
-			err := m.prepareChart(req.Context(), repo, target)
+			ma, err := referrersIndex(descs)
 			if err != nil {
-				return err
+				return errors.RegErrInternal(err)
+			}
+			return write(ma)
+		}
+		if !ok && strings.HasPrefix(target, "sha256:") {
+			if _, err := v1.NewHash(target); err != nil {
+				return &errors.RegError{
+					Status:  http.StatusBadRequest,
+					Code:    "DIGEST_INVALID",
+					Message: fmt.Sprintf("invalid digest %s: %v", target, err),
+				}
+			}
+			// the manifest expired, pack it again from the version it was tagged with
+			if tag, known := m.digestTag(repo, target); known {
+				if err := m.prepare(req.Context(), repo, tag); err != nil {
+					return err
+				}
+				ma, ok = m.lookup(repo, target)
 			}
 		}
-		ma, ok := m.manifests[repo][target]
 		if !ok {
-			err := m.prepareChart(req.Context(), repo, target)
-			if err != nil {
+			if !body && m.headKnownDigest(req, resp, repo, target) {
+				return nil
+			}
+			if err := m.prepare(req.Context(), repo, target); err != nil {
 				return err
 			}
-			ma, ok = m.manifests[repo][target]
-			if !ok {
+			if ma, ok = m.lookup(repo, target); !ok {
 				// we failed
 				return &errors.RegError{
 					Status:  http.StatusNotFound,
 					Code:    "NOT FOUND",
-					Message: "Chart prepare error",
+					Message: fmt.Sprintf("Chart prepare's result not found: %v, %v", repo, target),
 				}
 			}
 		}
-		rd := sha256.Sum256(ma.Blob)
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		resp.Header().Set("Docker-Content-Digest", d)
-		resp.Header().Set("Content-Type", ma.ContentType)
-		resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
-		resp.WriteHeader(http.StatusOK)
-		return nil
+		ma, err := m.revalidate(req.Context(), repo, target, ma)
+		if err != nil {
+			return err
+		}
+		return write(ma)
 
 	default:
+		if errors.IsWrite(req.Method) {
+			return errors.RegErrReadOnly
+		}
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
 			Code:    "METHOD_UNKNOWN",
@@ -223,6 +279,37 @@ func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
 	}
 }
 
+// touch records an access to the repo if it's cached.
+func (m *Manifests) touch(repo string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.manifests[repo]; ok {
+		m.accessed[repo] = time.Now()
+	}
+}
+
+// manifestDigest returns the digest of the manifest's content.
+func manifestDigest(ma Manifest) string {
+	rd := sha256.Sum256(ma.Blob)
+	return "sha256:" + hex.EncodeToString(rd[:])
+}
+
+// writeManifest writes the manifest headers and, unless it's a HEAD request, its content.
+func writeManifest(resp http.ResponseWriter, ma Manifest, body bool) error {
+	resp.Header().Set("Docker-Content-Digest", manifestDigest(ma))
+	resp.Header().Set("Content-Type", ma.ContentType)
+	resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
+	resp.WriteHeader(http.StatusOK)
+	if !body {
+		return nil
+	}
+	_, err := io.Copy(resp, bytes.NewReader(ma.Blob))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
+
 func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) error {
 	elem := strings.Split(req.URL.Path, "/")
 	if len(elem) < 4 {
@@ -232,19 +319,14 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 			Message: "No chart name specified",
 		}
 	}
-	var repoParts []string
-	for i := len(elem) - 3; i > 0; i-- {
-		if elem[i] == "v2" {
-			//stop
-			break
-		}
-		repoParts = append(repoParts, elem[i])
+	name, regErr := repoFromPath(req.URL.Path)
+	if regErr != nil {
+		return regErr
+	}
+	fullRepo := m.expandAlias(name)
+	if err := m.checkUpstreamHost(fullRepo); err != nil {
+		return err
 	}
-	sort.SliceStable(repoParts, func(i, j int) bool {
-		//reverse
-		return i > j
-	})
-	fullRepo := strings.Join(repoParts, "/")
 
 	if req.Method != "GET" {
 		return &errors.RegError{
@@ -253,33 +335,57 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 			Message: "We don't understand your method + url",
 		}
 	}
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	m.touch(fullRepo)
 
-	c, ok := m.manifests[fullRepo]
-	if !ok {
-		err := m.prepareChart(req.Context(), fullRepo, "")
-		if err != nil {
-			return err
-		}
-		c, _ = m.manifests[fullRepo]
-	}
-
-	repoPath := strings.Join(repoParts[:len(repoParts)-1], "/")
-	var tags []string
-
-	index, _ := m.GetIndex(repoPath)
+	// an empty list rather than null, for a chart without versions
+	tags := []string{}
 
-	if index != nil {
-		if versions, ok := index.Entries[repoParts[len(repoParts)-1]]; ok {
-			for _, v := range versions {
-				tags = append(tags, strings.TrimLeft(v.Version, "v"))
+	if m.isOCIUpstream(fullRepo) {
+		var err error
+		tags, err = m.ociTags(req.Context(), fullRepo)
+		if err != nil {
+			return &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    "NAME_UNKNOWN",
+				Message: fmt.Sprintf("tags of %s not listed: %v", fullRepo, err),
 			}
 		}
 	} else {
-		for tag := range c {
-			if !strings.Contains(tag, "sha256:") {
-				tags = append(tags, tag)
+		repoPath, chart := "", fullRepo
+		if sep := strings.LastIndex(fullRepo, "/"); sep >= 0 {
+			repoPath, chart = fullRepo[:sep], fullRepo[sep+1:]
+		}
+
+		index, err := m.GetIndex(req.Context(), repoPath)
+		if err != nil {
+			if regErr := refusedDownload(err); regErr != nil {
+				return regErr
+			}
+			// keep listing what's cached while the upstream is down
+			cached, ok := m.cachedTags(fullRepo)
+			if !ok {
+				if regErr := unreachableUpstream(err); regErr != nil {
+					return regErr
+				}
+				return &errors.RegError{
+					Status:  http.StatusNotFound,
+					Code:    "NAME_UNKNOWN",
+					Message: fmt.Sprintf("index file fetch error: %s", repoPath),
+				}
+			}
+			tags = append(tags, cached...)
+		} else {
+			// a chart listed without versions has no tags, one not listed at all is unknown
+			versions, ok := index.Entries[chart]
+			if !ok {
+				return &errors.RegError{
+					Status:  http.StatusNotFound,
+					Code:    "NAME_UNKNOWN",
+					Message: fmt.Sprintf("Chart: %s not found in %s", chart, repoPath),
+				}
+			}
+			for _, v := range versions {
+				tags = append(tags, m.listedTag(v.Version))
 			}
 		}
 	}
@@ -288,29 +394,18 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 	// https://github.com/opencontainers/distribution-spec/blob/b505e9cc53ec499edbd9c1be32298388921bb705/detail.md#tags-paginated
 	// Offset using last query parameter.
 	if last := req.URL.Query().Get("last"); last != "" {
-		for i, t := range tags {
-			if t > last {
-				tags = tags[i:]
-				break
-			}
-		}
+		tags = tags[sort.Search(len(tags), func(i int) bool { return tags[i] > last }):]
 	}
 
-	// Limit using n query parameter.
-	if ns := req.URL.Query().Get("n"); ns != "" {
-		if n, err := strconv.Atoi(ns); err != nil {
-			return &errors.RegError{
-				Status:  http.StatusBadRequest,
-				Code:    "BAD_REQUEST",
-				Message: fmt.Sprintf("parsing n: %v", err),
-			}
-		} else if n < len(tags) {
-			tags = tags[:n]
-		}
+	// Limit using n query parameter, linking the next page if there is one.
+	n, regErr := m.pageSize(req.URL.Query(), -1)
+	if regErr != nil {
+		return regErr
 	}
+	tags = page(resp, req, tags, n)
 
 	tagsToList := listTags{
-		Name: fullRepo,
+		Name: name,
 		Tags: tags,
 	}
 
@@ -324,7 +419,40 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 	return nil
 }
 
+// cachedTags returns the tags cached for the repo, and whether the repo is cached at all.
+func (m *Manifests) cachedTags(repo string) ([]string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.manifests[repo]
+	var tags []string
+	for tag := range c {
+		if !strings.Contains(tag, "sha256:") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, ok
+}
+
+// lookup returns the cached manifest of the repo by tag or digest.
+func (m *Manifests) lookup(repo string, name string) (Manifest, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ma, ok := m.manifests[repo][name]
+	return ma, ok
+}
+
+// forget drops the tag of the repo from the cache.
+func (m *Manifests) forget(repo string, name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.manifests[repo], name)
+	m.forgetDigest(repo, name)
+	m.unpersist(repo, name)
+}
+
 func (m *Manifests) Read(repo string, name string) (Manifest, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	mRepo, ok := m.manifests[repo]
 	if !ok {
@@ -338,26 +466,227 @@ func (m *Manifests) Read(repo string, name string) (Manifest, error) {
 }
 
 func (m *Manifests) Write(repo string, name string, n Manifest) error {
-
+	m.lock.Lock()
 	mRepo, ok := m.manifests[repo]
 	if !ok {
 		mRepo = map[string]Manifest{}
 		m.manifests[repo] = mRepo
+		m.accessed[repo] = time.Now()
 	}
 	mRepo[name] = n
+	var refs []string
+	if !ok {
+		// once the manifest is in, so blobs it shares with evicted repos are kept
+		refs = m.evictRepos(repo)
+	}
+	if m.config.VersionIndex {
+		// lists the cached versions, which just changed
+		m.cache.Del(versionIndexKey(repo))
+	}
+	m.recordDigest(repo, name, n)
+	m.persist(repo, name, n)
+	refs = m.unreferenced(append(refs, m.evictManifests(repo, name)...))
+	metrics.CachedManifests.Set(float64(m.countManifests()))
+	m.lock.Unlock()
+
+	// blob handlers may be remote, deleting doesn't hold up other writes
+	m.deleteBlobs(context.Background(), refs)
 	return nil
 }
 
-func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) error {
-	query := req.URL.Query()
-	nStr := query.Get("n")
-	n := 10000
-	if nStr != "" {
-		var err error
-		n, err = strconv.Atoi(nStr)
+// countManifests returns the number of cached manifests, the caller must hold the lock.
+func (m *Manifests) countManifests() int {
+	var n int
+	for _, mRepo := range m.manifests {
+		n += len(mRepo)
+	}
+	return n
+}
+
+// evictManifests drops the manifests created first while more than MaxManifests are cached, except the one just written.
+// All names of an evicted manifest go together. It returns the refs of the evicted manifests,
+// whose blobs the caller deletes if no other cached manifest references them.
+func (m *Manifests) evictManifests(keepRepo string, keepName string) []string {
+	count := m.countManifests()
+	if m.config.MaxManifests <= 0 || count <= m.config.MaxManifests {
+		return nil
+	}
+	type candidate struct {
+		repo, name string
+		ma         Manifest
+	}
+	var candidates []candidate
+	for repo, mRepo := range m.manifests {
+		for name, v := range mRepo {
+			if repo != keepRepo || name != keepName {
+				candidates = append(candidates, candidate{repo: repo, name: name, ma: v})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ma.CreatedAt.Before(candidates[j].ma.CreatedAt)
+	})
+
+	var refs []string
+	for _, oldest := range candidates {
+		if count <= m.config.MaxManifests {
+			break
+		}
+		mRepo := m.manifests[oldest.repo]
+		if _, ok := mRepo[oldest.name]; !ok {
+			// evicted together with another name of its manifest
+			continue
+		}
+		if m.config.Debug {
+			m.log.Printf("evicting manifest %s:%s\n", oldest.repo, oldest.name)
+		}
+		for name, v := range mRepo {
+			// the tag and digest of a manifest are written together
+			if (name == oldest.name || v.CreatedAt.Equal(oldest.ma.CreatedAt) && bytes.Equal(v.Blob, oldest.ma.Blob)) &&
+				!(oldest.repo == keepRepo && name == keepName) {
+				delete(mRepo, name)
+				m.unpersist(oldest.repo, name)
+				metrics.ManifestEvictions.WithLabelValues("manifests").Inc()
+				count--
+			}
+		}
+		if len(mRepo) == 0 {
+			delete(m.manifests, oldest.repo)
+			delete(m.accessed, oldest.repo)
+		}
+		refs = append(refs, oldest.ma.Refs...)
+	}
+	return refs
+}
+
+// unreferenced returns the refs which no cached manifest references, the caller must hold the lock.
+func (m *Manifests) unreferenced(refs []string) []string {
+	if len(refs) == 0 {
+		return nil
+	}
+	live := map[string]struct{}{}
+	for _, mRepo := range m.manifests {
+		for _, v := range mRepo {
+			for _, ref := range v.Refs {
+				live[ref] = struct{}{}
+			}
+		}
+	}
+	var res []string
+	for _, ref := range refs {
+		if _, ok := live[ref]; !ok {
+			res = append(res, ref)
+		}
+	}
+	return res
+}
+
+// evictRepos drops the least recently used repos while more than MaxRepos are cached.
+// It returns the refs of their manifests, whose blobs the caller deletes if no manifest of another repo references them.
+func (m *Manifests) evictRepos(keep string) []string {
+	var refs []string
+	for m.config.MaxRepos > 0 && len(m.manifests) > m.config.MaxRepos {
+		var oldest string
+		for repo := range m.manifests {
+			if repo == keep {
+				continue
+			}
+			if oldest == "" || m.accessed[repo].Before(m.accessed[oldest]) {
+				oldest = repo
+			}
+		}
+		if oldest == "" {
+			break
+		}
+		if m.config.Debug {
+			m.log.Printf("evicting repo %s\n", oldest)
+		}
+		for name, v := range m.manifests[oldest] {
+			refs = append(refs, v.Refs...)
+			m.unpersist(oldest, name)
+			metrics.ManifestEvictions.WithLabelValues("repos").Inc()
+		}
+		delete(m.manifests, oldest)
+		delete(m.accessed, oldest)
+	}
+	return refs
+}
+
+// releaseBlobs drops the blobs of an expired manifest, or retains them for BlobCacheTTL
+// if the blob handler tracks their age, so re-preparing the manifest finds them.
+func (m *Manifests) releaseBlobs(ctx context.Context, refs []string) {
+	if _, ok := m.blobHandler.(handler.BlobAgeHandler); !ok || m.config.BlobCacheTTL <= 0 {
+		m.deleteBlobs(ctx, refs)
+		return
+	}
+	for _, ref := range refs {
+		m.retained[ref] = struct{}{}
+	}
+}
+
+// expireBlobs deletes retained blobs which are older than BlobCacheTTL and not referenced by a cached manifest anymore.
+func (m *Manifests) expireBlobs(ctx context.Context) {
+	if len(m.retained) == 0 {
+		return
+	}
+	ageHandler := m.blobHandler.(handler.BlobAgeHandler)
+
+	live := map[string]struct{}{}
+	for _, mRepo := range m.manifests {
+		for _, v := range mRepo {
+			for _, ref := range v.Refs {
+				live[ref] = struct{}{}
+			}
+		}
+	}
+	for ref := range m.retained {
+		if _, ok := live[ref]; ok {
+			// owned by a manifest again, released once it expires
+			delete(m.retained, ref)
+			continue
+		}
+		h, err := v1.NewHash(ref)
+		if err != nil {
+			delete(m.retained, ref)
+			continue
+		}
+		storedAt, err := ageHandler.StoredAt(ctx, "", h)
+		if err != nil {
+			delete(m.retained, ref)
+			continue
+		}
+		if time.Since(storedAt) > m.config.BlobCacheTTL {
+			m.deleteBlobs(ctx, []string{ref})
+			delete(m.retained, ref)
+		}
+	}
+}
+
+// deleteBlobs removes the referenced blobs if the blob handler supports it.
+func (m *Manifests) deleteBlobs(ctx context.Context, refs []string) {
+	delHandler, ok := m.blobHandler.(handler.BlobDeleteHandler)
+	if !ok {
+		return
+	}
+	for _, ref := range refs {
+		h, err := v1.NewHash(ref)
 		if err != nil {
-			return errors.RegErrInternal(err)
+			continue
+		}
+		if m.config.Debug {
+			m.log.Printf("deleting blob %s", h.String())
 		}
+		if err = delHandler.Delete(ctx, "", h); err != nil {
+			m.log.Println(err)
+		}
+	}
+}
+
+func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+	n, regErr := m.pageSize(query, 10000)
+	if regErr != nil {
+		return regErr
 	}
 
 	elems := strings.Split(req.URL.Path, "/")
@@ -372,38 +701,39 @@ func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) e
 	}
 
 	var repos []string
-	countRepos := 0
 
 	if len(elems) > 2 {
 		// we have repo
 		repo := strings.Join(elems[0:len(elems)-2], "/")
-		index, _ := m.GetIndex(repo)
+		if err := m.checkUpstreamHost(m.expandAlias(repo)); err != nil {
+			return err
+		}
+		index, _ := m.GetIndex(req.Context(), m.expandAlias(repo))
 		if index != nil {
 			// show index's content instead of local
 			for r := range index.Entries {
-				if countRepos >= n {
-					break
-				}
-				countRepos++
 				repos = append(repos, fmt.Sprintf("%s/%s", repo, r))
 			}
 		}
 
 	} else {
 		m.lock.Lock()
-		defer m.lock.Unlock()
-
-		// TODO: implement pagination
 		for key := range m.manifests {
-			if countRepos >= n {
-				break
-			}
-			countRepos++
-			repos = append(repos, key)
+			repos = append(repos, m.aliasRepo(key))
 		}
+		m.lock.Unlock()
 	}
 
 	sort.Strings(repos)
+
+	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-repositories
+	// Offset using last query parameter.
+	if last := query.Get("last"); last != "" {
+		repos = repos[sort.Search(len(repos), func(i int) bool { return repos[i] > last }):]
+	}
+	// Limit using n query parameter, linking the next page if there is one.
+	repos = page(resp, req, repos, n)
+
 	repositoriesToList := Catalog{
 		Repos: repos,
 	}
@@ -417,3 +747,40 @@ func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) e
 	}
 	return nil
 }
+
+// pageSize returns the n query parameter of a paginated list, DefaultPageSize if there is none,
+// or the fallback without a DefaultPageSize, -1 meaning all entries. Larger pages than MaxPageSize are cut to it.
+func (m *Manifests) pageSize(query url.Values, fallback int) (int, *errors.RegError) {
+	n := fallback
+	if m.config.DefaultPageSize > 0 {
+		n = m.config.DefaultPageSize
+	}
+	if ns := query.Get("n"); ns != "" {
+		var err error
+		if n, err = strconv.Atoi(ns); err != nil || n < 0 {
+			return 0, &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    "BAD_REQUEST",
+				Message: fmt.Sprintf("invalid n: %s", ns),
+			}
+		}
+	}
+	if limit := m.config.MaxPageSize; limit > 0 && (n < 0 || n > limit) {
+		n = limit
+	}
+	return n, nil
+}
+
+// page returns the first n of the sorted entries, setting the Link header to the next page if there are more.
+// A negative n returns all of them.
+func page(resp http.ResponseWriter, req *http.Request, entries []string, n int) []string {
+	if n < 0 || n >= len(entries) {
+		return entries
+	}
+	entries = entries[:n]
+	if n > 0 {
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {entries[n-1]}}
+		resp.Header().Set("Link", fmt.Sprintf("<%s%s?%s>; rel=\"next\"", helper.PathPrefix(req), req.URL.Path, next.Encode()))
+	}
+	return entries
+}
@@ -0,0 +1,493 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mapCache is a Cache without eviction, unlike ristretto it stores synchronously.
+type mapCache struct {
+	m    map[interface{}]interface{}
+	lock sync.Mutex
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{m: map[interface{}]interface{}{}}
+}
+
+func (c *mapCache) SetWithTTL(key, value interface{}, _ int64, _ time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m[key] = value
+	return true
+}
+
+func (c *mapCache) Get(key interface{}) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *mapCache) Del(key interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.m, key)
+}
+
+func newTestManifests(t *testing.T, config Config) *Manifests {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewManifests(ctx, mem.NewMemHandler(), config, newMapCache(), log.New(io.Discard, "", 0))
+}
+
+func TestEvictLeastRecentlyUsedRepo(t *testing.T) {
+	m := newTestManifests(t, Config{MaxRepos: 2})
+
+	for _, repo := range []string{"a.example.com/one", "b.example.com/two"} {
+		if err := m.Write(repo, "1.0.0", Manifest{CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// make the first repo the most recently used one
+	m.accessed["a.example.com/one"] = time.Now().Add(time.Second)
+
+	if err := m.Write("c.example.com/three", "1.0.0", Manifest{CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.manifests) != 2 {
+		t.Fatalf("got %d repos cached, want 2", len(m.manifests))
+	}
+	if _, ok := m.manifests["b.example.com/two"]; ok {
+		t.Error("least recently used repo was not evicted")
+	}
+	for _, repo := range []string{"a.example.com/one", "c.example.com/three"} {
+		if _, ok := m.manifests[repo]; !ok {
+			t.Errorf("repo %s was evicted", repo)
+		}
+	}
+}
+
+func TestEvictRepoKeepsSharedBlobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blobs := mem.NewMemHandler()
+	m := NewManifests(ctx, blobs, Config{MaxRepos: 1}, newMapCache(), log.New(io.Discard, "", 0))
+
+	var hashes []v1.Hash
+	for _, data := range []string{"shared", "own"} {
+		h, _, err := v1.SHA256(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = blobs.Put(ctx, "", h, io.NopCloser(strings.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+	shared, own := hashes[0].String(), hashes[1].String()
+	// the same chart reached through a virtual repo and its direct path
+	if err := m.Write("virtual.example.com/app", "1.0.0", Manifest{Refs: []string{shared, own}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write("charts.example.com/app", "1.0.0", Manifest{Refs: []string{shared}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := m.manifests["virtual.example.com/app"]; ok {
+		t.Fatal("least recently used repo was not evicted")
+	}
+	if _, err := blobs.Stat(ctx, "", hashes[0]); err != nil {
+		t.Errorf("blob shared with the cached repo got deleted: %v", err)
+	}
+	if _, err := blobs.Stat(ctx, "", hashes[1]); err == nil {
+		t.Error("blob of the evicted repo only is still stored")
+	}
+}
+
+func TestEvictOldestManifests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blobs := mem.NewMemHandler()
+	m := NewManifests(ctx, blobs, Config{MaxManifests: 4}, newMapCache(), log.New(io.Discard, "", 0))
+
+	var hashes []v1.Hash
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("chart %d", i))
+		h, _, err := v1.SHA256(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = blobs.Put(ctx, "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+		// stored by tag and digest, like prepared charts
+		ma := Manifest{Blob: data, Refs: []string{h.String()}, CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		for _, name := range []string{fmt.Sprintf("1.0.%d", i), "sha256:" + h.Hex} {
+			if err = m.Write("charts.example.com/app", name, ma); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := m.countManifests(); got != 4 {
+		t.Fatalf("got %d manifests cached, want 4", got)
+	}
+	if _, ok := m.lookup("charts.example.com/app", "1.0.0"); ok {
+		t.Error("oldest manifest was not evicted")
+	}
+	if _, ok := m.lookup("charts.example.com/app", "sha256:"+hashes[0].Hex); ok {
+		t.Error("digest of the oldest manifest was not evicted")
+	}
+	if _, err := blobs.Stat(ctx, "", hashes[0]); err == nil {
+		t.Error("blob of the oldest manifest is still stored")
+	}
+	for i := 1; i < 3; i++ {
+		if _, ok := m.lookup("charts.example.com/app", fmt.Sprintf("1.0.%d", i)); !ok {
+			t.Errorf("manifest 1.0.%d was evicted", i)
+		}
+		if _, err := blobs.Stat(ctx, "", hashes[i]); err != nil {
+			t.Errorf("blob of 1.0.%d got deleted: %v", i, err)
+		}
+	}
+}
+
+// lockCheckingHandler records the deleted blobs and those deleted while the manifests lock was held.
+type lockCheckingHandler struct {
+	*mem.Handler
+	m       *Manifests
+	deleted []string
+	locked  []string
+}
+
+func (h *lockCheckingHandler) Delete(ctx context.Context, repo string, hash v1.Hash) error {
+	h.deleted = append(h.deleted, hash.String())
+	if !h.m.lock.TryLock() {
+		h.locked = append(h.locked, hash.String())
+	} else {
+		h.m.lock.Unlock()
+	}
+	return h.Handler.Delete(ctx, repo, hash)
+}
+
+func TestEvictionDeletesBlobsUnlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blobs := &lockCheckingHandler{Handler: mem.NewMemHandler()}
+	m := NewManifests(ctx, blobs, Config{MaxRepos: 2, MaxManifests: 2}, newMapCache(), log.New(io.Discard, "", 0))
+	blobs.m = m
+
+	put := func(data string) string {
+		t.Helper()
+		h, _, err := v1.SHA256(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = blobs.Put(ctx, "", h, io.NopCloser(strings.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		return h.String()
+	}
+	start := time.Now()
+	write := func(repo, name string, age time.Duration) {
+		t.Helper()
+		if err := m.Write(repo, name, Manifest{Refs: []string{put(repo + name)}, CreatedAt: start.Add(-age)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// over MaxManifests, then over MaxRepos
+	write("charts.example.com/one", "1.0.0", 3*time.Second)
+	write("charts.example.com/one", "1.0.1", 2*time.Second)
+	write("charts.example.com/one", "1.0.2", time.Second)
+	m.accessed["charts.example.com/one"] = start.Add(-time.Hour)
+	write("charts.example.com/two", "1.0.0", 0)
+	write("charts.example.com/three", "1.0.0", 0)
+	if _, ok := m.manifests["charts.example.com/one"]; ok {
+		t.Fatal("least recently used repo was not evicted")
+	}
+	m.Invalidate(ctx, "charts.example.com", "", "")
+
+	if len(blobs.locked) > 0 {
+		t.Errorf("got blobs %v deleted while holding the lock", blobs.locked)
+	}
+	if n := len(blobs.deleted); n != 5 {
+		t.Errorf("got %d blobs deleted, want all 5", n)
+	}
+}
+
+// agedHandler reports all blobs as stored at the given time.
+type agedHandler struct {
+	*mem.Handler
+	storedAt time.Time
+}
+
+func (h *agedHandler) StoredAt(ctx context.Context, repo string, hash v1.Hash) (time.Time, error) {
+	if _, err := h.Handler.StoredAt(ctx, repo, hash); err != nil {
+		return time.Time{}, err
+	}
+	return h.storedAt, nil
+}
+
+func TestCleanupRetainsBlobsForBlobCacheTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blobs := &agedHandler{Handler: mem.NewMemHandler(), storedAt: time.Now()}
+	m := NewManifests(ctx, blobs, Config{CacheTTL: time.Minute, BlobCacheTTL: time.Hour}, newMapCache(), log.New(io.Discard, "", 0))
+
+	h, _, err := v1.SHA256(bytes.NewReader([]byte("chart")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blobs.Put(ctx, "", h, io.NopCloser(bytes.NewReader([]byte("chart")))); err != nil {
+		t.Fatal(err)
+	}
+	expired := Manifest{Refs: []string{h.String()}, CreatedAt: time.Now().Add(-time.Hour)}
+	if err = m.Write("charts.example.com/app", "1.0.0", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	m.cleanup(ctx)
+	if _, ok := m.manifests["charts.example.com/app"]; ok {
+		t.Fatal("expired manifest is still cached")
+	}
+	if _, err = blobs.Stat(ctx, "", h); err != nil {
+		t.Fatalf("blob younger than BlobCacheTTL got deleted: %v", err)
+	}
+
+	blobs.storedAt = time.Now().Add(-2 * time.Hour)
+	m.cleanup(ctx)
+	if _, err = blobs.Stat(ctx, "", h); err == nil {
+		t.Error("blob older than BlobCacheTTL is still stored")
+	}
+}
+
+func TestSlowUpstreamDoesNotBlockOtherRepos(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	chartData := testChart(t, testChartYAML, nil)
+
+	var downloads int32
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	serveChartsHandler(t, m, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		entered <- struct{}{}
+		<-release
+		_, _ = w.Write(chartData)
+	}))
+	if err := m.Write("other.example.com/lib", "1.0.0", Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-entered
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/other.example.com/lib/manifests/1.0.0", nil))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached repo is blocked by a slow upstream of another repo")
+	}
+
+	// give the second request time to join the download
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("got %d downloads of the chart for concurrent requests, want 1", n)
+	}
+}
+
+func TestHandleCatalogPagination(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	var want []string
+	for i := 0; i < 5; i++ {
+		repo := fmt.Sprintf("charts.example.com/app%d", i)
+		want = append(want, repo)
+		if err := m.Write(repo, "1.0.0", Manifest{CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	next := "/v2/_catalog?n=2"
+	for pages := 0; next != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		rec := httptest.NewRecorder()
+		if err := m.HandleCatalog(rec, httptest.NewRequest(http.MethodGet, next, nil)); err != nil {
+			t.Fatal(err)
+		}
+		var catalog Catalog
+		if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.Repos) > 2 {
+			t.Fatalf("got %d repos on a page of 2", len(catalog.Repos))
+		}
+		got = append(got, catalog.Repos...)
+
+		next = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got repos %v, want %v", got, want)
+	}
+}
+
+func TestHandleCatalogPageSize(t *testing.T) {
+	m := newTestManifests(t, Config{DefaultPageSize: 2, MaxPageSize: 3})
+	for i := 0; i < 5; i++ {
+		if err := m.Write(fmt.Sprintf("charts.example.com/app%d", i), "1.0.0", Manifest{CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]int{
+		"/v2/_catalog":      2,
+		"/v2/_catalog?n=10": 3,
+	} {
+		rec := httptest.NewRecorder()
+		if err := m.HandleCatalog(rec, httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+			t.Fatal(err)
+		}
+		var catalog Catalog
+		if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+			t.Fatal(err)
+		}
+		if len(catalog.Repos) != want {
+			t.Errorf("%s: got %d repos, want %d", path, len(catalog.Repos), want)
+		}
+		if rec.Header().Get("Link") == "" {
+			t.Errorf("%s: no Link to the next page", path)
+		}
+	}
+}
+
+func TestHandleRejectsPushes(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		err := m.Handle(rec, httptest.NewRequest(method, "/v2/charts.example.com/app/manifests/1.0.0", strings.NewReader("{}")))
+		regErr, ok := err.(*errors.RegError)
+		if !ok || regErr.Status != http.StatusMethodNotAllowed || regErr.Code != "UNSUPPORTED" {
+			t.Errorf("%s: got %v, want a 405 UNSUPPORTED", method, err)
+		}
+	}
+}
+
+func TestHandleCacheHeaders(t *testing.T) {
+	m := newTestManifests(t, Config{ResponseCacheMaxAge: time.Minute})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	digest := rec.Header().Get("Docker-Content-Digest")
+	if got := rec.Header().Get("ETag"); got != `"`+digest+`"` {
+		t.Errorf("got ETag %s, want the digest %s", got, digest)
+	}
+	if got, want := rec.Header().Get("Cache-Control"), "public, max-age=60"; got != want {
+		t.Errorf("got Cache-Control %q by tag, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/"+digest, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("Cache-Control"), "public, max-age=60, immutable"; got != want {
+		t.Errorf("got Cache-Control %q by digest, want %q", got, want)
+	}
+
+	m = newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	rec = httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "" {
+		t.Errorf("got Cache-Control %q without max age", got)
+	}
+}
+
+func TestHandleRequireExplicitVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		config     Config
+		wantStatus int
+	}{
+		{name: "rejected", config: Config{RequireExplicitVersion: true}, wantStatus: http.StatusBadRequest},
+		{name: "version index", config: Config{RequireExplicitVersion: true, VersionIndex: true}, wantStatus: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, tc.config)
+			m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+			if err := m.Write("charts.example.com/app", "1.0.0", Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/", nil))
+			if tc.wantStatus == http.StatusOK {
+				if err != nil {
+					t.Fatalf("got %v, want the version index", err)
+				}
+			} else if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != tc.wantStatus || regErr.Code != "TAG_INVALID" {
+				t.Fatalf("got %v, want a %d TAG_INVALID", err, tc.wantStatus)
+			}
+
+			// pinned versions and tag lists are served as usual
+			if err = m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+				t.Errorf("explicit version: %v", err)
+			}
+			rec = httptest.NewRecorder()
+			if err = m.HandleTags(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/tags/list", nil)); err != nil {
+				t.Fatalf("list tags: %v", err)
+			}
+			var list listTags
+			if err = json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(list.Tags, ",") != "1.0.0" {
+				t.Errorf("got tags %v, want [1.0.0]", list.Tags)
+			}
+		})
+	}
+}
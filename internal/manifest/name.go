@@ -0,0 +1,56 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	// hostPattern matches the first element of a repo, the upstream host with an optional port, or an alias
+	hostPattern = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9.-]*[a-zA-Z0-9])?(?::[0-9]+)?$`)
+	// pathComponentPattern matches the other elements of a repo, as the OCI distribution spec defines them
+	pathComponentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*$`)
+)
+
+// repoFromPath returns the repo of a registry API path like /v2/<repo>/manifests/<reference>.
+// The repo is everything between the first v2 element and the last two elements, at least the upstream host and the chart name:
+//
+//	/v2/<host>[/<path>...]/<chart>/{manifests,tags,referrers}/<reference>
+//
+// The host is lowercased, the other elements must be valid OCI repository path components.
+func repoFromPath(urlPath string) (string, *errors.RegError) {
+	elem := strings.Split(urlPath, "/")
+	start := -1
+	for i, e := range elem {
+		if e == "v2" {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 || len(elem)-2-start < 2 {
+		return "", &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "NAME_INVALID",
+			Message: fmt.Sprintf("invalid repository in %s, expected <host>[/<path>...]/<chart>", urlPath),
+		}
+	}
+	parts := append([]string{}, elem[start:len(elem)-2]...)
+	parts[0] = strings.ToLower(parts[0])
+	for i, part := range parts {
+		valid := pathComponentPattern.MatchString(part)
+		if i == 0 {
+			valid = hostPattern.MatchString(part)
+		}
+		if !valid {
+			return "", &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    "NAME_INVALID",
+				Message: fmt.Sprintf("invalid repository name %s: invalid element %q", strings.Join(parts, "/"), part),
+			}
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
@@ -0,0 +1,58 @@
+package manifest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRepoFromPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v2/charts.example.com/app/manifests/1.0.0":                        "charts.example.com/app",
+		"/v2/github.com/org/repo/subpath/chart/manifests/1.0.0":             "github.com/org/repo/subpath/chart",
+		"/v2/a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r/s/t/u/v/w/x/y/z/tags/list": "a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r/s/t/u/v/w/x/y/z",
+		"/v2/charts.example.com/v2/app/manifests/1.0.0":                     "charts.example.com/v2/app",
+		"/v2/Charts.Example.com:8443/my_org/app-chart/manifests/1.0.0":      "charts.example.com:8443/my_org/app-chart",
+		"/v2/charts.example.com/app/referrers/sha256:abc":                   "charts.example.com/app",
+		"/v2/charts.example.com/app/manifests/":                             "charts.example.com/app",
+	} {
+		got, err := repoFromPath(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got repo %q, want %q", path, got, want)
+		}
+	}
+
+	for _, path := range []string{
+		"/v2/app/manifests/1.0.0",
+		"/v2/charts.example.com/App/manifests/1.0.0",
+		"/v2/charts.example.com/../app/manifests/1.0.0",
+		"/v2/charts.example.com//app/manifests/1.0.0",
+		"/v2/charts.example.com/_app/manifests/1.0.0",
+		"/v2/-charts.example.com/app/manifests/1.0.0",
+		"/charts.example.com/app/manifests/1.0.0",
+	} {
+		if got, err := repoFromPath(path); err == nil || err.Code != "NAME_INVALID" {
+			t.Errorf("%s: got repo %q and %v, want NAME_INVALID", path, got, err)
+		}
+	}
+}
+
+func TestHandleNestedRepoPath(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	cached, _ := m.cache.Get("charts.example.com")
+	m.cache.SetWithTTL("github.com/org/repo/subpath", cached, 1, time.Hour)
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/github.com/org/repo/subpath/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("github.com/org/repo/subpath/app", "1.0.0"); !ok {
+		t.Error("chart not cached under the nested repo")
+	}
+}
@@ -0,0 +1,211 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"net/http"
+	"net/url"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"strings"
+	"sync"
+)
+
+// isOCIUpstream tells whether the repo's host is configured as OCI registry rather than a chart repository.
+func (m *Manifests) isOCIUpstream(repo string) bool {
+	host := strings.SplitN(repo, "/", 2)[0]
+	for _, h := range m.config.OCIUpstreams {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNotAChart is returned for OCI artifacts which aren't Helm charts, the proxy doesn't serve them.
+var errNotAChart = cerrors.New("not a Helm chart")
+
+// chartGraphCheck refuses to copy the nodes of an OCI graph which don't make up a Helm chart, before they get downloaded.
+// oras copies a manifest only once its blobs are copied, so a manifest is checked last for having a chart layer.
+type chartGraphCheck struct {
+	maxChartSize int64
+	lock         sync.Mutex
+	chart        bool
+}
+
+func (c *chartGraphCheck) preCopy(_ context.Context, desc ocispec.Descriptor) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest:
+		if !c.chart {
+			return fmt.Errorf("%w: manifest %s has no chart layer", errNotAChart, desc.Digest)
+		}
+	case helmregistry.ChartLayerMediaType, helmregistry.LegacyChartLayerMediaType:
+		if c.maxChartSize > 0 && desc.Size > c.maxChartSize {
+			return fmt.Errorf("%w: chart %s larger than the limit of %d bytes", errNotAChart, desc.Digest, c.maxChartSize)
+		}
+		c.chart = true
+	case helmregistry.ConfigMediaType, helmregistry.ProvLayerMediaType:
+	default:
+		return fmt.Errorf("%w: %s has media type %s", errNotAChart, desc.Digest, desc.MediaType)
+	}
+	return nil
+}
+
+// prepareOCIChart copies the chart manifest and its blobs from an upstream OCI registry.
+// Anything but a Helm chart within MaxChartSize is refused, the proxy is no general image proxy.
+func (m *Manifests) prepareOCIChart(ctx context.Context, repo string, reference string) *errors.RegError {
+	if reference == "" {
+		// nothing to copy without a tag, tags get listed from the upstream registry
+		return nil
+	}
+	src, err := m.ociRepository(repo)
+	if err != nil {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "NAME_INVALID",
+			Message: fmt.Sprintf("invalid OCI repository %s: %v", repo, err),
+		}
+	}
+
+	copyOptions := oras.DefaultCopyOptions
+	copyOptions.Concurrency = m.copyConcurrency()
+	copyOptions.PreCopy = (&chartGraphCheck{maxChartSize: m.config.MaxChartSize}).preCopy
+
+	dst := NewInternalDst(repo, m.blobHandler.(handler.BlobPutHandler), m)
+	root, err := oras.Copy(ctx, src, reference, dst, reference, copyOptions)
+	if err != nil {
+		if cerrors.Is(err, errNotAChart) {
+			return &errors.RegError{
+				Status:  http.StatusForbidden,
+				Code:    "DENIED",
+				Message: fmt.Sprintf("%s:%s: %v", repo, reference, err),
+			}
+		}
+		if cerrors.Is(err, errdef.ErrNotFound) {
+			return &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    "NOT FOUND",
+				Message: fmt.Sprintf("Chart: %s version: %s not found: %v", repo, reference, err),
+			}
+		}
+		return errors.RegErrInternal(err)
+	}
+
+	// record referenced blobs, so they get cleaned up together with the manifest
+	ma, err := m.Read(repo, root.Digest.String())
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	ma.Refs = manifestRefs(ma.Blob)
+	for _, name := range []string{root.Digest.String(), reference} {
+		if err = m.Write(repo, name, ma); err != nil {
+			return errors.RegErrInternal(err)
+		}
+	}
+	return nil
+}
+
+// pullOCIChart pulls the chart archive of an index entry with an oci:// URL from the upstream registry.
+// URLs without tag or digest name the repository and get the entry's version.
+func (m *Manifests) pullOCIChart(ctx context.Context, u *url.URL, version string) ([]byte, error) {
+	ref := u.Host + u.Path
+	repoRef, target := ref, chartTag(version)
+	if i := strings.Index(ref, "@"); i >= 0 {
+		repoRef, target = ref[:i], ref[i+1:]
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repoRef, target = ref[:i], ref[i+1:]
+	}
+	src, err := m.ociRepository(repoRef)
+	if err != nil {
+		return nil, err
+	}
+	_, manifestData, err := oras.FetchBytes(ctx, src, target, oras.DefaultFetchBytesOptions)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", u, err)
+	}
+	var manifest ocispec.Manifest
+	if err = json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, err
+	}
+	for _, l := range manifest.Layers {
+		if l.MediaType == helmregistry.ChartLayerMediaType {
+			if limit := m.config.MaxChartSize; limit > 0 && l.Size > limit {
+				return nil, fmt.Errorf("pull %s: chart larger than the limit of %d bytes", u, limit)
+			}
+			return content.FetchAll(ctx, src, l)
+		}
+	}
+	return nil, fmt.Errorf("no chart layer in %s", u)
+}
+
+// ociTags lists the tags of the repo in the upstream OCI registry.
+func (m *Manifests) ociTags(ctx context.Context, repo string) ([]string, error) {
+	src, err := m.ociRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	err = src.Tags(ctx, "", func(t []string) error {
+		tags = append(tags, t...)
+		return nil
+	})
+	return tags, err
+}
+
+// ociRepository returns the upstream OCI repository, accessed with the upstream client.
+func (m *Manifests) ociRepository(repo string) (*remote.Repository, error) {
+	src, err := remote.NewRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	src.PlainHTTP = m.upstreamScheme(src.Reference.Registry) == "http"
+	src.Client = &auth.Client{
+		Client: m.client,
+		Cache:  auth.DefaultCache,
+		Credential: func(_ context.Context, registry string) (auth.Credential, error) {
+			creds, _ := m.upstreamCredentials(&url.URL{Host: registry})
+			return auth.Credential{Username: creds.Username, Password: creds.Password}, nil
+		},
+	}
+	return src, nil
+}
+
+// manifestRefs returns the digests of the config and layers referenced by an image manifest, or the blobs of an artifact manifest.
+func manifestRefs(blob []byte) []string {
+	var parsed struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+		Blobs []struct {
+			Digest string `json:"digest"`
+		} `json:"blobs"`
+	}
+	if err := json.Unmarshal(blob, &parsed); err != nil {
+		return nil
+	}
+	var refs []string
+	if parsed.Config.Digest != "" {
+		refs = append(refs, parsed.Config.Digest)
+	}
+	for _, l := range parsed.Layers {
+		refs = append(refs, l.Digest)
+	}
+	for _, b := range parsed.Blobs {
+		refs = append(refs, b.Digest)
+	}
+	return refs
+}
@@ -0,0 +1,216 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// pushOCIChart pushes the chart archive helm style to the repository of the registry at host.
+func pushOCIChart(t *testing.T, host string, repository string, tag string, chartData []byte) {
+	t.Helper()
+	pushOCIArtifact(t, host, repository, tag, helmregistry.ConfigMediaType, helmregistry.ChartLayerMediaType, chartData)
+}
+
+// pushOCIArtifact pushes an image manifest with the config and layer media types to the repository of the registry at host.
+func pushOCIArtifact(t *testing.T, host string, repository string, tag string, configMediaType string, layerMediaType string, layerData []byte) {
+	t.Helper()
+	ctx := context.Background()
+	store := memory.New()
+	configData := []byte("{}")
+	config := ocispec.Descriptor{MediaType: configMediaType, Digest: digest.FromBytes(configData), Size: int64(len(configData))}
+	layer := ocispec.Descriptor{MediaType: layerMediaType, Digest: digest.FromBytes(layerData), Size: int64(len(layerData))}
+	for _, blob := range []struct {
+		desc ocispec.Descriptor
+		data []byte
+	}{{config, configData}, {layer, layerData}} {
+		if err := store.Push(ctx, blob.desc, bytes.NewReader(blob.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := oras.Pack(ctx, store, "", []ocispec.Descriptor{layer}, oras.PackOptions{ConfigDescriptor: &config, PackImageManifest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Tag(ctx, root, tag); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := remote.NewRepository(host + "/" + repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.PlainHTTP = true
+	if _, err = oras.Copy(ctx, store, tag, dst, tag, oras.DefaultCopyOptions); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareChartFromOCIURL(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartData := testChart(t, testChartYAML, nil)
+	pushOCIChart(t, u.Host, "charts/app", "1.0.0", chartData)
+
+	for _, chartURL := range []string{
+		"oci://" + u.Host + "/charts/app:1.0.0",
+		// the entry's version is the tag
+		"oci://" + u.Host + "/charts/app",
+	} {
+		t.Run(chartURL, func(t *testing.T) {
+			m := newTestManifests(t, Config{UpstreamScheme: "http"})
+			index := repo.NewIndexFile()
+			index.Entries["app"] = repo.ChartVersions{{
+				Metadata: &chart.Metadata{Name: "app", Version: "1.0.0"},
+				URLs:     []string{chartURL},
+			}}
+			m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: index}, 1, time.Hour)
+
+			manifest := preparedManifest(t, m)
+			if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digest.FromBytes(chartData) {
+				t.Fatalf("got layers %+v, want the pulled chart", manifest.Layers)
+			}
+			if got := manifest.Layers[0].Annotations[ocispec.AnnotationTitle]; got != "app-1.0.0.tgz" {
+				t.Errorf("got layer title %q, want app-1.0.0.tgz", got)
+			}
+		})
+	}
+}
+
+// ociUpstream serves an OCI registry configured as OCI upstream of the returned manifests.
+func ociUpstream(t *testing.T, config Config) (*Manifests, string) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OCIUpstreams = []string{u.Host}
+	config.UpstreamSchemes = map[string]string{u.Host: "http"}
+	return newTestManifests(t, config), u.Host
+}
+
+func TestHandleOCIUpstream(t *testing.T) {
+	m, host := ociUpstream(t, Config{})
+	chartData := testChart(t, testChartYAML, nil)
+	// tagged like most charts published to OCI registries, with the v prefix
+	pushOCIChart(t, host, "charts/app", "v1.0.0", chartData)
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/"+host+"/charts/app/manifests/v1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	ma, ok := m.lookup(host+"/charts/app", "v1.0.0")
+	if !ok {
+		t.Fatal("manifest not cached under the upstream tag")
+	}
+	if got, want := rec.Header().Get("Docker-Content-Digest"), manifestDigest(ma); got != want {
+		t.Errorf("got digest %s, want %s", got, want)
+	}
+	if _, ok = m.lookup(host+"/charts/app", manifestDigest(ma)); !ok {
+		t.Error("manifest not cached by digest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digest.FromBytes(chartData) {
+		t.Errorf("got layers %+v, want the pushed chart", manifest.Layers)
+	}
+
+	rec = httptest.NewRecorder()
+	err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/"+host+"/charts/app/manifests/1.0.0", nil))
+	if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusNotFound {
+		t.Errorf("got %v for a tag the upstream doesn't have, want a 404", err)
+	}
+}
+
+func TestHandleTagsOCIUpstream(t *testing.T) {
+	m, host := ociUpstream(t, Config{})
+	chartData := testChart(t, testChartYAML, nil)
+	for _, tag := range []string{"v1.0.0", "1.1.0"} {
+		pushOCIChart(t, host, "charts/app", tag, chartData)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, "/v2/"+host+"/charts/app/tags/list", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var list listTags
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(list.Tags, ","); got != "1.1.0,v1.0.0" {
+		t.Errorf("got tags %q, want the upstream tags as they are", got)
+	}
+}
+
+func TestHandleOCIUpstreamRefusesNonCharts(t *testing.T) {
+	chartData := testChart(t, testChartYAML, nil)
+	for _, tc := range []struct {
+		name       string
+		config     Config
+		configType string
+		layerType  string
+		// the layer itself is refused, rather than the manifest it belongs to
+		layerRefused bool
+	}{
+		{name: "image", configType: ocispec.MediaTypeImageConfig, layerType: ocispec.MediaTypeImageLayerGzip, layerRefused: true},
+		{name: "chart layer of an image", configType: ocispec.MediaTypeImageConfig, layerType: helmregistry.ChartLayerMediaType},
+		{
+			name:         "chart too large",
+			config:       Config{MaxChartSize: int64(len(chartData)) - 1},
+			configType:   helmregistry.ConfigMediaType,
+			layerType:    helmregistry.ChartLayerMediaType,
+			layerRefused: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, host := ociUpstream(t, tc.config)
+			pushOCIArtifact(t, host, "images/app", "1.0.0", tc.configType, tc.layerType, chartData)
+
+			err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/"+host+"/images/app/manifests/1.0.0", nil))
+			if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusForbidden {
+				t.Fatalf("got %v, want a 403", err)
+			}
+			if _, ok := m.lookup(host+"/images/app", "1.0.0"); ok {
+				t.Error("manifest cached")
+			}
+			if !tc.layerRefused {
+				return
+			}
+			h, err := v1.NewHash(digest.FromBytes(chartData).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = m.blobHandler.(handler.BlobStatHandler).Stat(context.Background(), "", h); err == nil {
+				t.Error("refused layer copied")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parentTimeout bounds pulling a manifest from the parent registry
+const parentTimeout = time.Minute
+
+// prepare prepares the chart from its upstream index, without holding the lock while downloading.
+// Concurrent requests for the same chart and target share one preparation, which runs detached from their contexts.
+func (m *Manifests) prepare(ctx context.Context, repo string, target string) *errors.RegError {
+	res, _, _ := m.prepares.Do(repo+"@"+target, func() (interface{}, error) {
+		ctx, cancel := detached(ctx, sharedTimeout)
+		defer cancel()
+		return m.prepareOrParent(ctx, repo, target), nil
+	})
+	return res.(*errors.RegError)
+}
+
+// prepareOrParent prepares the chart from its upstream index.
+// If the chart can't be found there and a parent registry is configured, the manifest is pulled from the parent.
+func (m *Manifests) prepareOrParent(ctx context.Context, repo string, target string) *errors.RegError {
+	err := m.prepareChart(ctx, repo, target)
+	if err == nil || err.Status != http.StatusNotFound || m.parent == nil || target == "" {
+		return err
+	}
+	parentCtx, cancel := context.WithTimeout(ctx, parentTimeout)
+	defer cancel()
+	if perr := m.fetchParentManifest(parentCtx, repo, target); perr != nil {
+		if m.config.Debug {
+			m.log.Printf("parent registry fallback failed: %v\n", perr)
+		}
+		return err
+	}
+	return nil
+}
+
+// fetchParentManifest pulls the manifest from the parent registry and stores it by tag and digest.
+// Manifests whose digest differs from the requested one or the Docker-Content-Digest the parent sent aren't stored.
+// Blobs are pulled by the blobs handler once the client asks for them.
+func (m *Manifests) fetchParentManifest(ctx context.Context, repo string, target string) error {
+	resp, err := m.parent.Get(ctx, fmt.Sprintf("/v2/%s/manifests/%s", repo, target), defaultManifestMediaTypes...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	blob, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	ma := Manifest{
+		ContentType: resp.Header.Get("Content-Type"),
+		Blob:        blob,
+		Refs:        manifestRefs(blob), // so blobs get cleaned up together with the manifest
+		CreatedAt:   time.Now(),
+	}
+	rd := sha256.Sum256(blob)
+	got := "sha256:" + hex.EncodeToString(rd[:])
+	for _, want := range []string{resp.Header.Get("Docker-Content-Digest"), target} {
+		if strings.HasPrefix(want, "sha256:") && want != got {
+			return fmt.Errorf("parent registry sent manifest %s for %s:%s, want %s", got, repo, target, want)
+		}
+	}
+	if err = m.Write(repo, got, ma); err != nil {
+		return err
+	}
+	return m.Write(repo, target, ma)
+}
@@ -0,0 +1,89 @@
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// parentManifest is the manifest served by the parent registry in the tests
+var parentManifest = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+
+// serveParent serves parentManifest for every manifest request, with the Docker-Content-Digest.
+func serveParent(t *testing.T, digest string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		if digest != "" {
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+		_, _ = w.Write(parentManifest)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newParentManifests(t *testing.T, parent string) *Manifests {
+	t.Helper()
+	m := newTestManifests(t, Config{ParentRegistry: parent})
+	// the upstream doesn't list the chart, so it's looked up in the parent
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("other", "1.0.0")}, 1, time.Hour)
+	return m
+}
+
+func TestPrepareFromParent(t *testing.T) {
+	rd := sha256.Sum256(parentManifest)
+	digest := "sha256:" + hex.EncodeToString(rd[:])
+	m := newParentManifests(t, serveParent(t, digest).URL)
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != string(parentManifest) {
+		t.Errorf("got %s, want the parent's manifest", rec.Body.String())
+	}
+	for _, name := range []string{"1.0.0", digest} {
+		if _, ok := m.lookup("charts.example.com/app", name); !ok {
+			t.Errorf("parent manifest not cached as %s", name)
+		}
+	}
+}
+
+func TestPrepareFromParentVerifiesDigest(t *testing.T) {
+	const other = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	for name, tc := range map[string]struct {
+		header string
+		target string
+	}{
+		"Docker-Content-Digest": {header: other, target: "1.0.0"},
+		"requested digest":      {target: other},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := newParentManifests(t, serveParent(t, tc.header).URL)
+			if err := m.prepare(context.Background(), "charts.example.com/app", tc.target); err == nil {
+				t.Fatal("got no error for a manifest with another digest")
+			}
+			if n := m.countManifests(); n != 0 {
+				t.Errorf("got %d manifests cached, want none", n)
+			}
+		})
+	}
+}
+
+func TestPrepareFromParentOutlivesRequest(t *testing.T) {
+	m := newParentManifests(t, serveParent(t, "").URL)
+	// the request which started the shared preparation went away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.prepare(ctx, "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("charts.example.com/app", "1.0.0"); !ok {
+		t.Error("parent manifest not cached")
+	}
+}
@@ -0,0 +1,81 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/repo"
+	"strings"
+)
+
+// LatestTag is the reference resolved to the highest version of a chart listed in its index.
+const LatestTag = "latest"
+
+// chartTag returns the tag a chart version is served as: without a "v" prefix and with "_" in place of "+",
+// since OCI tags can't contain "+". Requested references are normalized the same way, so either spelling finds the chart.
+func chartTag(version string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(version, "v"), "+", "_")
+}
+
+// listedTag returns the tag a chart version is listed as in tag lists and the version index.
+// That's its chartTag, unless PreserveVersionPrefix keeps the version's "v" prefix.
+func (m *Manifests) listedTag(version string) string {
+	if m.config.PreserveVersionPrefix {
+		return strings.ReplaceAll(version, "+", "_")
+	}
+	return chartTag(version)
+}
+
+// versionCandidates returns the versions a tag may be listed as in an index, e.g. 1.2.3_build may be listed
+// as 1.2.3+build, v1.2.3+build, 1.2.3_build or v1.2.3_build.
+func versionCandidates(tag string) []string {
+	tag = strings.TrimPrefix(tag, "v")
+	plus := strings.ReplaceAll(tag, "_", "+")
+	candidates := []string{plus, "v" + plus}
+	if plus != tag {
+		candidates = append(candidates, tag, "v"+tag)
+	}
+	return candidates
+}
+
+// findVersion resolves the reference of a chart in the index. Every spelling of the reference is tried as exact version first,
+// then the reference is matched as semver constraint, which also resolves an empty reference to the latest version.
+func findVersion(index *repo.IndexFile, chart string, reference string) (*repo.ChartVersion, error) {
+	if reference != "" {
+		for _, candidate := range versionCandidates(reference) {
+			for _, v := range index.Entries[chart] {
+				if v.Version == candidate {
+					return v, nil
+				}
+			}
+		}
+	}
+	return index.Get(chart, strings.ReplaceAll(reference, "_", "+"))
+}
+
+// latestVersion returns the highest semver version of the chart in the index, prereleases only if allowPrerelease.
+// Unlike an empty constraint it doesn't depend on the order of the index entries.
+func latestVersion(index *repo.IndexFile, chart string, allowPrerelease bool) (*repo.ChartVersion, error) {
+	var latest *repo.ChartVersion
+	var latestVer *semver.Version
+	for _, v := range index.Entries[chart] {
+		ver, err := semver.NewVersion(v.Version)
+		if err != nil || (ver.Prerelease() != "" && !allowPrerelease) {
+			continue
+		}
+		if latestVer == nil || ver.GreaterThan(latestVer) {
+			latest, latestVer = v, ver
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no version of %s to resolve %s", chart, LatestTag)
+	}
+	return latest, nil
+}
+
+// resolveVersion is findVersion resolving an empty reference like the latest tag.
+func (m *Manifests) resolveVersion(index *repo.IndexFile, chart string, reference string) (*repo.ChartVersion, error) {
+	if reference == "" {
+		return latestVersion(index, chart, m.config.AllowPrereleaseLatest)
+	}
+	return findVersion(index, chart, reference)
+}
@@ -0,0 +1,272 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestFindVersionConventions(t *testing.T) {
+	// every way a repo may list a version, and every way a client may request it
+	for _, listed := range []string{"1.2.3", "v1.2.3", "1.2.3+build.1", "v1.2.3+build.1"} {
+		index := testIndex("app", listed, "0.1.0")
+
+		requests := []string{"1.2.3", "v1.2.3"}
+		if chartTag(listed) == "1.2.3_build.1" {
+			requests = []string{"1.2.3_build.1", "v1.2.3_build.1", "1.2.3+build.1", "v1.2.3+build.1"}
+		}
+		for _, reference := range requests {
+			v, err := findVersion(index, "app", reference)
+			if err != nil {
+				t.Errorf("listed %s, requested %s: %v", listed, reference, err)
+				continue
+			}
+			if v.Version != listed {
+				t.Errorf("listed %s, requested %s: got %s", listed, reference, v.Version)
+			}
+		}
+	}
+}
+
+func TestFindVersionPrefersExactMatch(t *testing.T) {
+	index := testIndex("app", "1.2.3", "v1.2.3")
+
+	for _, reference := range []string{"1.2.3", "v1.2.3"} {
+		v, err := findVersion(index, "app", reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// both normalize to the same tag, the version without prefix wins
+		if v.Version != "1.2.3" {
+			t.Errorf("requested %s: got %s, want 1.2.3", reference, v.Version)
+		}
+	}
+}
+
+func TestFindVersionLatest(t *testing.T) {
+	v, err := findVersion(testIndex("app", "1.0.0", "2.0.0"), "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != "2.0.0" {
+		t.Errorf("got %s, want the latest version 2.0.0", v.Version)
+	}
+}
+
+func TestChartTag(t *testing.T) {
+	for version, want := range map[string]string{
+		"1.2.3":          "1.2.3",
+		"v1.2.3":         "1.2.3",
+		"1.2.3+build.1":  "1.2.3_build.1",
+		"v1.2.3_build.1": "1.2.3_build.1",
+	} {
+		if got := chartTag(version); got != want {
+			t.Errorf("chartTag(%s): got %s, want %s", version, got, want)
+		}
+	}
+}
+
+func TestHandleTagsVersionPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		preserve bool
+		want     []string
+	}{
+		{false, []string{"1.0.0_build.1", "1.17.2"}},
+		{true, []string{"1.0.0_build.1", "v1.17.2"}},
+	} {
+		m := newTestManifests(t, Config{PreserveVersionPrefix: tc.preserve})
+		m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "v1.17.2", "1.0.0+build.1")}, 1, time.Hour)
+		// cached, so listing tags doesn't prepare the chart
+		if err := m.Write("charts.example.com/app", "1.17.2", Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/tags/list", nil)); err != nil {
+			t.Fatal(err)
+		}
+		var list listTags
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(list.Tags, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("preserve %v: got tags %v, want %v", tc.preserve, list.Tags, tc.want)
+		}
+
+		// either spelling resolves the manifest
+		for _, reference := range []string{"1.17.2", "v1.17.2"} {
+			rec = httptest.NewRecorder()
+			if err := m.Handle(rec, httptest.NewRequest(http.MethodHead, "/v2/charts.example.com/app/manifests/"+reference, nil)); err != nil {
+				t.Errorf("preserve %v, reference %s: %v", tc.preserve, reference, err)
+			}
+		}
+	}
+}
+
+func TestHandleTagsPagination(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0", "1.1.0", "1.2.0")}, 1, time.Hour)
+	if err := m.Write("charts.example.com/app", "1.2.0", Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(path string) ([]string, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+			t.Fatal(err)
+		}
+		var list listTags
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		return list.Tags, rec.Header().Get("Link")
+	}
+
+	tags, link := list("/v2/charts.example.com/app/tags/list?n=2")
+	if strings.Join(tags, ",") != "1.0.0,1.1.0" {
+		t.Errorf("got first page %v, want [1.0.0 1.1.0]", tags)
+	}
+	want := `</v2/charts.example.com/app/tags/list?last=1.1.0&n=2>; rel="next"`
+	if link != want {
+		t.Fatalf("got Link %q, want %q", link, want)
+	}
+
+	tags, link = list(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`))
+	if strings.Join(tags, ",") != "1.2.0" {
+		t.Errorf("got second page %v, want [1.2.0]", tags)
+	}
+	if link != "" {
+		t.Errorf("got Link %q on the last page", link)
+	}
+}
+
+func TestHandleTagsPageSize(t *testing.T) {
+	m := newTestManifests(t, Config{DefaultPageSize: 2, MaxPageSize: 3})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0", "1.1.0", "1.2.0", "1.3.0")}, 1, time.Hour)
+
+	for path, want := range map[string]string{
+		// the default page size without n
+		"/v2/charts.example.com/app/tags/list": `</v2/charts.example.com/app/tags/list?last=1.1.0&n=2>; rel="next"`,
+		// n larger than the max page size
+		"/v2/charts.example.com/app/tags/list?n=10": `</v2/charts.example.com/app/tags/list?last=1.2.0&n=3>; rel="next"`,
+		"/v2/charts.example.com/app/tags/list?n=1":  `</v2/charts.example.com/app/tags/list?last=1.0.0&n=1>; rel="next"`,
+	} {
+		rec := httptest.NewRecorder()
+		if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Link"); got != want {
+			t.Errorf("%s: got Link %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestHandleBuildMetadataVersion(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{
+		"/app-1.0.0+build1.tgz": testChart(t, "apiVersion: v2\nname: app\nversion: 1.0.0+build1\n", nil),
+	})
+	index, err := m.GetIndex(context.Background(), "charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Entries["app"][0].Version = "1.0.0+build1"
+	index.Entries["app"][0].URLs = []string{strings.Replace(index.Entries["app"][0].URLs[0], "1.0.0", "1.0.0+build1", 1)}
+
+	// GET and HEAD resolve either spelling, whichever comes first, also once the manifest expired
+	for _, method := range []string{http.MethodHead, http.MethodGet, http.MethodHead} {
+		for _, ref := range []string{"1.0.0_build1", "1.0.0+build1"} {
+			rec := httptest.NewRecorder()
+			if err := m.Handle(rec, httptest.NewRequest(method, "/v2/charts.example.com/app/manifests/"+ref, nil)); err != nil {
+				t.Fatalf("%s %s: %v", method, ref, err)
+			}
+			if rec.Header().Get("Docker-Content-Digest") == "" {
+				t.Errorf("%s %s: got no digest", method, ref)
+			}
+		}
+		delete(m.manifests, "charts.example.com/app")
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	index := testIndex("app", "1.2.0", "2.0.0-rc.1", "1.10.0", "not-semver", "v1.9.0")
+	for _, tc := range []struct {
+		allowPrerelease bool
+		want            string
+	}{
+		{false, "1.10.0"},
+		{true, "2.0.0-rc.1"},
+	} {
+		v, err := latestVersion(index, "app", tc.allowPrerelease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != tc.want {
+			t.Errorf("prereleases allowed %v: got %s, want %s", tc.allowPrerelease, v.Version, tc.want)
+		}
+	}
+	if _, err := latestVersion(testIndex("app", "1.0.0-beta"), "app", false); err == nil {
+		t.Error("got a latest version of a chart with prereleases only")
+	}
+}
+
+func TestHandleLatest(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	index, err := m.GetIndex(context.Background(), "charts.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the prerelease is not downloadable, resolving to it fails the pull
+	index.Entries["app"] = append(index.Entries["app"], &repo.ChartVersion{
+		Metadata: &chart.Metadata{Name: "app", Version: "1.1.0-rc.1"},
+		URLs:     []string{"app-1.1.0-rc.1.tgz"},
+	})
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/latest", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Header().Get("Docker-Content-Digest"), preparedDigest(t, m); got != want {
+		t.Errorf("got digest %s, want %s of 1.0.0", got, want)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if got := manifest.Annotations[ocispec.AnnotationVersion]; got != "1.0.0" {
+		t.Errorf("got version annotation %q, want 1.0.0", got)
+	}
+}
+
+func TestHandleTagsUnknownChart(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	index := testIndex("app", "1.0.0")
+	index.Entries["empty"] = repo.ChartVersions{}
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: index}, 1, time.Hour)
+
+	rec := httptest.NewRecorder()
+	if err := m.HandleTags(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/empty/tags/list", nil)); err != nil {
+		t.Fatalf("chart without versions: %v", err)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"name":"charts.example.com/empty","tags":[]}` {
+		t.Errorf("got %s for a chart without versions, want an empty tag list", got)
+	}
+
+	for _, path := range []string{"/v2/charts.example.com/missing/tags/list", "/v2/unknown.example.com/app/tags/list"} {
+		err := m.HandleTags(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusNotFound || regErr.Code != "NAME_UNKNOWN" {
+			t.Errorf("%s: got %v, want a 404 NAME_UNKNOWN", path, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// referrersTagPattern matches the tags clients without referrers API support look referrers up at
+var referrersTagPattern = regexp.MustCompile(`^sha256-[a-f0-9]{64}$`)
+
+// HandleReferrers lists the cached manifests which have the requested digest as subject.
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func (m *Manifests) HandleReferrers(resp http.ResponseWriter, req *http.Request) error {
+	elem := strings.Split(req.URL.Path, "/")
+	if len(elem) < 5 {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "INVALID PARAMS",
+			Message: "No chart name specified",
+		}
+	}
+	if req.Method != http.MethodGet {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "METHOD_UNKNOWN",
+			Message: "We don't understand your method + url",
+		}
+	}
+	subject := elem[len(elem)-1]
+	if _, err := digest.Parse(subject); err != nil {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "DIGEST_INVALID",
+			Message: fmt.Sprintf("invalid digest %s: %v", subject, err),
+		}
+	}
+
+	name, regErr := repoFromPath(req.URL.Path)
+	if regErr != nil {
+		return regErr
+	}
+	repo := m.expandAlias(name)
+
+	artifactType := req.URL.Query().Get("artifactType")
+	ma, err := referrersIndex(m.referrers(repo, subject, artifactType))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if artifactType != "" {
+		resp.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	return writeManifest(resp, ma, true)
+}
+
+// referrers describes the cached manifests of the repo whose subject is the given digest.
+// An empty artifactType lists referrers of all types.
+func (m *Manifests) referrers(repo string, subject string, artifactType string) []ocispec.Descriptor {
+	descs := []ocispec.Descriptor{}
+	seen := map[digest.Digest]struct{}{}
+
+	m.lock.Lock()
+	for _, ma := range m.manifests[repo] {
+		var parsed struct {
+			ArtifactType string `json:"artifactType"`
+			Config       struct {
+				MediaType string `json:"mediaType"`
+			} `json:"config"`
+			Subject *struct {
+				Digest string `json:"digest"`
+			} `json:"subject"`
+			Annotations map[string]string `json:"annotations"`
+		}
+		if err := json.Unmarshal(ma.Blob, &parsed); err != nil || parsed.Subject == nil || parsed.Subject.Digest != subject {
+			continue
+		}
+		// manifests are cached by tag and digest
+		d := digest.FromBytes(ma.Blob)
+		if _, ok := seen[d]; ok {
+			continue
+		}
+		seen[d] = struct{}{}
+
+		// without an explicit artifact type the config media type serves as one
+		typ := parsed.ArtifactType
+		if typ == "" {
+			typ = parsed.Config.MediaType
+		}
+		if artifactType != "" && typ != artifactType {
+			continue
+		}
+		descs = append(descs, ocispec.Descriptor{
+			MediaType:    ma.ContentType,
+			ArtifactType: typ,
+			Digest:       d,
+			Size:         int64(len(ma.Blob)),
+			Annotations:  parsed.Annotations,
+		})
+	}
+	m.lock.Unlock()
+
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].Digest < descs[j].Digest
+	})
+	return descs
+}
+
+// referrersIndex wraps the referrers into an image index, as returned by the referrers API.
+func referrersIndex(descs []ocispec.Descriptor) (Manifest, error) {
+	blob, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: descs,
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	return Manifest{ContentType: ocispec.MediaTypeImageIndex, Blob: blob}, nil
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestHandleReferrers(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	repo := "charts.example.com/charts/app"
+
+	chart := []byte(`{"schemaVersion":2}`)
+	chartDigest := digest.FromBytes(chart)
+	referrer := func(configMediaType string) Manifest {
+		blob, err := json.Marshal(ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.Descriptor{MediaType: configMediaType, Digest: digest.FromString("{}"), Size: 2},
+			Subject:   &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: chartDigest, Size: int64(len(chart))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Manifest{ContentType: ocispec.MediaTypeImageManifest, Blob: blob, CreatedAt: time.Now()}
+	}
+	sbom, sig := referrer("application/spdx+json"), referrer("application/vnd.dev.cosign.artifact.sig.v1+json")
+	for name, ma := range map[string]Manifest{
+		"1.0.0":                              {ContentType: ocispec.MediaTypeImageManifest, Blob: chart, CreatedAt: time.Now()},
+		digest.FromBytes(sbom.Blob).String(): sbom,
+		"sbom":                               sbom,
+		digest.FromBytes(sig.Blob).String():  sig,
+	} {
+		if err := m.Write(repo, name, ma); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(t *testing.T, h func(http.ResponseWriter, *http.Request) error, path string) (*httptest.ResponseRecorder, ocispec.Index) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := h(rec, httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+			t.Fatal(err)
+		}
+		var idx ocispec.Index
+		if err := json.Unmarshal(rec.Body.Bytes(), &idx); err != nil {
+			t.Fatal(err)
+		}
+		if idx.MediaType != ocispec.MediaTypeImageIndex {
+			t.Errorf("got media type %q, want %q", idx.MediaType, ocispec.MediaTypeImageIndex)
+		}
+		return rec, idx
+	}
+
+	t.Run("all", func(t *testing.T) {
+		_, idx := get(t, m.HandleReferrers, "/v2/"+repo+"/referrers/"+chartDigest.String())
+		if len(idx.Manifests) != 2 {
+			t.Fatalf("got %d referrers, want 2: %+v", len(idx.Manifests), idx.Manifests)
+		}
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		rec, idx := get(t, m.HandleReferrers, "/v2/"+repo+"/referrers/"+chartDigest.String()+"?artifactType=application/spdx%2Bjson")
+		if len(idx.Manifests) != 1 || idx.Manifests[0].ArtifactType != "application/spdx+json" {
+			t.Fatalf("got %+v, want only the SBOM", idx.Manifests)
+		}
+		if rec.Header().Get("OCI-Filters-Applied") != "artifactType" {
+			t.Error("missing OCI-Filters-Applied header")
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		_, idx := get(t, m.HandleReferrers, "/v2/"+repo+"/referrers/"+digest.FromString("other").String())
+		if idx.Manifests == nil || len(idx.Manifests) != 0 {
+			t.Errorf("got %+v, want an empty list", idx.Manifests)
+		}
+	})
+
+	t.Run("fallback tag", func(t *testing.T) {
+		_, idx := get(t, m.Handle, "/v2/"+repo+"/manifests/sha256-"+chartDigest.Encoded())
+		if len(idx.Manifests) != 2 {
+			t.Fatalf("got %d referrers, want 2", len(idx.Manifests))
+		}
+	})
+}
+
+func TestHandleReferrersInvalidDigest(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	err := m.HandleReferrers(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/charts/app/referrers/latest", nil))
+	regErr, ok := err.(*errors.RegError)
+	if !ok || regErr.Status != http.StatusBadRequest {
+		t.Fatalf("got %v, want a bad request", err)
+	}
+}
+
+func TestFallbackTagWithoutReferrers(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/charts/app/manifests/sha256-"+digest.FromString("chart").Encoded(), nil))
+	regErr, ok := err.(*errors.RegError)
+	if !ok || regErr.Status != http.StatusNotFound {
+		t.Fatalf("got %v, want not found", err)
+	}
+}
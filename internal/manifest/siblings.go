@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+)
+
+const (
+	// SignatureLayerMediaType is the media type of detached chart signatures published next to the chart
+	SignatureLayerMediaType = "application/vnd.container-registry.helm.chart.signature.v1.sig"
+)
+
+// SiblingPolicy defines which files published next to the chart tarball get packed as additional layers.
+type SiblingPolicy string
+
+const (
+	// SiblingsNone packs the chart only
+	SiblingsNone SiblingPolicy = "chart"
+	// SiblingsProvenance packs the chart and its provenance file
+	SiblingsProvenance SiblingPolicy = "provenance"
+	// SiblingsAll packs the chart, its provenance file and signatures
+	SiblingsAll SiblingPolicy = "all"
+)
+
+type sibling struct {
+	suffix    string // appended to the chart URL
+	mediaType string
+}
+
+var (
+	provenanceSibling = sibling{suffix: ".prov", mediaType: helmregistry.ProvLayerMediaType}
+	signatureSibling  = sibling{suffix: ".sig", mediaType: SignatureLayerMediaType}
+)
+
+// Valid tells whether the policy is known.
+func (p SiblingPolicy) Valid() bool {
+	switch p {
+	case SiblingsNone, SiblingsProvenance, SiblingsAll:
+		return true
+	}
+	return false
+}
+
+func (p SiblingPolicy) siblings() []sibling {
+	switch p {
+	case SiblingsProvenance:
+		return []sibling{provenanceSibling}
+	case SiblingsAll:
+		return []sibling{provenanceSibling, signatureSibling}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// SimpleSigningMediaType is the media type of cosign signature payloads
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// SignatureAnnotation holds the base64 encoded signature of the payload
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// LoadSigningKey reads a PEM encoded ECDSA, Ed25519 or RSA private key.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// signatureTag returns the tag cosign looks up the signature of a manifest digest at.
+func signatureTag(manifestDigest string) string {
+	return strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+}
+
+// signManifest signs the generated manifest with the configured key and stores the signature cosign style,
+// as manifest tagged sha256-<digest>.sig, so consumers can verify the chart came through the proxy with `cosign verify --key`.
+func (m *Manifests) signManifest(ctx context.Context, repo string, ma Manifest) error {
+	if m.config.Signer == nil {
+		return nil
+	}
+	rd := sha256.Sum256(ma.Blob)
+	manifestDigest := "sha256:" + hex.EncodeToString(rd[:])
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": repo},
+			"image":    map[string]string{"docker-manifest-digest": manifestDigest},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	})
+	if err != nil {
+		return err
+	}
+	signature, err := sign(m.config.Signer, payload)
+	if err != nil {
+		return err
+	}
+
+	putHandler := m.blobHandler.(handler.BlobPutHandler)
+	configData := []byte("{}")
+	config := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+	layer := ocispec.Descriptor{
+		MediaType: SimpleSigningMediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			SignatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+		},
+	}
+	for _, blob := range []struct {
+		desc ocispec.Descriptor
+		data []byte
+	}{{config, configData}, {layer, payload}} {
+		h, err := v1.NewHash(blob.desc.Digest.String())
+		if err != nil {
+			return err
+		}
+		if err = putHandler.Put(ctx, "", h, io.NopCloser(bytes.NewReader(blob.data))); err != nil {
+			return err
+		}
+	}
+
+	blob, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		return err
+	}
+	sig := Manifest{
+		ContentType: ocispec.MediaTypeImageManifest,
+		Blob:        blob,
+		Refs:        []string{config.Digest.String(), layer.Digest.String()},
+		CreatedAt:   time.Now(),
+	}
+	if err = m.Write(repo, digest.FromBytes(blob).String(), sig); err != nil {
+		return err
+	}
+	return m.Write(repo, signatureTag(manifestDigest), sig)
+}
+
+// sign signs the payload, Ed25519 keys sign the payload itself, other keys its SHA-256 digest.
+func sign(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	sum := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
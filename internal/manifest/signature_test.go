@@ -0,0 +1,94 @@
+package manifest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSignManifest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManifests(t, Config{Signer: key})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	if err := m.prepareChart(context.Background(), "charts.example.com/app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	chartDigest := m.digests["charts.example.com/app"]["1.0.0"].Digest
+	sig, ok := m.manifests["charts.example.com/app"][signatureTag(chartDigest)]
+	if !ok {
+		t.Fatalf("no signature at %s", signatureTag(chartDigest))
+	}
+
+	var manifest ocispec.Manifest
+	if err = json.Unmarshal(sig.Blob, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != SimpleSigningMediaType {
+		t.Fatalf("got signature layers %v", manifest.Layers)
+	}
+	h, err := v1.NewHash(manifest.Layers[0].Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), chartDigest) {
+		t.Errorf("payload %s doesn't name the chart manifest %s", payload, chartDigest)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[SignatureAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(&key.PublicKey, sum[:], signature) {
+		t.Error("signature doesn't verify")
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(signer.Public()) {
+		t.Error("loaded a different key")
+	}
+}
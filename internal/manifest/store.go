@@ -0,0 +1,233 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/metrics"
+	"github.com/dgraph-io/badger/v3"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"strings"
+)
+
+// ManifestStore persists cached manifests, so they survive restarts.
+// It only makes sense together with a persistent blob handler, manifests with missing blobs aren't loaded.
+type ManifestStore interface {
+	// Load returns all persisted manifests, mapping repo -> tag/digest -> Manifest
+	Load() (map[string]map[string]Manifest, error)
+	Save(repo string, name string, ma Manifest) error
+	Delete(repo string, name string) error
+}
+
+// storeOp is a pending change of the ManifestStore, a nil manifest deletes.
+// An op with flushed set changes nothing, flushed is closed once the changes queued before it are applied.
+type storeOp struct {
+	repo    string
+	name    string
+	ma      *Manifest
+	flushed chan struct{}
+}
+
+// storeQueueSize bounds the changes waiting to be persisted
+const storeQueueSize = 4096
+
+// persist queues saving the manifest, the caller must hold the lock.
+func (m *Manifests) persist(repo string, name string, ma Manifest) {
+	m.queueStoreOp(storeOp{repo: repo, name: name, ma: &ma})
+}
+
+// unpersist queues deleting the manifest, the caller must hold the lock.
+func (m *Manifests) unpersist(repo string, name string) {
+	m.queueStoreOp(storeOp{repo: repo, name: name})
+}
+
+func (m *Manifests) queueStoreOp(op storeOp) {
+	if m.storeOps == nil {
+		return
+	}
+	select {
+	case m.storeOps <- op:
+	default:
+		// never block requests on the store, the manifest expires like any other
+		metrics.ManifestStoreDrops.Inc()
+		m.log.Printf("manifest store queue full, dropping change of %s:%s\n", op.repo, op.name)
+	}
+}
+
+// runStore applies the queued changes in order until ctx is done, then the ones still queued.
+func (m *Manifests) runStore(ctx context.Context) {
+	defer close(m.storeStopped)
+	for {
+		select {
+		case op := <-m.storeOps:
+			m.applyStoreOp(op)
+		case <-ctx.Done():
+			m.drainStore()
+			return
+		}
+	}
+}
+
+// Flush applies the changes queued for the ManifestStore, it must be called before the store is closed.
+func (m *Manifests) Flush() {
+	if m.storeOps == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case m.storeOps <- storeOp{flushed: flushed}:
+		select {
+		case <-flushed:
+			return
+		case <-m.storeStopped:
+		}
+	case <-m.storeStopped:
+	}
+	// runStore is gone, nothing else takes changes off the queue
+	m.drainStore()
+}
+
+// drainStore applies the queued changes until the queue is empty.
+func (m *Manifests) drainStore() {
+	for {
+		select {
+		case op := <-m.storeOps:
+			m.applyStoreOp(op)
+		default:
+			return
+		}
+	}
+}
+
+func (m *Manifests) applyStoreOp(op storeOp) {
+	if op.flushed != nil {
+		close(op.flushed)
+		return
+	}
+	var err error
+	if op.ma != nil {
+		err = m.config.Store.Save(op.repo, op.name, *op.ma)
+	} else {
+		err = m.config.Store.Delete(op.repo, op.name)
+	}
+	if err != nil {
+		m.log.Printf("manifest store %s:%s: %v\n", op.repo, op.name, err)
+	}
+}
+
+// loadStore fills the cache with the persisted manifests whose blobs are still stored, the others are deleted from the store.
+// They are deleted right away rather than queued, after a restart with blobs in memory every persisted manifest is stale,
+// which would overflow the queue nothing takes changes off yet.
+func (m *Manifests) loadStore(ctx context.Context) error {
+	persisted, err := m.config.Store.Load()
+	if err != nil {
+		return err
+	}
+	var stale []storeOp
+	m.lock.Lock()
+	for repo, mRepo := range persisted {
+		for name, ma := range mRepo {
+			if !m.blobsStored(ctx, ma.Refs) {
+				stale = append(stale, storeOp{repo: repo, name: name})
+				continue
+			}
+			if _, ok := m.manifests[repo]; !ok {
+				m.manifests[repo] = map[string]Manifest{}
+				m.accessed[repo] = ma.CreatedAt
+			}
+			m.manifests[repo][name] = ma
+			m.recordDigest(repo, name, ma)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, op := range stale {
+		m.applyStoreOp(op)
+	}
+	return nil
+}
+
+// BadgerStore is a ManifestStore in a badger database.
+type BadgerStore struct {
+	db *badger.DB
+}
+
+// NewBadgerStore opens the badger database at path.
+func NewBadgerStore(path string) (*BadgerStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerStore{db: db}, nil
+}
+
+// keys are repo and name separated by a NUL byte, which can't be part of either
+func storeKey(repo string, name string) []byte {
+	return []byte(repo + "\x00" + name)
+}
+
+func (s *BadgerStore) Load() (map[string]map[string]Manifest, error) {
+	res := map[string]map[string]Manifest{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			repo, name, ok := strings.Cut(string(it.Item().Key()), "\x00")
+			if !ok {
+				continue
+			}
+			var ma Manifest
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ma)
+			}); err != nil {
+				return err
+			}
+			if _, ok := res[repo]; !ok {
+				res[repo] = map[string]Manifest{}
+			}
+			res[repo][name] = ma
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *BadgerStore) Save(repo string, name string, ma Manifest) error {
+	data, err := json.Marshal(ma)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(storeKey(repo, name), data)
+	})
+}
+
+func (s *BadgerStore) Delete(repo string, name string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(storeKey(repo, name))
+	})
+}
+
+// Close closes the database.
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// blobsStored tells whether all referenced blobs are still stored, if the blob handler can tell.
+func (m *Manifests) blobsStored(ctx context.Context, refs []string) bool {
+	statHandler, ok := m.blobHandler.(handler.BlobStatHandler)
+	if !ok {
+		return true
+	}
+	for _, ref := range refs {
+		h, err := v1.NewHash(ref)
+		if err != nil {
+			return false
+		}
+		if _, err = statHandler.Stat(ctx, "", h); err != nil && !blobs.IsRedirect(err) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBadgerStoreRoundTrip(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ma := Manifest{ContentType: "application/json", Blob: []byte("{}"), Refs: []string{"sha256:abc"}, CreatedAt: time.Now().Round(0)}
+	for _, name := range []string{"1.0.0", "2.0.0"} {
+		if err = store.Save("example.com/charts/one", name, ma); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.Delete("example.com/charts/one", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded["example.com/charts/one"]) != 1 {
+		t.Fatalf("got %v, want only 1.0.0", loaded)
+	}
+	got := loaded["example.com/charts/one"]["1.0.0"]
+	if !bytes.Equal(got.Blob, ma.Blob) || got.ContentType != ma.ContentType || !got.CreatedAt.Equal(ma.CreatedAt) || len(got.Refs) != 1 {
+		t.Errorf("got %+v, want %+v", got, ma)
+	}
+}
+
+func TestLoadStoreSkipsManifestsWithMissingBlobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewBadgerStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	blobHandler := mem.NewMemHandler()
+	layer := []byte("chart")
+	sum := sha256.Sum256(layer)
+	stored := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+	if err = blobHandler.Put(ctx, "", stored, io.NopCloser(bytes.NewReader(layer))); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := "example.com/charts/one"
+	if err = store.Save(repo, "1.0.0", Manifest{Blob: []byte("{}"), Refs: []string{stored.String()}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	missing := "sha256:" + hex.EncodeToString(make([]byte, 32))
+	if err = store.Save(repo, "2.0.0", Manifest{Blob: []byte("{}"), Refs: []string{missing}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManifests(ctx, blobHandler, Config{Store: store}, newMapCache(), log.New(io.Discard, "", 0))
+
+	if _, ok := m.lookup(repo, "1.0.0"); !ok {
+		t.Error("persisted manifest with stored blobs was not loaded")
+	}
+	if _, ok := m.lookup(repo, "2.0.0"); ok {
+		t.Error("persisted manifest with a missing blob was loaded")
+	}
+
+	// the skipped manifest is deleted from the store while loading
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded[repo]["2.0.0"]; ok {
+		t.Error("manifest with a missing blob was not deleted from the store")
+	}
+}
+
+func TestLoadStoreDeletesStaleManifestsBeyondQueue(t *testing.T) {
+	// after a restart with blobs in memory, every persisted manifest is stale
+	missing := "sha256:" + hex.EncodeToString(make([]byte, 32))
+	store := &recordingStore{persisted: map[string]map[string]Manifest{"charts.example.com/app": {}}}
+	for i := 0; i < storeQueueSize+10; i++ {
+		store.persisted["charts.example.com/app"][fmt.Sprintf("1.0.%d", i)] = Manifest{Refs: []string{missing}, CreatedAt: time.Now()}
+	}
+	m := newTestManifests(t, Config{Store: store})
+
+	if n := m.countManifests(); n != 0 {
+		t.Errorf("got %d stale manifests loaded", n)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if n := len(store.deleted); n != storeQueueSize+10 {
+		t.Errorf("got %d stale manifests deleted, want %d", n, storeQueueSize+10)
+	}
+}
+
+func TestWarmPersistsManifests(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewBadgerStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like registry warm without --serve, which returns without its context getting done
+	m := NewManifests(context.Background(), mem.NewMemHandler(), Config{Store: store}, newMapCache(), log.New(io.Discard, "", 0))
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+	if err = m.Warm(context.Background(), "charts.example.com/app:1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	m.Flush()
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err = NewBadgerStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded["charts.example.com/app"]["1.0.0"]; !ok {
+		t.Errorf("warmed manifest not persisted, got %v", loaded)
+	}
+}
+
+func TestFlushAfterShutdown(t *testing.T) {
+	store := &recordingStore{}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewManifests(ctx, mem.NewMemHandler(), Config{Store: store}, newMapCache(), log.New(io.Discard, "", 0))
+	cancel()
+	<-m.storeStopped
+
+	if err := m.Write("charts.example.com/app", "1.0.0", Manifest{Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	m.Flush()
+	if len(store.saved) != 1 {
+		t.Errorf("got %d manifests saved, want the one written after shutdown", len(store.saved))
+	}
+}
+
+// recordingStore is a ManifestStore loading the persisted manifests, recording the saved and deleted ones.
+type recordingStore struct {
+	lock      sync.Mutex
+	persisted map[string]map[string]Manifest
+	saved     []string
+	deleted   []string
+}
+
+func (s *recordingStore) Load() (map[string]map[string]Manifest, error) {
+	return s.persisted, nil
+}
+
+func (s *recordingStore) Save(repo string, name string, _ Manifest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saved = append(s.saved, repo+":"+name)
+	return nil
+}
+
+func (s *recordingStore) Delete(repo string, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deleted = append(s.deleted, repo+":"+name)
+	return nil
+}
@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheTTLOverride returns the TTL configured for the repo by CacheTTLOverrides.
+// Overrides are keyed by lower case host, with or without path, the longest one matching whole elements of the repo wins.
+func (m *Manifests) cacheTTLOverride(repo string) (time.Duration, bool) {
+	repo = strings.ToLower(repo)
+	var ttl time.Duration
+	var match string
+	for prefix, d := range m.config.CacheTTLOverrides {
+		prefix = strings.Trim(strings.ToLower(prefix), "/")
+		if repo != prefix && !strings.HasPrefix(repo, prefix+"/") {
+			continue
+		}
+		if len(prefix) > len(match) {
+			ttl, match = d, prefix
+		}
+	}
+	return ttl, match != ""
+}
+
+// indexCacheTTL returns for how long the index of the repo is cached, IndexCacheTTL unless overridden.
+func (m *Manifests) indexCacheTTL(repoURLPath string) time.Duration {
+	if ttl, ok := m.cacheTTLOverride(repoURLPath); ok {
+		return ttl
+	}
+	return m.config.IndexCacheTTL
+}
+
+// manifestCacheTTL returns for how long the manifests of the repo are cached, CacheTTL unless overridden.
+func (m *Manifests) manifestCacheTTL(repo string) time.Duration {
+	if ttl, ok := m.cacheTTLOverride(repo); ok {
+		return ttl
+	}
+	return m.config.CacheTTL
+}
+
+// indexRepo returns the repo the index URL belongs to, its host and path without the file.
+func indexRepo(indexURL string) string {
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return ""
+	}
+	return path.Dir(u.Host + u.Path)
+}
@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"sigs.k8s.io/yaml"
+)
+
+func TestCacheTTLOverrideIndex(t *testing.T) {
+	index, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(index)
+	}))
+	defer srv.Close()
+	// the same upstream under two hosts
+	overridden := strings.TrimPrefix(srv.URL, "http://")
+	other := strings.Replace(overridden, "127.0.0.1", "localhost", 1)
+
+	cache := &ttlCache{mapCache: newMapCache()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManifests(ctx, mem.NewMemHandler(), Config{
+		UpstreamSchemes:   map[string]string{overridden: "http", other: "http"},
+		IndexCacheTTL:     time.Hour,
+		CacheTTLOverrides: map[string]time.Duration{overridden: time.Minute},
+	}, cache, log.New(io.Discard, "", 0))
+
+	for host, want := range map[string]time.Duration{overridden: time.Minute, other: time.Hour} {
+		if _, err := m.GetIndex(context.Background(), host); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{host, "http://" + host + "/index.yaml"} {
+			if ttl, _ := cache.ttls.Load(key); ttl != want {
+				t.Errorf("%s cached for %v, want %s", key, ttl, want)
+			}
+		}
+	}
+}
+
+func TestCacheTTLOverrideManifests(t *testing.T) {
+	m := newTestManifests(t, Config{
+		CacheTTL: time.Hour,
+		CacheTTLOverrides: map[string]time.Duration{
+			"charts.example.com":        time.Minute,
+			"charts.example.com/stable": 2 * time.Hour,
+		},
+	})
+	created := time.Now().Add(-10 * time.Minute)
+	for _, repo := range []string{"charts.example.com/app", "charts.example.com/stable/app", "other.example.com/app"} {
+		if err := m.Write(repo, "1.0.0", Manifest{ContentType: "application/json", Blob: []byte("{}"), CreatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.cleanup(context.Background())
+	for repo, want := range map[string]bool{
+		"charts.example.com/app":        false,
+		"charts.example.com/stable/app": true,
+		"other.example.com/app":         true,
+	} {
+		if _, ok := m.lookup(repo, "1.0.0"); ok != want {
+			t.Errorf("%s cached: got %v, want %v", repo, ok, want)
+		}
+	}
+}
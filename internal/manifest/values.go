@@ -0,0 +1,39 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ValuesLayerMediaType is the media type of the chart's default values, packed next to the chart with EXPOSE_VALUES_LAYER
+const ValuesLayerMediaType = "application/vnd.container-registry.helm.chart.values.v1.yaml"
+
+// errNoValues is returned for charts without values.yaml
+var errNoValues = errors.New("chart has no values.yaml")
+
+// extractValuesYAML returns the values.yaml at the top level of the chart archive.
+func extractValuesYAML(chartData []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(chartData))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, errNoValues
+		}
+		if err != nil {
+			return nil, err
+		}
+		// archives hold a single chart directory, values of subcharts are deeper
+		if dir, name, ok := strings.Cut(strings.TrimPrefix(h.Name, "./"), "/"); ok && dir != "" && name == "values.yaml" {
+			return io.ReadAll(tr)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package manifest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/repo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// versionIndexCacheResp is a built version index, valid while the upstream index it was built from is the cached one.
+type versionIndexCacheResp struct {
+	index *repo.IndexFile
+	ma    Manifest
+}
+
+// versionIndexKey returns the cache key of the version index of the repo, which can't collide with index keys.
+func versionIndexKey(repo string) string {
+	return "version-index:" + repo
+}
+
+// versionIndex builds an OCI image index of the chart versions listed in the upstream index.
+// Every entry points to the version's manifest and is annotated with its version,
+// so clients can discover available versions with the standard index type.
+// Only versions whose manifest is cached are listed, nothing gets downloaded to build it.
+// The built index is cached until the upstream index changes, a manifest of the repo is written or CacheTTL passes.
+func (m *Manifests) versionIndex(ctx context.Context, repo string) (Manifest, *errors.RegError) {
+	elem := strings.Split(repo, "/")
+	if len(elem) < 2 {
+		return Manifest{}, errors.RegErrInternal(fmt.Errorf("invalid repo length"))
+	}
+	path := strings.Join(elem[:len(elem)-1], "/")
+	chart := elem[len(elem)-1]
+
+	index, err := m.GetIndex(ctx, path)
+	if err != nil {
+		if regErr := failedDownload(err); regErr != nil {
+			return Manifest{}, regErr
+		}
+		return Manifest{}, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("index file fetch error: %s", path),
+		}
+	}
+	versions, ok := index.Entries[chart]
+	if !ok {
+		return Manifest{}, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("Chart: %s not found", chart),
+		}
+	}
+
+	key := versionIndexKey(repo)
+	if c, ok := m.cache.Get(key); ok {
+		if res, ok := c.(*versionIndexCacheResp); ok && res.index == index {
+			return res.ma, nil
+		}
+	}
+
+	idx := ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+
+	for _, v := range versions {
+		tag := chartTag(v.Version)
+		ma, ok := m.lookup(repo, tag)
+		if !ok {
+			// not pulled yet, or expired
+			continue
+		}
+		rd := sha256.Sum256(ma.Blob)
+		idx.Manifests = append(idx.Manifests, ocispec.Descriptor{
+			MediaType: ma.ContentType,
+			Digest:    digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(rd[:])),
+			Size:      int64(len(ma.Blob)),
+			Annotations: map[string]string{
+				ocispec.AnnotationRefName: m.listedTag(v.Version),
+				ocispec.AnnotationVersion: v.Version,
+			},
+		})
+	}
+
+	blob, err := json.Marshal(idx)
+	if err != nil {
+		return Manifest{}, errors.RegErrInternal(err)
+	}
+	ma := Manifest{
+		ContentType: ocispec.MediaTypeImageIndex,
+		Blob:        blob,
+	}
+	m.cache.SetWithTTL(key, &versionIndexCacheResp{index: index, ma: ma}, int64(len(blob)), m.manifestCacheTTL(repo))
+	return ma, nil
+}
+
+// revalidate checks that the version of a cached manifest older than RevalidateMaxAge is still listed in the upstream index.
+// Versions removed upstream are dropped from the cache and prepared again, which fails unless they can be found elsewhere.
+func (m *Manifests) revalidate(ctx context.Context, repo string, target string, ma Manifest) (Manifest, *errors.RegError) {
+	if m.config.RevalidateMaxAge <= 0 || time.Since(ma.CreatedAt) < m.config.RevalidateMaxAge ||
+		strings.HasPrefix(target, "sha256:") || m.isOCIUpstream(repo) {
+		return ma, nil
+	}
+	if m.versionListed(ctx, repo, target) {
+		return ma, nil
+	}
+	m.forget(repo, target)
+
+	if err := m.prepare(ctx, repo, target); err != nil {
+		return Manifest{}, err
+	}
+	ma, ok := m.lookup(repo, target)
+	if !ok {
+		return Manifest{}, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NOT FOUND",
+			Message: fmt.Sprintf("Chart prepare's result not found: %v, %v", repo, target),
+		}
+	}
+	return ma, nil
+}
+
+// versionListed tells whether the upstream index still lists the chart version.
+// If the index can't be fetched the version is assumed to be listed, to keep serving cached charts while the upstream is down.
+func (m *Manifests) versionListed(ctx context.Context, repo string, version string) bool {
+	elem := strings.Split(repo, "/")
+	if len(elem) < 2 {
+		return false
+	}
+	index, err := m.GetIndex(ctx, strings.Join(elem[:len(elem)-1], "/"))
+	if err != nil {
+		return true
+	}
+	_, err = findVersion(index, elem[len(elem)-1], version)
+	return err == nil
+}
+
+// resolveLatest returns the tag of the highest version of the chart listed in the upstream index.
+func (m *Manifests) resolveLatest(ctx context.Context, repo string) (string, *errors.RegError) {
+	elem := strings.Split(repo, "/")
+	if len(elem) < 2 {
+		return "", errors.RegErrInternal(fmt.Errorf("invalid repo length"))
+	}
+	path := strings.Join(elem[:len(elem)-1], "/")
+	index, err := m.GetIndex(ctx, path)
+	if err != nil {
+		if regErr := failedDownload(err); regErr != nil {
+			return "", regErr
+		}
+		return "", &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NAME_UNKNOWN",
+			Message: fmt.Sprintf("index file fetch error: %s", path),
+		}
+	}
+	v, err := latestVersion(index, elem[len(elem)-1], m.config.AllowPrereleaseLatest)
+	if err != nil {
+		return "", &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "MANIFEST_UNKNOWN",
+			Message: err.Error(),
+		}
+	}
+	return chartTag(v.Version), nil
+}
@@ -0,0 +1,144 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testIndex(name string, versions ...string) *repo.IndexFile {
+	i := repo.NewIndexFile()
+	for _, v := range versions {
+		i.Entries[name] = append(i.Entries[name], &repo.ChartVersion{
+			Metadata: &chart.Metadata{Name: name, Version: v},
+			URLs:     []string{name + "-" + v + ".tgz"},
+		})
+	}
+	i.SortEntries()
+	return i
+}
+
+func TestRevalidateRemovedVersion(t *testing.T) {
+	m := newTestManifests(t, Config{RevalidateMaxAge: time.Minute})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+
+	stale := Manifest{Blob: []byte("{}"), CreatedAt: time.Now().Add(-time.Hour)}
+	if err := m.Write("charts.example.com/app", "1.0.0", stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write("charts.example.com/app", "2.0.0", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.revalidate(context.Background(), "charts.example.com/app", "1.0.0", stale); err != nil {
+		t.Errorf("revalidate listed version: %v", err)
+	}
+
+	_, err := m.revalidate(context.Background(), "charts.example.com/app", "2.0.0", stale)
+	if err == nil || err.Status != http.StatusNotFound {
+		t.Fatalf("revalidate removed version: got %v, want 404", err)
+	}
+	if _, ok := m.manifests["charts.example.com/app"]["2.0.0"]; ok {
+		t.Error("removed version is still cached")
+	}
+}
+
+func TestRevalidateFreshManifest(t *testing.T) {
+	m := newTestManifests(t, Config{RevalidateMaxAge: time.Minute})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+
+	fresh := Manifest{Blob: []byte("{}"), CreatedAt: time.Now()}
+	if _, err := m.revalidate(context.Background(), "charts.example.com/app", "2.0.0", fresh); err != nil {
+		t.Errorf("fresh manifest got revalidated: %v", err)
+	}
+}
+
+// noDownloads is a transport failing the test on any upstream request.
+type noDownloads struct{ t *testing.T }
+
+func (n noDownloads) RoundTrip(req *http.Request) (*http.Response, error) {
+	n.t.Errorf("unexpected upstream request %s", req.URL)
+	return nil, fmt.Errorf("no downloads")
+}
+
+func versionIndexOf(t *testing.T, m *Manifests) ocispec.Index {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("Content-Type"); got != ocispec.MediaTypeImageIndex {
+		t.Errorf("got content type %s, want %s", got, ocispec.MediaTypeImageIndex)
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(rec.Body.Bytes(), &idx); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestVersionIndexListsCachedVersions(t *testing.T) {
+	m := newTestManifests(t, Config{VersionIndex: true, Client: &http.Client{Transport: noDownloads{t}}})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0", "1.1.0", "2.0.0")}, 1, time.Hour)
+	cached := Manifest{ContentType: ocispec.MediaTypeImageManifest, Blob: []byte(`{"schemaVersion":2}`), CreatedAt: time.Now()}
+	if err := m.Write("charts.example.com/app", "1.1.0", cached); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := versionIndexOf(t, m)
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("got %d manifests, want the cached 1.1.0 only", len(idx.Manifests))
+	}
+	desc := idx.Manifests[0]
+	if desc.Digest.String() != manifestDigest(cached) || desc.Size != int64(len(cached.Blob)) || desc.MediaType != cached.ContentType {
+		t.Errorf("got descriptor %+v, want the one of the cached manifest", desc)
+	}
+	if desc.Annotations[ocispec.AnnotationVersion] != "1.1.0" || desc.Annotations[ocispec.AnnotationRefName] != "1.1.0" {
+		t.Errorf("got annotations %v, want version 1.1.0", desc.Annotations)
+	}
+
+	// pulling another version lists it right away
+	if err := m.Write("charts.example.com/app", "2.0.0", cached); err != nil {
+		t.Fatal(err)
+	}
+	if idx = versionIndexOf(t, m); len(idx.Manifests) != 2 {
+		t.Errorf("got %d manifests after pulling 2.0.0, want 2", len(idx.Manifests))
+	}
+}
+
+func TestVersionIndexCached(t *testing.T) {
+	m := newTestManifests(t, Config{VersionIndex: true})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+	if err := m.Write("charts.example.com/app", "1.0.0", Manifest{Blob: []byte("{}"), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	versionIndexOf(t, m)
+	c, ok := m.cache.Get(versionIndexKey("charts.example.com/app"))
+	if !ok {
+		t.Fatal("version index not cached")
+	}
+
+	// a refreshed upstream index builds it again
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0", "1.1.0")}, 1, time.Hour)
+	versionIndexOf(t, m)
+	if again, _ := m.cache.Get(versionIndexKey("charts.example.com/app")); again == c {
+		t.Error("version index of the old upstream index served")
+	}
+}
+
+func TestVersionIndexRequireExplicitVersion(t *testing.T) {
+	m := newTestManifests(t, Config{VersionIndex: true, RequireExplicitVersion: true})
+	m.cache.SetWithTTL("charts.example.com", &indexCacheResp{c: testIndex("app", "1.0.0")}, 1, time.Hour)
+
+	// listing versions is what an empty reference means with the version index
+	if idx := versionIndexOf(t, m); len(idx.Manifests) != 0 {
+		t.Errorf("got %d manifests, want none cached", len(idx.Manifests))
+	}
+}
@@ -0,0 +1,99 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"helm.sh/helm/v3/pkg/repo"
+	"net/url"
+	"strings"
+)
+
+// MergePolicy defines how the indexes of a virtual repo are merged when they list the same chart.
+type MergePolicy string
+
+const (
+	// MergeOverride takes the versions of the chart from the repo listed last
+	MergeOverride MergePolicy = "override"
+	// MergeError fails the merged index
+	MergeError MergePolicy = "error"
+)
+
+// Valid tells whether the policy is known.
+func (p MergePolicy) Valid() bool {
+	switch p {
+	case MergeOverride, MergeError:
+		return true
+	}
+	return false
+}
+
+// virtualRepo returns the upstream paths whose indexes the repo merges, if it's a virtual repo.
+func (m *Manifests) virtualRepo(repoURLPath string) ([]string, bool) {
+	paths, ok := m.config.VirtualRepos[strings.ToLower(repoURLPath)]
+	return paths, ok
+}
+
+// downloadVirtualIndex merges the indexes of the upstream paths, each cached on its own like any other index.
+// Chart URLs are made absolute, as they can't be resolved against the virtual repo.
+func (m *Manifests) downloadVirtualIndex(ctx context.Context, paths []string) (*repo.IndexFile, error) {
+	indexes := make([]*repo.IndexFile, 0, len(paths))
+	for _, p := range paths {
+		index, err := m.GetIndex(ctx, p)
+		if err != nil {
+			// a partial index would hide the charts of the failing repo
+			return nil, fmt.Errorf("index of %s: %w", p, err)
+		}
+		base, err := url.Parse(m.upstreamURL(p, "index.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, absoluteURLs(index, base))
+	}
+	return mergeIndexes(m.config.VirtualRepoConflicts, indexes...)
+}
+
+// absoluteURLs returns a copy of the index with the chart URLs resolved against the URL of the index.
+// Cached indexes are shared, so the chart versions are copied too.
+func absoluteURLs(index *repo.IndexFile, base *url.URL) *repo.IndexFile {
+	res := repo.NewIndexFile()
+	res.Generated = index.Generated
+	for name, versions := range index.Entries {
+		copied := make(repo.ChartVersions, 0, len(versions))
+		for _, v := range versions {
+			if v == nil {
+				continue
+			}
+			cv := *v
+			cv.URLs = make([]string, len(v.URLs))
+			for i, u := range v.URLs {
+				cv.URLs[i] = u
+				if ref, err := url.Parse(u); err == nil {
+					cv.URLs[i] = base.ResolveReference(ref).String()
+				}
+			}
+			copied = append(copied, &cv)
+		}
+		res.Entries[name] = copied
+	}
+	return res
+}
+
+// mergeIndexes merges the entries of the indexes into a new one.
+// A chart listed by several of them is taken from the last one with MergeOverride, or fails the merge with MergeError.
+// An empty policy overrides.
+func mergeIndexes(policy MergePolicy, indexes ...*repo.IndexFile) (*repo.IndexFile, error) {
+	res := repo.NewIndexFile()
+	for _, index := range indexes {
+		for name, versions := range index.Entries {
+			if _, ok := res.Entries[name]; ok && policy == MergeError {
+				return nil, fmt.Errorf("chart %s is listed by more than one repo", name)
+			}
+			res.Entries[name] = versions
+		}
+		if index.Generated.After(res.Generated) {
+			res.Generated = index.Generated
+		}
+	}
+	res.SortEntries()
+	return res, nil
+}
@@ -0,0 +1,93 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestMergeIndexes(t *testing.T) {
+	first := testIndex("app", "1.0.0", "1.1.0")
+	first.Entries["base"] = testIndex("base", "0.1.0").Entries["base"]
+	second := testIndex("app", "2.0.0")
+
+	merged, err := mergeIndexes(MergeOverride, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(merged.Entries["app"]); got != 1 {
+		t.Errorf("got %d versions of app, want the one of the repo listed last", got)
+	}
+	if _, err = findVersion(merged, "app", "2.0.0"); err != nil {
+		t.Error(err)
+	}
+	if _, err = findVersion(merged, "base", "0.1.0"); err != nil {
+		t.Error(err)
+	}
+	if len(first.Entries["app"]) != 2 {
+		t.Error("merged index modified")
+	}
+
+	if _, err = mergeIndexes(MergeError, first, second); err == nil || !strings.Contains(err.Error(), "app") {
+		t.Errorf("got %v, want the conflict on app reported", err)
+	}
+}
+
+func TestVirtualRepoResolvesSecondIndex(t *testing.T) {
+	infra, err := yaml.Marshal(testIndex("base", "0.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps, err := yaml.Marshal(testIndex("app", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"/infra/index.yaml":   infra,
+		"/apps/index.yaml":    apps,
+		"/apps/app-1.0.0.tgz": testChart(t, testChartYAML, nil),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	m := newTestManifests(t, Config{
+		UpstreamSchemes: map[string]string{host: "http"},
+		VirtualRepos:    map[string][]string{"platform": {host + "/infra", host + "/apps"}},
+	})
+
+	index, err := m.GetIndex(context.Background(), "platform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := findVersion(index, "app", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/apps/app-1.0.0.tgz"; v.URLs[0] != want {
+		t.Errorf("got chart URL %s, want %s resolved against its own index", v.URLs[0], want)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/platform/app/manifests/1.0.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("platform/app", "1.0.0"); !ok {
+		t.Error("chart of the second index not cached under the virtual repo")
+	}
+
+	err = m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/platform/nested/app/manifests/1.0.0", nil))
+	if err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("got %v for a nested repo, want NAME_UNKNOWN", err)
+	}
+}
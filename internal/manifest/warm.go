@@ -0,0 +1,40 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Warm pulls the manifest of a chart the way a client pull does, so the manifest and its blobs are cached before the first real pull.
+// References are repo/chart[:version], without a version the latest one gets pulled.
+func (m *Manifests) Warm(ctx context.Context, ref string) error {
+	repo, version := ref, LatestTag
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, version = ref[:i], ref[i+1:]
+	}
+	if strings.Count(repo, "/") < 1 || version == "" {
+		return fmt.Errorf("invalid chart reference %q, expected repo/chart[:version]", ref)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("/v2/%s/manifests/%s", repo, version), nil)
+	if err != nil {
+		return err
+	}
+	return m.Handle(discardResponse{header: http.Header{}}, req)
+}
+
+// discardResponse is a http.ResponseWriter dropping whatever gets written.
+type discardResponse struct {
+	header http.Header
+}
+
+func (r discardResponse) Header() http.Header {
+	return r.header
+}
+
+func (r discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r discardResponse) WriteHeader(int) {}
@@ -0,0 +1,46 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestWarm(t *testing.T) {
+	for _, ref := range []string{"charts.example.com/app:1.0.0", "charts.example.com/app"} {
+		m := newTestManifests(t, Config{})
+		serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+		if err := m.Warm(context.Background(), ref); err != nil {
+			t.Fatalf("warm %s: %v", ref, err)
+		}
+		ma, ok := m.lookup("charts.example.com/app", "1.0.0")
+		if !ok {
+			t.Fatalf("warm %s: manifest not cached", ref)
+		}
+		for _, d := range manifestRefs(ma.Blob) {
+			h, err := v1.NewHash(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := m.blobHandler.Get(context.Background(), "", h)
+			if err != nil {
+				t.Errorf("warm %s: blob %s not cached: %v", ref, d, err)
+				continue
+			}
+			rc.Close()
+		}
+	}
+}
+
+func TestWarmFails(t *testing.T) {
+	m := newTestManifests(t, Config{})
+	serveCharts(t, m, map[string][]byte{"/app-1.0.0.tgz": testChart(t, testChartYAML, nil)})
+
+	for _, ref := range []string{"charts.example.com/app:2.0.0", "charts.example.com/other", "app", "charts.example.com/app:"} {
+		if err := m.Warm(context.Background(), ref); err == nil {
+			t.Errorf("warm %s: got no error", ref)
+		}
+	}
+}
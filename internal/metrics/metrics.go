@@ -0,0 +1,70 @@
+// Package metrics holds the Prometheus metrics of the proxy.
+package metrics
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	UpstreamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_bytes_total",
+		Help: "Bytes downloaded from upstream hosts.",
+	}, []string{"host"})
+	// layer is "parsed" for parsed indexes and "raw" for downloaded index files
+	IndexCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_index_cache_hits_total",
+		Help: "Index lookups served from the cache.",
+	}, []string{"layer"})
+	IndexCacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_index_cache_misses_total",
+		Help: "Index lookups which missed the cache.",
+	}, []string{"layer"})
+	ChartPrepares = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_chart_prepare_total",
+		Help: "Charts prepared from upstream by result: ok, notfound or error.",
+	}, []string{"result"})
+	ChartPrepareDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_chart_prepare_duration_seconds",
+		Help:    "Time to download and pack a chart.",
+		Buckets: prometheus.DefBuckets,
+	})
+	CachedManifests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_cached_manifests",
+		Help: "Manifests in the cache, counting tags and digests.",
+	})
+	// reason is "repos" for MaxRepos and "manifests" for MaxManifests evictions
+	ManifestEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_manifest_evictions_total",
+		Help: "Manifests evicted from the cache before expiring.",
+	}, []string{"reason"})
+	ManifestStoreDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_manifest_store_drops_total",
+		Help: "Manifest changes not persisted as the manifest store queue was full.",
+	})
+)
+
+// ObservePrepare records a chart preparation started at start.
+func ObservePrepare(start time.Time, result string) {
+	ChartPrepares.WithLabelValues(result).Inc()
+	ChartPrepareDuration.Observe(time.Since(start).Seconds())
+}
+
+// CountReader counts the bytes read from r as downloaded from the upstream host.
+func CountReader(r io.Reader, host string) io.Reader {
+	return &countingReader{r: r, counter: UpstreamBytes.WithLabelValues(host)}
+}
+
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountReader(t *testing.T) {
+	before := testutil.ToFloat64(UpstreamBytes.WithLabelValues("charts.example.com"))
+
+	if _, err := io.ReadAll(CountReader(strings.NewReader("0123456789"), "charts.example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(UpstreamBytes.WithLabelValues("charts.example.com")) - before; got != 10 {
+		t.Errorf("got %v bytes counted, want 10", got)
+	}
+}
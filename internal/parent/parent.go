@@ -0,0 +1,45 @@
+// Package parent forwards pulls which can't be resolved locally to a parent
+// proxy or registry, so proxies can be chained into a tiered cache.
+package parent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Registry is a parent registry speaking the distribution API.
+type Registry struct {
+	base   string
+	client *http.Client
+}
+
+// New returns a parent registry for the given base URL, e.g. https://chartproxy.example.com
+func New(base string, client *http.Client) *Registry {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Registry{base: strings.TrimSuffix(base, "/"), client: client}
+}
+
+// Get requests the given /v2/... path from the parent registry.
+// Any response other than 200 is returned as an error, otherwise the caller must close the body.
+func (r *Registry) Get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("parent registry %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"strings"
+)
+
+// BasicAuth requires clients to authenticate with one of the users, mapped to their passwords.
+// Unauthenticated requests get a 401 with a Basic challenge for the realm, /v2/ included so registry logins work.
+// Without users every request is allowed.
+func BasicAuth(users map[string]string, realm string) Option {
+	return func(r *Registry) {
+		if len(users) > 0 {
+			r.users = users
+			r.realm = realm
+		}
+	}
+}
+
+// authenticate checks the Basic credentials of the request, or its Bearer token with TokenAuth.
+// It returns nil if they are valid or no users are configured.
+func (r *Registry) authenticate(req *http.Request) *errors.RegError {
+	if r.users == nil {
+		return nil
+	}
+	if r.tokenKey != nil {
+		return r.authenticateToken(req)
+	}
+	if username, password, ok := req.BasicAuth(); ok && r.validCredentials(username, password) {
+		return nil
+	}
+	return r.basicChallenge()
+}
+
+// basicChallenge returns the 401 asking for Basic credentials.
+func (r *Registry) basicChallenge() *errors.RegError {
+	return &errors.RegError{
+		Status:  http.StatusUnauthorized,
+		Code:    "UNAUTHORIZED",
+		Message: "authentication required",
+		Header: http.Header{
+			"Www-Authenticate": {fmt.Sprintf("Basic realm=%q", r.realm)},
+			// clients check for it on /v2/ to tell they talk to a registry
+			"Docker-Distribution-Api-Version": {"registry/2.0"},
+		},
+	}
+}
+
+// validCredentials compares the password in constant time, hashed so the length doesn't leak either.
+func (r *Registry) validCredentials(username, password string) bool {
+	want, ok := r.users[username]
+	if !ok {
+		return false
+	}
+	got, expected := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(got[:], expected[:]) == 1
+}
+
+// authenticateAdmin checks the request carries the admin token as Bearer token, compared like passwords.
+func (r *Registry) authenticateAdmin(req *http.Request) *errors.RegError {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	got, expected := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(r.adminToken))
+	if ok && subtle.ConstantTimeCompare(got[:], expected[:]) == 1 {
+		return nil
+	}
+	return &errors.RegError{
+		Status:  http.StatusUnauthorized,
+		Code:    "UNAUTHORIZED",
+		Message: "admin token required",
+		Header:  http.Header{"Www-Authenticate": {"Bearer"}},
+	}
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusWriter records the status written, for the request log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// logRequest logs the handled request. Loggers with fields, like logrus with the JSON formatter,
+// get method, path, status, repo and latency as discrete fields, others a line of text.
+func (r *Registry) logRequest(req *http.Request, status int, start time.Time, msg string) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if fl, ok := r.log.(logrus.FieldLogger); ok {
+		entry := fl.WithFields(logrus.Fields{
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"status":     status,
+			"repo":       repoName(req.URL.Path),
+			"latency_ms": time.Since(start).Milliseconds(),
+		})
+		if status >= http.StatusBadRequest {
+			entry.Warn(msg)
+		} else {
+			entry.Info(msg)
+		}
+		return
+	}
+	if msg == "" {
+		r.log.Printf("%s - %s", req.Method, req.URL)
+		return
+	}
+	r.log.Printf("%s %s %d %s", req.Method, req.URL, status, msg)
+}
+
+// repoName returns the repository of a registry API path, empty for other paths.
+func repoName(path string) string {
+	elems := strings.Split(strings.Trim(path, "/"), "/")
+	for i, e := range elems {
+		if e != "v2" {
+			continue
+		}
+		for j := len(elems) - 2; j > i; j-- {
+			switch elems[j] {
+			case "manifests", "blobs", "tags", "referrers":
+				return strings.Join(elems[i+1:j], "/")
+			}
+		}
+	}
+	return ""
+}
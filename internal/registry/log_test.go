@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestJSONRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	notFound := func(resp http.ResponseWriter, req *http.Request) error {
+		return &errors.RegError{Status: http.StatusNotFound, Code: "NOT FOUND", Message: "no such chart"}
+	}
+	r := New(notFound, notFound, notFound, notFound, Logger(l))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/9.9.9", nil))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is no JSON: %v", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"method": "GET",
+		"path":   "/v2/charts.example.com/app/manifests/9.9.9",
+		"status": float64(http.StatusNotFound),
+		"repo":   "charts.example.com/app",
+		"msg":    "NOT FOUND no such chart",
+	} {
+		if line[k] != want {
+			t.Errorf("field %s: got %v, want %v", k, line[k], want)
+		}
+	}
+	if _, ok := line["latency_ms"]; !ok {
+		t.Error("missing latency_ms field")
+	}
+}
+
+func TestRepoName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v2/charts.example.com/app/manifests/1.0.0":      "charts.example.com/app",
+		"/v2/charts.example.com/sub/app/blobs/sha256:abc": "charts.example.com/sub/app",
+		"/v2/charts.example.com/app/tags/list":            "charts.example.com/app",
+		"/v2/":                                            "",
+		"/healthz":                                        "",
+	} {
+		if got := repoName(path); got != want {
+			t.Errorf("repoName(%s): got %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
+	"github.com/dgraph-io/ristretto"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// chartArchive packages a chart of the name and version, with only its Chart.yaml.
+func chartArchive(t *testing.T, name string, version string) []byte {
+	t.Helper()
+	chartYAML := "apiVersion: v2\nname: " + name + "\nversion: " + version + "\n"
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: name + "/Chart.yaml", Mode: 0644, Size: int64(len(chartYAML))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(tw, chartYAML); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPathPrefixPullsChart(t *testing.T) {
+	archive := chartArchive(t, "app", "1.0.0")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			_, _ = io.WriteString(w, "apiVersion: v1\nentries:\n  app:\n  - name: app\n    version: 1.0.0\n    apiVersion: v2\n    urls: [app-1.0.0.tgz]\n  - name: app\n    version: 0.9.0\n    apiVersion: v2\n    urls: [app-0.9.0.tgz]\n")
+		case "/app-1.0.0.tgz":
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1000, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := log.New(io.Discard, "", 0)
+	blobHandler := mem.NewMemHandler()
+	manifests := manifest.NewManifests(ctx, blobHandler, manifest.Config{UpstreamScheme: "http"}, cache, logger)
+	r := New(manifests.Handle, blobs.NewBlobs(blobHandler, blobs.Config{}, logger).Handle, manifests.HandleTags, manifests.HandleCatalog,
+		Logger(logger), PathPrefix("/charts/"))
+	mux := http.NewServeMux()
+	mux.Handle("/charts/", r)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s: got status %d: %s", path, resp.StatusCode, body)
+		}
+		return resp
+	}
+
+	var m ocispec.Manifest
+	if err := json.NewDecoder(get("/charts/v2/" + host + "/app/manifests/1.0.0").Body).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) == 0 {
+		t.Fatal("got a manifest without layers")
+	}
+	got, err := io.ReadAll(get("/charts/v2/" + host + "/app/blobs/" + m.Layers[0].Digest.String()).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, archive) {
+		t.Error("got a chart layer differing from the upstream chart")
+	}
+
+	link := get("/charts/v2/" + host + "/app/tags/list?n=1").Header.Get("Link")
+	if !strings.HasPrefix(link, "</charts/v2/"+host+"/app/tags/list?") {
+		t.Errorf("got next page link %q, want it below the prefix", link)
+	}
+}
@@ -1,14 +1,20 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,13 +22,40 @@ type Registry struct {
 	log logrus.StdLogger
 
 	// to operate blobs directly from registry
-	blobs Handler `json:"blobs"`
+	blobs Handler
 	//
-	manifests Handler `json:"manifests"`
+	manifests Handler
 	tags      Handler
 	catalog   Handler
+	index     Handler
+	archive   Handler
+	referrers Handler
+	metrics   http.Handler
 
-	debug bool
+	// served in debug mode only
+	debugIndex Handler
+	// served with the admin token only, nil means disabled
+	invalidate Handler
+	adminToken string
+
+	debug      bool
+	prettyJSON bool
+	indexOnly  bool
+	// stripped from request paths, for registries mounted below the site root
+	pathPrefix string
+
+	// caps concurrent requests, nil means unlimited
+	inflight chan struct{}
+	// checks readiness, nil means always ready
+	ready func(ctx context.Context) error
+	// users mapped to their passwords, nil means no authentication
+	users map[string]string
+	realm string
+	// signs the tokens of the token auth flow, nil means Basic auth
+	tokenKey     []byte
+	tokenTTL     time.Duration
+	tokenService string
+	tokenRealm   string
 }
 
 func (r *Registry) v2(resp http.ResponseWriter, req *http.Request) error {
@@ -36,12 +69,68 @@ func (r *Registry) v2(resp http.ResponseWriter, req *http.Request) error {
 	if req.URL.Path == "/api/systeminfo" || req.URL.Path == "/api/v2.0/systeminfo" {
 		return r.harborInfoHandler(resp)
 	}
+	if req.URL.Path == "/healthz" {
+		return r.healthHandler(resp, nil)
+	}
+	if req.URL.Path == "/readyz" {
+		var err error
+		if r.ready != nil {
+			err = r.ready(req.Context())
+		}
+		return r.healthHandler(resp, err)
+	}
+	if req.URL.Path == "/metrics" && r.metrics != nil {
+		r.metrics.ServeHTTP(resp, req)
+		return nil
+	}
+	if req.URL.Path == TokenPath && r.users != nil && r.tokenKey != nil {
+		return r.tokenHandler(resp, req)
+	}
+	if req.URL.Path == InvalidatePath && r.invalidate != nil {
+		// admin endpoints have their own token, registry users can't invalidate
+		if err := r.authenticateAdmin(req); err != nil {
+			return err
+		}
+		return r.invalidate(resp, req)
+	}
+	// probes and metrics stay open, whatever serves charts requires authentication
+	if err := r.authenticate(req); err != nil {
+		return err
+	}
+	if r.debug && r.debugIndex != nil && strings.HasPrefix(req.URL.Path, DebugIndexPath) {
+		return r.debugIndex(resp, req)
+	}
+	if r.index != nil && helper.IsIndex(req) {
+		return r.index(resp, req)
+	}
+	if r.archive != nil && helper.IsChartArchive(req) {
+		return r.archive(resp, req)
+	}
+	if r.indexOnly && !helper.IsV2(req) {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "UNSUPPORTED",
+			Message: "OCI endpoints are disabled, only index files are served",
+		}
+	}
+	if !helper.IsRegistryPath(req) {
+		// cheap and quiet rejection of scanner traffic
+		_ = (&errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    "NOT_FOUND",
+			Message: "Not found",
+		}).Write(resp)
+		return nil
+	}
 	if helper.IsBlob(req) {
 		return r.blobs(resp, req)
 	}
 	if helper.IsManifest(req) {
 		return r.manifests(resp, req)
 	}
+	if r.referrers != nil && helper.IsReferrers(req) {
+		return r.referrers(resp, req)
+	}
 	if helper.IsTags(req) {
 		return r.tags(resp, req)
 	}
@@ -68,7 +157,7 @@ func (r *Registry) versionHandler(resp http.ResponseWriter) error {
 		Version: "v2.0",
 	}
 	resp.WriteHeader(200)
-	if err := prettyEncode(res, resp); err != nil {
+	if err := r.encode(res, resp); err != nil {
 		return errors.RegErrInternal(err)
 	}
 	return nil
@@ -84,29 +173,81 @@ func (r *Registry) harborInfoHandler(resp http.ResponseWriter) error {
 		CurrentTime:   time.Now(),
 	}
 	resp.WriteHeader(200)
-	if err := prettyEncode(res, resp); err != nil {
+	if err := r.encode(res, resp); err != nil {
 		return errors.RegErrInternal(err)
 	}
 	return nil
 }
 
+// healthz and readyz, plain text for probes
+func (r *Registry) healthHandler(resp http.ResponseWriter, err error) error {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		r.log.Printf("not ready: %v", err)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(resp, "not ready: %v\n", err)
+		return nil
+	}
+	resp.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(resp, "ok\n")
+	return nil
+}
+
 func (r *Registry) homeHandler(w http.ResponseWriter, req *http.Request) error {
 	http.Redirect(w, req, "https://container-registry.com/helm-charts-oci-proxy/", 302)
 	return nil
 }
 
 func (r *Registry) root(resp http.ResponseWriter, req *http.Request) {
-	if err := r.v2(resp, req); err != nil {
+	start := time.Now()
+	// probes are cheap and must not fail because of load
+	if r.inflight != nil && req.URL.Path != "/healthz" && req.URL.Path != "/readyz" {
+		select {
+		case r.inflight <- struct{}{}:
+			defer func() { <-r.inflight }()
+		default:
+			// shed the request instead of queueing it, so the proxy stays responsive under overload
+			r.logRequest(req, http.StatusServiceUnavailable, start, "too many requests in flight")
+			resp.Header().Set("Retry-After", "1")
+			_ = (&errors.RegError{
+				Status:  http.StatusServiceUnavailable,
+				Code:    "UNAVAILABLE",
+				Message: "too many requests in flight, retry later",
+			}).Write(resp)
+			return
+		}
+	}
+	ctx, span := tracing.Start(req.Context(), "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+			attribute.String("repo", repoName(req.URL.Path)),
+		))
+	defer span.End()
+	req = req.WithContext(ctx)
+
+	sw := &statusWriter{ResponseWriter: resp}
+	defer func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}()
+	if err := r.v2(sw, req); err != nil {
 		if regErr, ok := err.(*errors.RegError); ok {
-			r.log.Printf("%s %s %d %s %s", req.Method, req.URL, regErr.Status, regErr.Code, regErr.Message)
-			_ = regErr.Write(resp)
+			r.logRequest(req, regErr.Status, start, regErr.Code+" "+regErr.Message)
+			_ = regErr.Write(sw)
 		} else {
-			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			http.Error(sw, err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 	if r.debug {
-		r.log.Printf("%s - %s", req.Method, req.URL)
+		r.logRequest(req, sw.status, start, "")
 	}
 }
 
@@ -125,6 +266,12 @@ func New(manifests Handler, blobs Handler, tags Handler, catalog Handler, opts .
 	if r.log == nil {
 		r.log = log.Default()
 	}
+	if r.pathPrefix != "" {
+		// the routing only sees the path below the prefix, links handed to clients get it back
+		return http.StripPrefix(r.pathPrefix, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			r.root(resp, helper.WithPathPrefix(req, r.pathPrefix))
+		}))
+	}
 	return http.HandlerFunc(r.root)
 }
 
@@ -145,9 +292,104 @@ func Debug(v bool) Option {
 	}
 }
 
-func prettyEncode(data interface{}, out io.Writer) error {
+// Metrics serves the metrics handler at /metrics.
+func Metrics(h http.Handler) Option {
+	return func(r *Registry) {
+		r.metrics = h
+	}
+}
+
+// PathPrefix serves the registry below the prefix, e.g. /charts when mounted at /charts/ of another mux.
+// Requests outside of it get a 404.
+func PathPrefix(prefix string) Option {
+	return func(r *Registry) {
+		r.pathPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// PrettyJSON indents JSON responses of the API handlers.
+func PrettyJSON(v bool) Option {
+	return func(r *Registry) {
+		r.prettyJSON = v
+	}
+}
+
+// Index serves the index.yaml of chart repositories with the given handler.
+func Index(h Handler) Option {
+	return func(r *Registry) {
+		r.index = h
+	}
+}
+
+// Archive serves the chart archives next to the index.yaml of chart repositories with the given handler.
+func Archive(h Handler) Option {
+	return func(r *Registry) {
+		r.archive = h
+	}
+}
+
+// DebugIndexPath is the path prefix the debug index handler is served at.
+const DebugIndexPath = "/debug/index/"
+
+// DebugIndex serves the parsed index of chart repositories at /debug/index/<repo-path> with the given handler.
+// It's only reachable with Debug enabled.
+func DebugIndex(h Handler) Option {
+	return func(r *Registry) {
+		r.debugIndex = h
+	}
+}
+
+// InvalidatePath is the path the invalidate handler is served at.
+const InvalidatePath = "/admin/invalidate"
+
+// Invalidate serves the given handler at /admin/invalidate, to requests with the token as Bearer token.
+// Without a token the endpoint is disabled.
+func Invalidate(token string, h Handler) Option {
+	return func(r *Registry) {
+		if token != "" {
+			r.adminToken = token
+			r.invalidate = h
+		}
+	}
+}
+
+// Referrers serves the referrers API with the given handler.
+func Referrers(h Handler) Option {
+	return func(r *Registry) {
+		r.referrers = h
+	}
+}
+
+// Ready checks readiness at /readyz, e.g. that the blob backend is reachable.
+// /healthz answers regardless as long as the server is up.
+func Ready(check func(ctx context.Context) error) Option {
+	return func(r *Registry) {
+		r.ready = check
+	}
+}
+
+// IndexOnly disables the OCI manifest, blob, tag and catalog endpoints, so only index files are served.
+func IndexOnly(v bool) Option {
+	return func(r *Registry) {
+		r.indexOnly = v
+	}
+}
+
+// MaxInflight caps the number of requests handled concurrently, requests beyond it get a 503.
+// Zero or less means unlimited.
+func MaxInflight(n int) Option {
+	return func(r *Registry) {
+		if n > 0 {
+			r.inflight = make(chan struct{}, n)
+		}
+	}
+}
+
+func (r *Registry) encode(data interface{}, out io.Writer) error {
 	enc := json.NewEncoder(out)
-	enc.SetIndent("", "    ")
+	if r.prettyJSON {
+		enc.SetIndent("", "    ")
+	}
 	if err := enc.Encode(data); err != nil {
 		return err
 	}
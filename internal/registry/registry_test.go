@@ -0,0 +1,442 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
+)
+
+func TestMaxInflightShedsExcessRequests(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	blocking := func(resp http.ResponseWriter, req *http.Request) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	}
+	h := New(blocking, blocking, blocking, blocking, Logger(log.New(io.Discard, "", 0)), MaxInflight(1))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil))
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	close(release)
+	<-done
+
+	// the slot is free again
+	go func() { <-entered }()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d after release, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRejectScannerProbes(t *testing.T) {
+	var called bool
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called = true
+		return nil
+	}
+	r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)))
+
+	for _, path := range []string{"/favicon.ico", "/.env", "/v2/.git/config", "/wp-login.php", "/charts.example.com/.aws/credentials"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+	if called {
+		t.Error("scanner probe reached a handler")
+	}
+
+	for _, path := range []string{"/v2/", "/v2/charts.example.com/app/manifests/1.0.0", "/charts.example.com/v2/_catalog"} {
+		called = false
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if path != "/v2/" && !called {
+			t.Errorf("%s: valid path didn't reach its handler", path)
+		}
+	}
+}
+
+func TestIndexOnly(t *testing.T) {
+	var called []string
+	handler := func(name string) Handler {
+		return func(resp http.ResponseWriter, req *http.Request) error {
+			called = append(called, name)
+			return nil
+		}
+	}
+	r := New(handler("manifests"), handler("blobs"), handler("tags"), handler("catalog"),
+		Logger(log.New(io.Discard, "", 0)), Index(handler("index")), IndexOnly(true))
+
+	for _, path := range []string{
+		"/v2/charts.example.com/app/manifests/1.0.0",
+		"/v2/charts.example.com/app/blobs/sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		"/v2/charts.example.com/app/tags/list",
+		"/v2/_catalog",
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/charts.example.com/index.yaml", nil))
+	if len(called) != 1 || called[0] != "index" {
+		t.Errorf("got handlers %v called, want the index handler only", called)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	var called bool
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called = true
+		return nil
+	}
+	var notReady error
+	r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), Ready(func(ctx context.Context) error {
+		return notReady
+	}))
+
+	for _, tc := range []struct {
+		path     string
+		notReady error
+		want     int
+	}{
+		{"/healthz", nil, http.StatusOK},
+		{"/readyz", nil, http.StatusOK},
+		{"/healthz", fmt.Errorf("redis down"), http.StatusOK},
+		{"/readyz", fmt.Errorf("redis down"), http.StatusServiceUnavailable},
+	} {
+		notReady = tc.notReady
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s with %v: got status %d, want %d", tc.path, tc.notReady, rec.Code, tc.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%s: got content type %q, want plain text", tc.path, ct)
+		}
+	}
+	if called {
+		t.Error("probes reached the registry handlers")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	var called int
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called++
+		return nil
+	}
+	r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), BasicAuth(map[string]string{"helm": "s3cret"}, "charts"))
+
+	for _, tc := range []struct {
+		path               string
+		username, password string
+		want               int
+	}{
+		{"/v2/", "", "", http.StatusUnauthorized},
+		{"/v2/charts.example.com/app/manifests/1.0.0", "", "", http.StatusUnauthorized},
+		{"/v2/charts.example.com/app/manifests/1.0.0", "helm", "wrong", http.StatusUnauthorized},
+		{"/v2/charts.example.com/app/manifests/1.0.0", "other", "s3cret", http.StatusUnauthorized},
+		{"/healthz", "", "", http.StatusOK},
+		{"/v2/", "helm", "s3cret", http.StatusOK},
+		{"/v2/charts.example.com/app/manifests/1.0.0", "helm", "s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s as %q: got status %d, want %d", tc.path, tc.username, rec.Code, tc.want)
+		}
+		if challenge := rec.Header().Get("WWW-Authenticate"); tc.want == http.StatusUnauthorized && challenge != `Basic realm="charts"` {
+			t.Errorf("%s as %q: got challenge %q", tc.path, tc.username, challenge)
+		}
+	}
+	if called != 1 {
+		t.Errorf("handler called %d times, want once for the authenticated pull", called)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	var called int
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called++
+		return nil
+	}
+	srv := httptest.NewServer(New(h, h, h, h, Logger(log.New(io.Discard, "", 0)),
+		BasicAuth(map[string]string{"helm": "s3cret"}, "charts"),
+		TokenAuth([]byte("key"), time.Minute, "proxy", "")))
+	defer srv.Close()
+
+	get := func(url string, auth func(req *http.Request)) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	manifestURL := srv.URL + "/v2/charts.example.com/app/manifests/1.0.0"
+
+	// challenge
+	resp := get(manifestURL, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d without token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	wantChallenge := fmt.Sprintf(`Bearer realm="%s/token",service="proxy",scope="repository:charts.example.com/app:pull"`, srv.URL)
+	if got := resp.Header.Get("WWW-Authenticate"); got != wantChallenge {
+		t.Fatalf("got challenge %q, want %q", got, wantChallenge)
+	}
+
+	// token
+	tokenURL := srv.URL + "/token?service=proxy&scope=repository:charts.example.com/app:pull,push"
+	if resp = get(tokenURL, func(req *http.Request) { req.SetBasicAuth("helm", "wrong") }); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a token with wrong credentials, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	resp = get(tokenURL, func(req *http.Request) { req.SetBasicAuth("helm", "s3cret") })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d for a token, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var token struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" || token.ExpiresIn != 60 {
+		t.Fatalf("got token %+v", token)
+	}
+
+	// pull
+	if resp = get(manifestURL, bearer(token.Token)); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d with token, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp = get(srv.URL+"/v2/", bearer(token.Token)); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for /v2/ with token, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp = get(srv.URL+"/v2/charts.example.com/other/manifests/1.0.0", bearer(token.Token)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for another repo, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if resp = get(manifestURL, bearer(token.Token+"x")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d with a tampered token, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if called != 1 {
+		t.Errorf("handler called %d times, want once for the authorized pull", called)
+	}
+}
+
+func TestParseTokenExpiry(t *testing.T) {
+	r := &Registry{tokenKey: []byte("key"), tokenService: "proxy"}
+	now := time.Now()
+	token, err := r.signToken(tokenClaims{Audience: "proxy", NotBefore: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.parseToken(token, now); err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+	if _, err = r.parseToken(token, now.Add(time.Minute)); err == nil {
+		t.Error("got no error for an expired token")
+	}
+	other := &Registry{tokenKey: []byte("key"), tokenService: "other"}
+	if _, err = other.parseToken(token, now); err == nil {
+		t.Error("got no error for a token of another service")
+	}
+}
+
+func TestDebugIndexNeedsDebug(t *testing.T) {
+	var called bool
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called = true
+		return nil
+	}
+	for _, debug := range []bool{false, true} {
+		called = false
+		r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), DebugIndex(h), Debug(debug))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/index/charts.example.com/stable", nil))
+		if called != debug {
+			t.Errorf("debug %v: got debug index called %v", debug, called)
+		}
+		if !debug && rec.Code != http.StatusNotFound {
+			t.Errorf("got status %d without debug, want %d", rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestHelmHTTPArchives(t *testing.T) {
+	var called []string
+	handler := func(name string) Handler {
+		return func(resp http.ResponseWriter, req *http.Request) error {
+			called = append(called, name)
+			return nil
+		}
+	}
+	r := New(handler("manifests"), handler("blobs"), handler("tags"), handler("catalog"),
+		Logger(log.New(io.Discard, "", 0)), Index(handler("index")), Archive(handler("archive")))
+
+	for _, path := range []string{
+		"/charts.example.com/stable/index.yaml",
+		"/charts.example.com/stable/app-1.0.0.tgz",
+		"/v2/charts.example.com/stable/app/manifests/1.0.0",
+	} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if want := "index archive manifests"; strings.Join(called, " ") != want {
+		t.Errorf("got handlers %v called, want %s", called, want)
+	}
+}
+
+func TestInvalidateNeedsAdminToken(t *testing.T) {
+	var called bool
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called = true
+		return nil
+	}
+	r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), BasicAuth(map[string]string{"user": "pass"}, "test"),
+		Invalidate("secret", h))
+	for auth, want := range map[string]int{
+		"":                   http.StatusUnauthorized,
+		"Bearer wrong":       http.StatusUnauthorized,
+		"Basic dXNlcjpwYXNz": http.StatusUnauthorized,
+		"Bearer secret":      http.StatusOK,
+	} {
+		called = false
+		req := httptest.NewRequest(http.MethodPost, "/admin/invalidate?repo=charts.example.com", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != want || called != (want == http.StatusOK) {
+			t.Errorf("%q: got status %d and handler called %v, want %d", auth, rec.Code, called, want)
+		}
+	}
+
+	// disabled without a token
+	called = false
+	r = New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), Invalidate("", h))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/invalidate?repo=charts.example.com", nil))
+	if called || rec.Code != http.StatusNotFound {
+		t.Errorf("without token: got status %d and handler called %v, want %d", rec.Code, called, http.StatusNotFound)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	var called []string
+	h := func(resp http.ResponseWriter, req *http.Request) error {
+		called = append(called, req.URL.Path)
+		return nil
+	}
+	r := New(h, h, h, h, Logger(log.New(io.Discard, "", 0)), PathPrefix("/charts/"))
+	for path, want := range map[string]int{
+		"/charts/v2/charts.example.com/app/manifests/1.0.0": http.StatusOK,
+		"/charts/healthz": http.StatusOK,
+		"/v2/charts.example.com/app/manifests/1.0.0": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, want)
+		}
+	}
+	if len(called) != 1 || called[0] != "/v2/charts.example.com/app/manifests/1.0.0" {
+		t.Errorf("got handlers called for %v, want the manifest without the prefix", called)
+	}
+}
+
+// nopCache never holds anything, for tests which write their manifests directly.
+type nopCache struct{}
+
+func (nopCache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool { return false }
+func (nopCache) Get(key interface{}) (interface{}, bool)                               { return nil, false }
+func (nopCache) Del(key interface{})                                                   {}
+
+func TestPrettyJSON(t *testing.T) {
+	for _, pretty := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		m := manifest.NewManifests(ctx, mem.NewMemHandler(), manifest.Config{}, nopCache{}, log.New(io.Discard, "", 0))
+		blob := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+		if err := m.Write("charts.example.com/app", "1.0.0", manifest.Manifest{ContentType: "application/vnd.oci.image.manifest.v1+json", Blob: blob, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		r := New(m.Handle, m.Handle, m.HandleTags, m.HandleCatalog, Logger(log.New(io.Discard, "", 0)), PrettyJSON(pretty))
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+		if indented := strings.Contains(rec.Body.String(), "\n    \"version\""); indented != pretty {
+			t.Errorf("pretty %v: got indented %v in %q", pretty, indented, rec.Body.String())
+		}
+		var version struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &version); err != nil || version.Version != "v2.0" {
+			t.Errorf("pretty %v: got version %q, %v", pretty, version.Version, err)
+		}
+
+		// manifests are served as stored, their digest and size still match
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/charts.example.com/app/manifests/1.0.0", nil))
+		if !bytes.Equal(rec.Body.Bytes(), blob) {
+			t.Fatalf("pretty %v: got manifest %q, want %q", pretty, rec.Body.String(), blob)
+		}
+		want := fmt.Sprintf("sha256:%x", sha256.Sum256(rec.Body.Bytes()))
+		if got := rec.Header().Get("Docker-Content-Digest"); got != want {
+			t.Errorf("pretty %v: got Docker-Content-Digest %s, want %s", pretty, got, want)
+		}
+
+		rec = httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/v2/charts.example.com/app/manifests/1.0.0", nil))
+		if got := rec.Header().Get("Content-Length"); got != fmt.Sprint(len(blob)) {
+			t.Errorf("pretty %v: got HEAD Content-Length %s, want %d", pretty, got, len(blob))
+		}
+		if got := rec.Header().Get("Docker-Content-Digest"); got != want {
+			t.Errorf("pretty %v: got HEAD Docker-Content-Digest %s, want %s", pretty, got, want)
+		}
+	}
+}
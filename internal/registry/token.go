@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenPath is where the token endpoint of the token auth flow is served.
+const TokenPath = "/token"
+
+// TokenAuth switches BasicAuth to the token auth flow of the docker registry.
+// Clients are challenged for a Bearer token, which the token endpoint issues to the BasicAuth users for pulling.
+// Tokens are JWTs signed with the key and expire after ttl. The realm is the URL of the token endpoint,
+// derived from the request if empty, the service tells the proxy apart from other registries sharing the token endpoint.
+func TokenAuth(key []byte, ttl time.Duration, service string, realm string) Option {
+	return func(r *Registry) {
+		r.tokenKey = key
+		r.tokenTTL = ttl
+		r.tokenService = service
+		r.tokenRealm = realm
+	}
+}
+
+// tokenClaims are the claims of the JWTs issued by the token endpoint.
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  string        `json:"aud"`
+	IssuedAt  int64         `json:"iat"`
+	NotBefore int64         `json:"nbf"`
+	ExpiresAt int64         `json:"exp"`
+	Access    []tokenAccess `json:"access"`
+}
+
+// tokenAccess is a resource and the actions granted on it.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// allows tells whether the claims grant the action on the resource.
+func (c *tokenClaims) allows(typ, name, action string) bool {
+	for _, a := range c.Access {
+		if a.Type != typ || a.Name != name {
+			continue
+		}
+		for _, granted := range a.Actions {
+			if granted == action || granted == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken returns the claims as JWT signed with HMAC-SHA256.
+func (r *Registry) signToken(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, r.tokenKey)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken verifies the signature, audience and validity period of the JWT and returns its claims.
+func (r *Registry) parseToken(token string, now time.Time) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	if parts[0] != tokenHeader {
+		return nil, fmt.Errorf("unsupported token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, r.tokenKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	var claims tokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	if claims.Audience != r.tokenService {
+		return nil, fmt.Errorf("token issued for service %q", claims.Audience)
+	}
+	if now.Unix() < claims.NotBefore || now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired or not valid yet")
+	}
+	return &claims, nil
+}
+
+// tokenHandler issues tokens for the scopes asked for to users authenticating with their Basic credentials.
+// Only pulls are granted, the proxy can't be pushed to.
+func (r *Registry) tokenHandler(resp http.ResponseWriter, req *http.Request) error {
+	username, password, ok := req.BasicAuth()
+	if !ok || !r.validCredentials(username, password) {
+		return r.basicChallenge()
+	}
+	query := req.URL.Query()
+	if service := query.Get("service"); service != "" && service != r.tokenService {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    "UNSUPPORTED",
+			Message: fmt.Sprintf("tokens are issued for service %q only", r.tokenService),
+		}
+	}
+
+	var access []tokenAccess
+	for _, scopes := range query["scope"] {
+		for _, scope := range strings.Fields(scopes) {
+			if a, ok := grantedAccess(scope); ok {
+				access = append(access, a)
+			}
+		}
+	}
+	now := time.Now()
+	token, err := r.signToken(tokenClaims{
+		Issuer:    r.tokenService,
+		Subject:   username,
+		Audience:  r.tokenService,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(r.tokenTTL).Unix(),
+		Access:    access,
+	})
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	if err = r.encode(struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
+	}{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(r.tokenTTL.Seconds()),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	}, resp); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
+
+// grantedAccess returns the access granted for a scope like repository:charts.example.com/app:pull,push.
+// Repository names may contain a port, so the type ends at the first colon and the actions start after the last one.
+func grantedAccess(scope string) (tokenAccess, bool) {
+	first, last := strings.Index(scope, ":"), strings.LastIndex(scope, ":")
+	if first < 0 || first == last {
+		return tokenAccess{}, false
+	}
+	a := tokenAccess{Type: scope[:first], Name: scope[first+1 : last]}
+	for _, action := range strings.Split(scope[last+1:], ",") {
+		switch {
+		case a.Type == "repository" && action == "pull",
+			a.Type == "registry" && a.Name == "catalog" && action == "*":
+			a.Actions = append(a.Actions, action)
+		}
+	}
+	return a, len(a.Actions) > 0
+}
+
+// authenticateToken checks the Bearer token of the request grants access to what it asks for.
+// Requests without a valid token get challenged for one with the scope they need.
+func (r *Registry) authenticateToken(req *http.Request) *errors.RegError {
+	typ, name, action := requiredScope(req)
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := r.parseToken(token, time.Now())
+		if err == nil && (typ == "" || claims.allows(typ, name, action)) {
+			return nil
+		}
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q,service=%q", r.tokenRealmURL(req), r.tokenService)
+	if typ != "" {
+		challenge += fmt.Sprintf(",scope=%q", typ+":"+name+":"+action)
+	}
+	return &errors.RegError{
+		Status:  http.StatusUnauthorized,
+		Code:    "UNAUTHORIZED",
+		Message: "authentication required",
+		Header: http.Header{
+			"Www-Authenticate":                {challenge},
+			"Docker-Distribution-Api-Version": {"registry/2.0"},
+		},
+	}
+}
+
+// requiredScope returns the resource and action a request needs to be granted, none for the API version check and index files.
+func requiredScope(req *http.Request) (typ, name, action string) {
+	if helper.IsCatalog(req) {
+		return "registry", "catalog", "*"
+	}
+	if repo := repoName(req.URL.Path); repo != "" {
+		return "repository", repo, "pull"
+	}
+	return "", "", ""
+}
+
+// tokenRealmURL returns the URL of the token endpoint clients get pointed to.
+func (r *Registry) tokenRealmURL(req *http.Request) string {
+	if r.tokenRealm != "" {
+		return r.tokenRealm
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + helper.PathPrefix(req) + TokenPath
+}
@@ -0,0 +1,41 @@
+// Package tracing sets up OpenTelemetry tracing of requests, index and chart downloads and chart packing.
+// Without an OTLP endpoint configured all spans are no-ops.
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "github.com/container-registry/helm-charts-oci-proxy"
+
+// Setup exports spans via OTLP over HTTP if OTEL_EXPORTER_OTLP_ENDPOINT is set,
+// the exporter takes the rest of its configuration from the standard OTEL_EXPORTER_OTLP_* env vars.
+// The returned func flushes pending spans, it's a no-op if tracing is disabled.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("helm-charts-oci-proxy"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start starts a span with the tracer of the proxy.
+func Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(name).Start(ctx, spanName, opts...)
+}
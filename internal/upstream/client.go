@@ -0,0 +1,177 @@
+// Package upstream builds the HTTP client shared by all requests to upstream
+// chart repositories, OCI registries and the parent registry.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config customizes the upstream transport.
+type Config struct {
+	// DNS is the host[:port] of the DNS server resolving upstream hosts, the system resolver is used if empty
+	DNS string
+	// DialTimeout limits connecting, TLSHandshakeTimeout the TLS handshake, 0 uses the defaults of 30s and 10s
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Timeout limits a whole request including reading the body, 0 means no limit
+	Timeout time.Duration
+	// RootCAs verifies upstream certificates, the system roots are used if nil
+	RootCAs *x509.CertPool
+	// AllowPrivate allows connecting to loopback, link-local and private addresses, which are refused by default,
+	// so crafted repo paths can't reach internal services. TrustedHosts, like the parent registry, are always allowed,
+	// as are the proxies configured by the environment.
+	AllowPrivate bool
+	TrustedHosts []string
+	// UserAgent is sent with every request, replacing the one of Go or the library making it, if not empty
+	UserAgent string
+}
+
+// ErrPrivateAddress is returned for connections to a loopback, link-local or private address without AllowPrivate.
+var ErrPrivateAddress = errors.New("connecting to a private address is not allowed")
+
+// LoadCAFile returns the system roots extended by the PEM encoded certificates in the file,
+// so upstreams behind an internal CA can be trusted next to public ones.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// NewClient returns the upstream client for the config.
+// It goes through the proxy configured by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func NewClient(config Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if config.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.RootCAs, MinVersion: tls.VersionTLS12}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if config.DialTimeout > 0 {
+		dialer.Timeout = config.DialTimeout
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.DNS != "" {
+		dialer.Resolver = resolver(config.DNS)
+	}
+	transport.DialContext = dialer.DialContext
+	if !config.AllowPrivate {
+		transport.DialContext = guardedDial(dialer, append(proxyHosts(), config.TrustedHosts...))
+	}
+
+	var rt http.RoundTripper = transport
+	if config.UserAgent != "" {
+		rt = &userAgentTransport{RoundTripper: transport, userAgent: config.UserAgent}
+	}
+	return &http.Client{Transport: rt, Timeout: config.Timeout}
+}
+
+// DefaultUserAgent returns helm-charts-oci-proxy/<version>, with the module version the binary was built from,
+// or just helm-charts-oci-proxy if the version isn't known, as for local builds.
+func DefaultUserAgent() string {
+	ua := "helm-charts-oci-proxy"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		ua += "/" + info.Main.Version
+	}
+	return ua
+}
+
+// userAgentTransport sets the User-Agent of every request.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// guardedDial dials trusted hosts as usual and refuses private addresses for all others.
+// Addresses are checked once resolved, so host names resolving to private addresses are refused too.
+func guardedDial(dialer *net.Dialer, trusted []string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	trustedHosts := map[string]bool{}
+	for _, h := range trusted {
+		trustedHosts[strings.ToLower(h)] = true
+	}
+	guarded := *dialer
+	guarded.Control = func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || isPrivate(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+		}
+		return nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if trustedHosts[strings.ToLower(addr)] || trustedHosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// proxyHosts returns the hosts of the proxies configured by the environment, which are commonly internal.
+func proxyHosts() []string {
+	var hosts []string
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if v := os.Getenv(name); v != "" {
+			if !strings.Contains(v, "://") {
+				v = "http://" + v
+			}
+			if u, err := url.Parse(v); err == nil && u.Host != "" {
+				hosts = append(hosts, u.Host, u.Hostname())
+			}
+		}
+	}
+	return hosts
+}
+
+// resolver returns a resolver sending all lookups to the given DNS server.
+func resolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
@@ -0,0 +1,213 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveDNS answers every A query with 127.0.0.1 and any other query with no records.
+func serveDNS(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+			// question name ends with a zero length label, followed by type and class
+			end := 12
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			if end+5 > len(q) {
+				continue
+			}
+			question := q[12 : end+5]
+			isA := binary.BigEndian.Uint16(q[end+1:]) == 1
+
+			resp := append([]byte{}, q[:2]...)          // id
+			resp = append(resp, 0x81, 0x80)             // response, recursion available
+			resp = append(resp, 0, 1, 0, 0, 0, 0, 0, 0) // counts, answer count set below
+			if isA {
+				resp[7] = 1
+			}
+			resp = append(resp, question...)
+			if isA {
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNewClientCustomDNS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	client := NewClient(Config{DNS: serveDNS(t), AllowPrivate: true})
+	resp, err := client.Get(fmt.Sprintf("http://charts.internal.invalid:%s/index.yaml", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("got %q from the resolved host", body)
+	}
+}
+
+func TestNewClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := NewClient(Config{Timeout: 50 * time.Millisecond, AllowPrivate: true})
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(srv.URL + "/index.yaml")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got a response from a hanging upstream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request to a hanging upstream is blocking")
+	}
+}
+
+func TestNewClientUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.UserAgent())
+	}))
+	defer srv.Close()
+
+	client := NewClient(Config{AllowPrivate: true, UserAgent: "helm-charts-oci-proxy/v1.2.3"})
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/index.yaml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// libraries like oras set their own
+	req.Header.Set("User-Agent", "oras-go")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "helm-charts-oci-proxy/v1.2.3" {
+		t.Errorf("got User-Agent %q", got)
+	}
+	if req.Header.Get("User-Agent") != "oras-go" {
+		t.Error("the request got modified")
+	}
+}
+
+func TestNewClientCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	if resp, err := NewClient(Config{AllowPrivate: true}).Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("got a response from an upstream with an untrusted certificate")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := LoadCAFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewClient(Config{RootCAs: pool, AllowPrivate: true}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestLoadCAFileWithoutCertificates(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCAFile(caFile); err == nil {
+		t.Error("got no error for a file without certificates")
+	}
+}
+
+func TestNewClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	client := NewClient(Config{DNS: serveDNS(t)})
+	for _, u := range []string{
+		srv.URL + "/index.yaml",
+		"http://169.254.169.254/latest/meta-data/",
+		// resolves to 127.0.0.1
+		fmt.Sprintf("http://charts.internal.invalid:%s/index.yaml", port),
+	} {
+		resp, err := client.Get(u)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("%s: got error %v, want %v", u, err, ErrPrivateAddress)
+		}
+	}
+}
+
+func TestNewClientTrustedHosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	resp, err := NewClient(Config{TrustedHosts: []string{srv.Listener.Addr().String()}}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,45 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/proxy"
+)
+
+// The proxy mounted below /charts/ of an existing mux.
+func ExampleNewWithDefaults() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := proxy.NewWithDefaults(ctx, proxy.PathPrefix("/charts"), proxy.Logger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/charts/", p)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "the rest of the program\n")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, path := range []string{"/charts/healthz", "/charts/v2/", "/"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		fmt.Println(strings.TrimSpace(fmt.Sprintf("%s %d %s", path, resp.StatusCode, body)))
+	}
+	// Output:
+	// /charts/healthz 200 ok
+	// /charts/v2/ 200
+	// / 200 the rest of the program
+}
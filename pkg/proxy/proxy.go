@@ -0,0 +1,163 @@
+// Package proxy embeds the Helm charts OCI proxy into other programs, e.g. next to the handlers of an existing mux.
+// It serves the charts of Helm repositories as OCI artifacts like the serve command does with its default settings,
+// keeping indexes, manifests and blobs in memory.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/registry"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/upstream"
+	"github.com/dgraph-io/ristretto"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAddress is the address Run listens on if none is set.
+const DefaultAddress = "0.0.0.0:9000"
+
+// Proxy is the http.Handler of an embedded proxy.
+type Proxy struct {
+	handler http.Handler
+	address string
+	log     logrus.StdLogger
+}
+
+type options struct {
+	address    string
+	pathPrefix string
+	log        logrus.StdLogger
+}
+
+// Option describes the available options for creating the proxy.
+type Option func(o *options)
+
+// Address sets the host:port Run listens on, DefaultAddress if empty.
+func Address(address string) Option {
+	return func(o *options) {
+		o.address = address
+	}
+}
+
+// PathPrefix serves the proxy below the prefix, e.g. /charts when mounted at /charts/ of another mux.
+// OCI clients expect the registry API at the root of the host, so a prefix mostly suits hosts which only proxy charts,
+// or reverse proxies which strip it.
+func PathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.pathPrefix = prefix
+	}
+}
+
+// Logger overrides the logger of the proxy, which logs to stdout by default.
+func Logger(l logrus.StdLogger) Option {
+	return func(o *options) {
+		o.log = l
+	}
+}
+
+// NewWithDefaults sets up a proxy with the defaults of the serve command: an in-memory index cache and blob handler,
+// manifests cached for 1 minute, indexes for 4 hours and failed index downloads for 30 seconds.
+// Cached manifests are cleaned up in the background until ctx is done.
+func NewWithDefaults(ctx context.Context, opts ...Option) (*Proxy, error) {
+	o := options{address: DefaultAddress}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.address == "" {
+		o.address = DefaultAddress
+	}
+	if o.log == nil {
+		o.log = log.New(os.Stdout, "proxy-", log.LstdFlags)
+	}
+
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,       // number of keys to track frequency of (10M).
+		MaxCost:     100000000, // maximum cost of cache (1GB).
+		BufferItems: 64,        // number of keys per Get buffer.
+	})
+	if err != nil {
+		return nil, err
+	}
+	blobsHandler := mem.NewMemHandler()
+	client := upstream.NewClient(upstream.Config{
+		Timeout:   2 * time.Minute,
+		UserAgent: upstream.DefaultUserAgent(),
+	})
+
+	manifests := manifest.NewManifests(ctx, blobsHandler, manifest.Config{
+		CacheTTL:              time.Minute,
+		IndexCacheTTL:         4 * time.Hour,
+		IndexErrorCacheTTl:    30 * time.Second,
+		NotFoundCacheTTL:      10 * time.Second,
+		IndexNotFoundCacheTTL: 5 * time.Minute,
+		SiblingPolicy:         manifest.SiblingsProvenance,
+		CreatedPolicy:         manifest.CreatedFromChart,
+		Client:                client,
+		VerifyChartDigest:     true,
+		CopyConcurrency:       1,
+		MaxChartSize:          100 << 20,
+		MaxIndexSize:          50 << 20,
+		DownloadQueueTimeout:  10 * time.Second,
+		MaxRetries:            2,
+		RetryBackoff:          500 * time.Millisecond,
+	}, cache, o.log)
+	blobsHttpHandler := blobs.NewBlobs(blobsHandler, blobs.Config{Client: client}, o.log)
+
+	return &Proxy{
+		handler: registry.New(
+			manifests.Handle,
+			blobsHttpHandler.Handle,
+			manifests.HandleTags,
+			manifests.HandleCatalog,
+			registry.Logger(o.log),
+			registry.Referrers(manifests.HandleReferrers),
+			registry.PathPrefix(o.pathPrefix)),
+		address: o.address,
+		log:     o.log,
+	}, nil
+}
+
+func (p *Proxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	p.handler.ServeHTTP(resp, req)
+}
+
+// Run serves the proxy on its address until ctx is done, then lets running requests finish for up to 10 seconds.
+// Programs mounting the proxy on their own server don't need it.
+func (p *Proxy) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.address)
+	if err != nil {
+		return err
+	}
+	s := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second, // prevent slowloris
+		Handler:           p,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		p.log.Printf("listening HTTP on %s", listener.Addr())
+		errCh <- s.Serve(listener)
+	}()
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err = <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}